@@ -0,0 +1,286 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"saferay/internal/capture"
+)
+
+func newAnalyzeCmd() *cobra.Command {
+	var tunnel, iface string
+
+	cmd := &cobra.Command{
+		Use:   "analyze <capture>",
+		Short: "Find DNS queries that left outside the tunnel in a capture",
+		Long: `Decode a pcap or pcapng capture and flag every DNS query (UDP or TCP
+port 53) that left on an interface other than the tunnel.
+
+pcapng captures and pf logs record each packet's interface; for a classic
+pcap from a single interface, name it with --iface. Queries to loopback
+and to split DNS resolvers are not leaks, nor are those pf blocked.`,
+		Example: "  sudo tcpdump -i en0 -w en0.pcap port 53\n  saferay analyze en0.pcap --iface en0",
+		Args:    cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg := loadConfig()
+			if tunnel == "" {
+				tunnel = tunnelInterface(cfg)
+			}
+			analyzeCapture(args[0], tunnel, iface, cfg)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&tunnel, "tunnel", "", "tunnel interface (default from config)")
+	cmd.Flags().StringVar(&iface, "iface", "", "interface a classic pcap was captured on")
+
+	return onPlatforms(cmd, anyPlatform)
+}
+
+// Where an analysed query went
+const (
+	verdictTunnel  = "tunnel"
+	verdictLocal   = "local"
+	verdictSplit   = "split"
+	verdictBlocked = "blocked"
+	verdictLeak    = "leak"
+	verdictUnknown = "unknown"
+)
+
+// dnsQuery is a DNS query found in a capture
+type dnsQuery struct {
+	Time      time.Time `json:"time"`
+	Interface string    `json:"interface"`
+	Src       string    `json:"src"`
+	Dst       string    `json:"dst"`
+	Proto     string    `json:"proto"`
+	Query     string    `json:"query"`
+	Type      string    `json:"type"`
+	// ClientSubnet is the EDNS Client Subnet the query discloses
+	ClientSubnet string `json:"client_subnet,omitempty"`
+	Verdict      string `json:"verdict"`
+}
+
+// analyzeReport is the result of 'saferay analyze'
+type analyzeReport struct {
+	report
+	File    string         `json:"file"`
+	Tunnel  string         `json:"tunnel"`
+	Packets int            `json:"packets"`
+	Skipped int            `json:"skipped"`
+	Queries int            `json:"queries"`
+	Counts  map[string]int `json:"counts"`
+	Leaks   []dnsQuery     `json:"leaks"`
+}
+
+func analyzeCapture(path, tunnel, iface string, cfg *Config) {
+	st := analyzeReport{report: newReport("analyze"), File: path, Tunnel: tunnel, Counts: map[string]int{}, Leaks: []dnsQuery{}}
+
+	queries, err := readCaptureQueries(path, iface, &st)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	split := map[string]bool{}
+	for _, route := range cfg.SplitDNS {
+		for _, ip := range route.Resolvers {
+			split[ip] = true
+		}
+	}
+
+	for _, q := range queries {
+		if q.Verdict == "" {
+			q.Verdict = queryVerdict(q, tunnel, split)
+		}
+		st.Queries++
+		st.Counts[q.Verdict]++
+		if q.Verdict == verdictLeak {
+			st.Leaks = append(st.Leaks, q)
+		}
+	}
+
+	if len(st.Leaks) > 0 {
+		st.notActive("%d DNS queries left outside %s", len(st.Leaks), tunnel)
+	}
+
+	finish(&st.report, st, func() {
+		fmt.Printf("=== %s: %d packets, %d DNS queries ===\n\n", path, st.Packets, st.Queries)
+		rows := []struct{ label, verdict string }{
+			{"Through tunnel (" + tunnel + "):", verdictTunnel},
+			{"Local resolver:", verdictLocal},
+			{"Split DNS:", verdictSplit},
+			{"Blocked by pf:", verdictBlocked},
+			{"Leaked:", verdictLeak},
+			{"No interface:", verdictUnknown},
+		}
+		for _, row := range rows {
+			fmt.Printf("%-26s %d\n", row.label, st.Counts[row.verdict])
+		}
+		if st.Skipped > 0 {
+			fmt.Printf("%-26s %d\n", "Undecodable packets:", st.Skipped)
+		}
+
+		if st.Counts[verdictUnknown] > 0 {
+			fmt.Println("\n  The capture doesn't record interfaces; pass --iface")
+		}
+		if len(st.Leaks) == 0 {
+			return
+		}
+
+		fmt.Println("\nLeaks:")
+		for _, q := range st.Leaks {
+			line := fmt.Sprintf("  %s  %-6s %s → %s  %s  %-5s %s",
+				q.Time.Local().Format("2006-01-02 15:04:05"), q.Interface, q.Src, q.Dst, q.Proto, q.Type, q.Query)
+			if q.ClientSubnet != "" {
+				line += "  ECS " + q.ClientSubnet
+			}
+			fmt.Println(line)
+		}
+	})
+}
+
+// queryVerdict decides whether a query left through the tunnel
+func queryVerdict(q dnsQuery, tunnel string, split map[string]bool) string {
+	dst := net.ParseIP(q.Dst)
+	switch {
+	case dst != nil && dst.IsLoopback():
+		return verdictLocal
+	case q.Interface == "":
+		return verdictUnknown
+	case q.Interface == tunnel:
+		return verdictTunnel
+	case split[q.Dst]:
+		return verdictSplit
+	}
+	return verdictLeak
+}
+
+// tcpFlow reassembles the client side of a TCP DNS connection. Segments
+// are only taken in order; retransmissions and reordering are dropped.
+type tcpFlow struct {
+	first   dnsQuery
+	next    uint32
+	started bool
+	buf     []byte
+	queries int
+}
+
+// readCaptureQueries decodes the DNS queries in a capture, oldest first
+func readCaptureQueries(path, iface string, st *analyzeReport) ([]dnsQuery, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r, err := capture.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var queries []dnsQuery
+	flows := map[string]*tcpFlow{}
+	var order []string
+
+	for {
+		pkt, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		st.Packets++
+
+		frame, err := capture.Decode(pkt)
+		if err != nil {
+			st.Skipped++
+			continue
+		}
+		ip := frame.IP
+		if ip.DstPort != 53 {
+			continue
+		}
+
+		q := dnsQuery{
+			Time:      frame.Time,
+			Interface: frame.Interface,
+			Src:       ip.Src.String(),
+			Dst:       ip.Dst.String(),
+			Proto:     ip.Proto,
+			Query:     "-",
+			Type:      "-",
+		}
+		if q.Interface == "" {
+			q.Interface = iface
+		}
+		if frame.Pflog != nil && frame.Pflog.Action == capture.PflogDrop {
+			q.Verdict = verdictBlocked
+		}
+
+		if ip.Proto == "udp" {
+			msg, err := capture.ParseDNS(ip.Payload)
+			if err != nil || msg.Response {
+				continue
+			}
+			queries = append(queries, withQuestion(q, msg))
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%d>%s:%d", q.Src, ip.SrcPort, q.Dst, ip.DstPort)
+		flow := flows[key]
+		if flow == nil {
+			flow = &tcpFlow{first: q}
+			flows[key] = flow
+			order = append(order, key)
+		}
+		switch {
+		case ip.TCPFlags&capture.TCPSyn != 0:
+			flow.next, flow.started = ip.Seq+1, true
+			continue
+		case len(ip.Payload) == 0:
+			continue
+		case !flow.started:
+			// Joined mid-connection: take this segment as the start
+			flow.next, flow.started = ip.Seq, true
+		case ip.Seq != flow.next:
+			continue
+		}
+
+		flow.next += uint32(len(ip.Payload))
+		var msgs [][]byte
+		msgs, flow.buf = capture.SplitTCPDNS(append(flow.buf, ip.Payload...))
+		for _, data := range msgs {
+			if msg, err := capture.ParseDNS(data); err == nil && !msg.Response {
+				queries = append(queries, withQuestion(q, msg))
+				flow.queries++
+			}
+		}
+	}
+
+	// Connections that never carried a query, e.g. blocked at the SYN,
+	// still count as one attempt each
+	for _, key := range order {
+		if flows[key].queries == 0 {
+			queries = append(queries, flows[key].first)
+		}
+	}
+	sort.SliceStable(queries, func(i, j int) bool { return queries[i].Time.Before(queries[j].Time) })
+	return queries, nil
+}
+
+// withQuestion fills in a query's name, type and client subnet
+func withQuestion(q dnsQuery, msg capture.DNSMessage) dnsQuery {
+	if len(msg.Questions) > 0 {
+		q.Query = msg.Questions[0].Name
+		q.Type = msg.Questions[0].TypeName()
+	}
+	q.ClientSubnet = msg.EDNS.ClientSubnet()
+	return q
+}
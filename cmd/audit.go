@@ -0,0 +1,426 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/user"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// Every change the runner makes is appended to an audit log, one JSON
+// object per line. Each entry carries the hash of the one before it, so
+// editing or deleting an entry breaks the chain, and the head file
+// records the last hash so truncating the log is caught too.
+//
+// Only root can write the log. Unprivileged runs hand each entry to
+// 'sudo saferay audit append', which holds a lock while it chains it.
+
+// auditDir is where the audit log lives; a variable so tests can keep
+// their entries out of it
+var auditDir = func() string {
+	if runtime.GOOS == "linux" {
+		return "/var/lib/saferay"
+	}
+	return "/var/db/saferay"
+}
+
+func auditPath() string     { return auditDir() + "/audit.log" }
+func auditHeadPath() string { return auditDir() + "/audit.head" }
+
+// Audited actions
+const (
+	auditWrite  = "write"
+	auditRemove = "remove"
+	auditExec   = "exec"
+)
+
+// auditAbsent is the hash recorded for a file that doesn't exist
+const auditAbsent = "absent"
+
+// auditEntry is one change. Before and After are file hashes for writes
+// and removals, and the relevant state (DNS servers, pf status...) for
+// commands where saferay knows how to query it.
+type auditEntry struct {
+	Seq     int       `json:"seq"`
+	Time    time.Time `json:"time"`
+	User    string    `json:"user"`
+	UID     int       `json:"uid"`
+	PID     int       `json:"pid"`
+	Command string    `json:"command"`
+	Action  string    `json:"action"`
+	Target  string    `json:"target"`
+	Before  string    `json:"before,omitempty"`
+	After   string    `json:"after,omitempty"`
+	Error   string    `json:"error,omitempty"`
+	Prev    string    `json:"prev"`
+	Hash    string    `json:"hash"`
+}
+
+// digest is the entry's hash: SHA-256 over its JSON with Hash empty
+func (e auditEntry) digest() string {
+	e.Hash = ""
+	data, _ := json.Marshal(e)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// newAuditEntry fills in who and what for an action
+func newAuditEntry(action, target string) auditEntry {
+	e := auditEntry{
+		Time:    time.Now().UTC(),
+		UID:     os.Getuid(),
+		PID:     os.Getpid(),
+		Command: "saferay " + strings.Join(os.Args[1:], " "),
+		Action:  action,
+		Target:  target,
+	}
+	// Under sudo, record who ran it rather than root
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		e.User = sudoUser
+		if uid, err := strconv.Atoi(os.Getenv("SUDO_UID")); err == nil {
+			e.UID = uid
+		}
+	} else if u, err := user.Current(); err == nil {
+		e.User = u.Username
+	}
+	return e
+}
+
+// fileHash returns a file's SHA-256, or auditAbsent
+func fileHash(path string) string {
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		return "directory"
+	}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return auditAbsent
+	}
+	if err != nil {
+		return "unreadable"
+	}
+	return contentHash(data)
+}
+
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// auditState returns a query for the state a command changes, so its
+// entry can record the values before and after, or nil if there isn't one
+func auditState(args []string) func() string {
+	if len(args) < 2 {
+		return nil
+	}
+	switch {
+	case args[0] == "networksetup" && args[1] == "-setdnsservers" && len(args) > 2:
+		return func() string {
+			out, _ := exec.Command("networksetup", "-getdnsservers", args[2]).Output()
+			return strings.Join(strings.Fields(string(out)), " ")
+		}
+	case args[0] == "resolvectl" && len(args) > 2 && (args[1] == "dns" || args[1] == "domain" || args[1] == "dnsovertls"):
+		return func() string {
+			out, _ := exec.Command("resolvectl", args[1], args[2]).Output()
+			_, value, _ := strings.Cut(strings.TrimSpace(string(out)), ":")
+			return strings.TrimSpace(value)
+		}
+	case args[0] == "pfctl" && (args[1] == "-e" || args[1] == "-ef" || args[1] == "-d"):
+		return func() string {
+			out, _ := sudoQuery("pfctl", "-s", "info").CombinedOutput()
+			if strings.Contains(string(out), "Status: Enabled") {
+				return "pf enabled"
+			}
+			return "pf disabled"
+		}
+	case args[0] == "install" || args[0] == "rm":
+		// The file installed or removed is the last argument
+		path := args[len(args)-1]
+		return func() string { return fileHash(path) }
+	}
+	return nil
+}
+
+// appendAudit adds an entry to the audit log. Warnings rather than errors:
+// a change that was made shouldn't be reported as failed.
+func appendAudit(e auditEntry) {
+	var err error
+	if os.Geteuid() == 0 {
+		err = writeAuditEntry(e)
+	} else {
+		err = appendAuditAsRoot(e)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: couldn't write audit log: %v\n", err)
+	}
+}
+
+// appendAuditAsRoot passes the entry to 'sudo saferay audit append'
+func appendAuditAsRoot(e auditEntry) error {
+	self, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.Command("sudo", self, "audit", "append")
+	cmd.Stdin = bytes.NewReader(data)
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(strings.TrimSpace(string(out))) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// writeAuditEntry chains an entry onto the log, as root. The lock keeps
+// the daemon and a concurrent command from chaining onto the same entry.
+func writeAuditEntry(e auditEntry) error {
+	if err := os.MkdirAll(auditDir(), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(auditPath(), os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer func() { _ = syscall.Flock(int(f.Fd()), syscall.LOCK_UN) }()
+
+	last, err := lastAuditEntry(f)
+	if err != nil {
+		return err
+	}
+	e.Seq, e.Prev = last.Seq+1, last.Hash
+	e.Hash = e.digest()
+
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return os.WriteFile(auditHeadPath(), []byte(fmt.Sprintf("%d %s\n", e.Seq, e.Hash)), 0644)
+}
+
+// lastAuditEntry reads the last entry of an open log; an empty log
+// returns a zero entry, which starts the chain
+func lastAuditEntry(f *os.File) (auditEntry, error) {
+	var last auditEntry
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return last, err
+	}
+	var line []byte
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(bytes.TrimSpace(scanner.Bytes())) > 0 {
+			line = append(line[:0], scanner.Bytes()...)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return last, err
+	}
+	if line == nil {
+		return last, nil
+	}
+	if err := json.Unmarshal(line, &last); err != nil {
+		return last, fmt.Errorf("last audit entry is corrupt; run 'saferay audit verify'")
+	}
+	return last, nil
+}
+
+// readAuditLog reads every entry; a line that isn't JSON is returned as an
+// entry with only Error set, so verify can point at it
+func readAuditLog() ([]auditEntry, error) {
+	data, err := os.ReadFile(auditPath())
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []auditEntry
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			e = auditEntry{Error: fmt.Sprintf("line %d is not a valid entry", i+1)}
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+func newAuditCmd() *cobra.Command {
+	cmd := groupCmd("audit", "Show and verify the log of changes saferay made")
+
+	var since string
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "List the changes saferay made to this system",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var from time.Time
+			if since != "" {
+				var err error
+				if from, err = parseSince(since, time.Now()); err != nil {
+					return err
+				}
+			}
+			listAudit(from)
+			return nil
+		},
+	}
+	list.Flags().StringVar(&since, "since", "", "only changes newer than this (30m, 2h, 7d, date)")
+
+	appendCmd := actionCmd("append", "Append an entry read from stdin (used internally)", cmdAuditAppend)
+	appendCmd.Hidden = true
+
+	cmd.AddCommand(
+		list,
+		actionCmd("verify", "Check the audit log's hash chain for tampering", verifyAudit),
+		appendCmd,
+	)
+	return onPlatforms(cmd, "darwin", "linux")
+}
+
+// cmdAuditAppend is the root side of appendAuditAsRoot
+func cmdAuditAppend() {
+	var e auditEntry
+	if err := json.NewDecoder(os.Stdin).Decode(&e); err != nil {
+		fmt.Printf("Error: reading entry: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeAuditEntry(e); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// auditListReport is the result of 'saferay audit list'
+type auditListReport struct {
+	report
+	Entries []auditEntry `json:"entries"`
+}
+
+func listAudit(since time.Time) {
+	st := auditListReport{report: newReport("audit list"), Entries: []auditEntry{}}
+
+	entries, err := readAuditLog()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	for _, e := range entries {
+		if since.IsZero() || !e.Time.Before(since) {
+			st.Entries = append(st.Entries, e)
+		}
+	}
+
+	finish(&st.report, st, func() {
+		if len(st.Entries) == 0 {
+			fmt.Println("No changes recorded in " + auditPath())
+			return
+		}
+		for _, e := range st.Entries {
+			fmt.Printf("%5d  %s  %-8s %-6s  %s\n", e.Seq, e.Time.Local().Format("2006-01-02 15:04:05"), e.User, e.Action, e.Target)
+			fmt.Printf("       by '%s'\n", e.Command)
+			if e.Before != "" || e.After != "" {
+				fmt.Printf("       %s → %s\n", shortHash(e.Before), shortHash(e.After))
+			}
+			if e.Error != "" {
+				fmt.Printf("       ✗ %s\n", e.Error)
+			}
+		}
+	})
+}
+
+// shortHash abbreviates SHA-256 hashes and leaves other values alone
+func shortHash(v string) string {
+	if v == "" {
+		return "-"
+	}
+	if len(v) == 64 {
+		if _, err := hex.DecodeString(v); err == nil {
+			return v[:12]
+		}
+	}
+	return v
+}
+
+// auditVerifyReport is the result of 'saferay audit verify'
+type auditVerifyReport struct {
+	report
+	Path    string `json:"path"`
+	Entries int    `json:"entries"`
+	Head    string `json:"head"`
+}
+
+func verifyAudit() {
+	st := auditVerifyReport{report: newReport("audit verify"), Path: auditPath()}
+
+	entries, err := readAuditLog()
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	st.Entries = len(entries)
+
+	prev := auditEntry{}
+	for _, e := range entries {
+		switch {
+		case e.Seq == 0 && e.Hash == "":
+			st.fail(exitFailure, "after entry %d: %s", prev.Seq, e.Error)
+		case e.Seq != prev.Seq+1:
+			st.fail(exitFailure, "entry %d follows %d: entries are missing or reordered", e.Seq, prev.Seq)
+		case e.Prev != prev.Hash:
+			st.fail(exitFailure, "entry %d doesn't chain onto entry %d: an earlier entry was changed", e.Seq, prev.Seq)
+		case e.Hash != e.digest():
+			st.fail(exitFailure, "entry %d was modified after it was written", e.Seq)
+		}
+		if e.Hash != "" {
+			prev = e
+		}
+	}
+	st.Head = prev.Hash
+
+	// The head file catches entries removed from the end
+	if head, err := os.ReadFile(auditHeadPath()); err == nil {
+		if want := fmt.Sprintf("%d %s", prev.Seq, prev.Hash); strings.TrimSpace(string(head)) != want {
+			st.fail(exitFailure, "log ends at entry %d but %s records %s: entries were removed from the end",
+				prev.Seq, auditHeadPath(), strings.TrimSpace(string(head)))
+		}
+	} else if len(entries) > 0 {
+		st.fail(exitFailure, "%s is missing", auditHeadPath())
+	}
+
+	finish(&st.report, st, func() {
+		if st.OK {
+			fmt.Printf("✓ %s: %d entries, chain intact\n", st.Path, st.Entries)
+			return
+		}
+		fmt.Printf("✗ %s: %d entries, chain broken\n", st.Path, st.Entries)
+		for _, problem := range st.Problems {
+			fmt.Println("  " + problem)
+		}
+	})
+}
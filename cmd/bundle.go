@@ -0,0 +1,381 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// bundleOutputLines is how much of the daemon's stdout log a bundle keeps
+const bundleOutputLines = 500
+
+func newBundleCmd() *cobra.Command {
+	var output, since string
+	var redact bool
+
+	cmd := &cobra.Command{
+		Use:   "bundle",
+		Short: "Collect diagnostics into a tar.gz for bug reports",
+		Long: `Gather everything needed to debug DNS problems into one tar.gz: firewall
+state (pfctl, nft or iptables), scutil --dns or resolvectl, interfaces and
+routes, daemon definitions and their status, saferay's config, status,
+doctor findings, and the daemon, leak and audit logs since --since.
+
+With --redact, IP and MAC addresses, SSIDs, hostnames, queried domains, and
+the user's name and home directory are replaced by placeholders such as
+[ip-3]. The same value gets the same
+placeholder throughout the bundle, so it can still be followed.`,
+		Example: "  sudo saferay bundle --redact\n  sudo saferay bundle -o /tmp/dns.tar.gz --since 2h",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			from, err := parseSince(since, time.Now())
+			if err != nil {
+				return err
+			}
+			if output == "" {
+				output = fmt.Sprintf("saferay-bundle-%s.tar.gz", time.Now().Format("20060102-150405"))
+			}
+			writeBundle(output, from, redact)
+			return nil
+		},
+	}
+	cmd.Flags().StringVarP(&output, "output", "o", "", "archive to write (default saferay-bundle-<time>.tar.gz)")
+	cmd.Flags().StringVar(&since, "since", "24h", "include log entries newer than this")
+	cmd.Flags().BoolVar(&redact, "redact", false, "replace addresses, SSIDs and hostnames with placeholders")
+
+	return onPlatforms(cmd, "darwin", "linux")
+}
+
+// bundleFile is one file of a support bundle
+type bundleFile struct {
+	name string
+	data []byte
+}
+
+// bundle collects a support bundle in memory, noting in its manifest what
+// couldn't be collected
+type bundle struct {
+	files    []bundleFile
+	manifest []string
+}
+
+func (b *bundle) add(name string, data []byte) {
+	b.files = append(b.files, bundleFile{name, data})
+}
+
+// note records a failure in the manifest
+func (b *bundle) note(name string, err error) {
+	b.manifest = append(b.manifest, fmt.Sprintf("%s: %v", name, err))
+}
+
+// command stores a command's output, prefixed with the command line. The
+// output of a failed command is kept too, as it's often the interesting
+// part.
+func (b *bundle) command(name string, args ...string) {
+	b.store(name, args, exec.Command(args[0], args[1:]...))
+}
+
+// rootCommand is command for queries that need root
+func (b *bundle) rootCommand(name string, args ...string) {
+	b.store(name, args, sudoQuery(args...))
+}
+
+func (b *bundle) store(name string, args []string, c *exec.Cmd) {
+	out, err := c.CombinedOutput()
+	if err != nil {
+		b.note(name, err)
+	}
+	b.add(name, append([]byte("$ "+strings.Join(args, " ")+"\n"), out...))
+}
+
+// file stores a file under files/ by its path, reading it as root if needed
+func (b *bundle) file(path string) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return
+	}
+	if os.IsPermission(err) {
+		data, err = sudoQuery("cat", path).Output()
+	}
+	if err != nil {
+		b.note(path, err)
+		return
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	b.add("files"+path, data)
+}
+
+// log stores the entries of a log and its rotated files newer than since
+func (b *bundle) log(name, path string, since time.Time) {
+	var out bytes.Buffer
+	for _, p := range logFiles(path) {
+		data, err := os.ReadFile(p)
+		if os.IsPermission(err) {
+			data, err = sudoQuery("cat", p).Output()
+		}
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(data), "\n") {
+			if strings.TrimSpace(line) == "" {
+				continue
+			}
+			if t := parseLogLine(line).Time; !t.IsZero() && t.Before(since) {
+				continue
+			}
+			out.WriteString(line + "\n")
+		}
+	}
+	if out.Len() > 0 {
+		b.add(name, out.Bytes())
+	}
+}
+
+func writeBundle(output string, since time.Time, redact bool) {
+	fmt.Println("Collecting diagnostics...")
+
+	b := &bundle{}
+	if runtime.GOOS == "linux" {
+		collectLinux(b, since)
+	} else {
+		collectDarwin(b)
+	}
+	collectSaferay(b, since)
+
+	var r *redactor
+	if redact {
+		r = newRedactor()
+		for i := range b.files {
+			b.files[i].name = r.redact(b.files[i].name)
+			b.files[i].data = []byte(r.redact(string(b.files[i].data)))
+		}
+		for i := range b.manifest {
+			b.manifest[i] = r.redact(b.manifest[i])
+		}
+	}
+	b.add("manifest.txt", bundleManifest(b, since, redact))
+
+	if err := writeTarGz(output, b.files); err != nil {
+		fmt.Printf("Error writing %s: %v\n", output, err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Bundle written to %s (%d files)\n", output, len(b.files))
+	if len(b.manifest) > 0 {
+		fmt.Printf("  %d items couldn't be collected; see manifest.txt\n", len(b.manifest))
+	}
+	if redact {
+		fmt.Printf("  Redacted %d addresses, SSIDs and hostnames\n", len(r.tokens))
+	} else {
+		fmt.Println("  It contains IP addresses, SSIDs and hostnames; use --redact before sharing it")
+	}
+}
+
+func collectDarwin(b *bundle) {
+	b.command("system/sw_vers.txt", "sw_vers")
+	b.command("system/csrutil.txt", "csrutil", "status")
+
+	b.command("network/ifconfig.txt", "ifconfig")
+	b.command("network/routes.txt", "netstat", "-rn")
+	b.command("network/scutil-dns.txt", "scutil", "--dns")
+	b.command("network/scutil-proxy.txt", "scutil", "--proxy")
+	b.command("network/services.txt", "networksetup", "-listallnetworkservices")
+	if service := getActiveNetworkService(); service != "" {
+		b.command("network/dns-servers.txt", "networksetup", "-getdnsservers", service)
+	}
+
+	b.rootCommand("firewall/pf-info.txt", "pfctl", "-s", "info")
+	b.rootCommand("firewall/pf-rules.txt", "pfctl", "-s", "rules")
+	b.rootCommand("firewall/pf-nat.txt", "pfctl", "-s", "nat")
+	b.rootCommand("firewall/pf-anchors.txt", "pfctl", "-s", "Anchors")
+	b.rootCommand("firewall/pf-references.txt", "pfctl", "-s", "References")
+	b.rootCommand("firewall/anchor-rules.txt", "pfctl", "-a", anchorName, "-vsr")
+	b.file(pfConf)
+
+	entries, _ := os.ReadDir(resolverDir)
+	for _, entry := range entries {
+		b.file(filepath.Join(resolverDir, entry.Name()))
+	}
+
+	sm := launchdManager{}
+	for _, s := range []service{autoService(), dnsFlushService()} {
+		if _, err := os.Stat(sm.path(s)); err == nil {
+			b.rootCommand("services/"+sm.label(s)+".txt", "launchctl", "print", "system/"+sm.label(s))
+		}
+	}
+}
+
+func collectLinux(b *bundle, since time.Time) {
+	b.command("system/uname.txt", "uname", "-a")
+	b.file("/etc/os-release")
+
+	b.command("network/ip-addr.txt", "ip", "addr")
+	b.command("network/ip-route.txt", "ip", "route")
+	b.command("network/ip6-route.txt", "ip", "-6", "route")
+	b.command("network/resolvectl.txt", "resolvectl", "status")
+	b.file("/etc/resolv.conf")
+
+	if _, err := exec.LookPath("nft"); err == nil {
+		b.rootCommand("firewall/nft-ruleset.txt", "nft", "list", "ruleset")
+	}
+	for _, family := range iptablesFamilies {
+		if family.available() {
+			b.rootCommand("firewall/"+family.iptables+".txt", family.iptables, "-S")
+			b.rootCommand("firewall/"+family.iptables+"-counters.txt", family.iptables, "-L", iptablesChain, "-n", "-v", "-x")
+		}
+	}
+
+	sm := systemdManager{}
+	for _, s := range []service{autoService(), dnsFlushService()} {
+		if _, err := os.Stat(sm.path(s)); err == nil {
+			b.command("services/"+sm.unit(s)+".txt", "systemctl", "status", "--no-pager", sm.unit(s))
+		}
+	}
+	if sink := loadConfig().LogSink; sink == sinkSystem || sink == sinkBoth {
+		b.rootCommand("logs/journal.txt", "journalctl", "--no-pager", "-t", logIdentifier, "--since", since.Format("2006-01-02 15:04:05"))
+	}
+}
+
+// collectSaferay adds saferay's own files, logs and what its status
+// commands report
+func collectSaferay(b *bundle, since time.Time) {
+	fw := newFirewall()
+	b.file(configPath)
+	b.file(lightConfigPath)
+	b.file(fw.rulesPath())
+	b.file(auditHeadPath())
+
+	sm := newServiceManager()
+	for _, s := range []service{autoService(), dnsFlushService()} {
+		b.file(sm.path(s))
+	}
+
+	// Status commands as JSON, run from this binary with the same config
+	if exe, err := os.Executable(); err == nil {
+		for _, args := range [][]string{
+			{"version"},
+			{"check"},
+			{"doctor"},
+			{"xray", "status"},
+			{"xray", "auto", "status"},
+			{"light", "status"},
+		} {
+			name := "saferay/" + strings.Join(args, "-") + ".json"
+			c := exec.Command(exe, append([]string{"--json", "--config", configPath}, args...)...)
+			// Status commands exit 2 when protection is off; the JSON says why
+			out, _ := c.Output()
+			b.add(name, out)
+		}
+	}
+
+	b.log("logs/"+filepath.Base(xrayLogPath), xrayLogPath, since)
+	b.log("logs/"+filepath.Base(leakLogPath), leakLogPath, since)
+	if audit := recentAudit(since); len(audit) > 0 {
+		b.add("logs/audit.log", audit)
+	}
+	if data, err := os.ReadFile(xrayOutputPath); err == nil {
+		lines := splitLines(string(data))
+		if len(lines) > bundleOutputLines {
+			lines = lines[len(lines)-bundleOutputLines:]
+		}
+		b.add("logs/"+filepath.Base(xrayOutputPath), []byte(strings.Join(lines, "\n")+"\n"))
+	}
+}
+
+// recentAudit returns the audit log lines newer than since
+func recentAudit(since time.Time) []byte {
+	data, _ := os.ReadFile(auditPath())
+
+	var out bytes.Buffer
+	for _, line := range strings.Split(string(data), "\n") {
+		var e struct {
+			Time time.Time `json:"time"`
+		}
+		if json.Unmarshal([]byte(line), &e) == nil && !e.Time.Before(since) {
+			out.WriteString(line + "\n")
+		}
+	}
+	return out.Bytes()
+}
+
+func bundleManifest(b *bundle, since time.Time, redact bool) []byte {
+	var m strings.Builder
+	fmt.Fprintf(&m, "saferay %s support bundle\n", version)
+	fmt.Fprintf(&m, "Created:  %s\n", time.Now().Format(time.RFC3339))
+	fmt.Fprintf(&m, "Platform: %s/%s\n", runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&m, "Logs:     since %s\n", since.Format(time.RFC3339))
+	if redact {
+		m.WriteString("Redacted: addresses, SSIDs and hostnames\n")
+	} else {
+		m.WriteString("Redacted: no\n")
+	}
+
+	m.WriteString("\nFiles:\n")
+	for _, f := range b.files {
+		fmt.Fprintf(&m, "  %-40s %d bytes\n", f.name, len(f.data))
+	}
+	if len(b.manifest) > 0 {
+		m.WriteString("\nNot collected or failed:\n")
+		for _, note := range b.manifest {
+			m.WriteString("  " + note + "\n")
+		}
+	}
+	return []byte(m.String())
+}
+
+// writeTarGz writes files under a directory named after the archive. The
+// archive is only readable by its owner, as it describes the network.
+func writeTarGz(output string, files []bundleFile) error {
+	f, err := os.OpenFile(output, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := bufio.NewWriter(f)
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	dir := strings.TrimSuffix(strings.TrimSuffix(strings.TrimSuffix(filepath.Base(output), ".tgz"), ".gz"), ".tar")
+	now := time.Now()
+	sort.SliceStable(files, func(i, j int) bool { return files[i].name < files[j].name })
+	for _, file := range files {
+		hdr := &tar.Header{
+			Name:    dir + "/" + strings.TrimPrefix(file.name, "/"),
+			Mode:    0644,
+			Size:    int64(len(file.data)),
+			ModTime: now,
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := tw.Write(file.data); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	return f.Close()
+}
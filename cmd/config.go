@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const configDir = "/etc/saferay"
+
+// configPath can be overridden with the global --config flag
+var configPath = "/etc/saferay/saferay.conf"
+
+// Config is the persistent saferay configuration.
+// It is stored as key=value lines, the same format as light.conf:
+//
+//	default_mode=xray
+//	tunnel=utun4
+//	firewall_backend=iptables
+//	log_sink=both
+//	metrics_addr=127.0.0.1:9753
+//	log_blocked=true
+//	drift=alert
+//	profile.office.mode=light
+//	profile.office.ssid=Corp Wi-Fi
+//	split.corp.example=10.0.0.53 10.0.0.54
+//	exempt.user=_builder
+//	xray_config=/usr/local/etc/xray/config.json
+//	xray.proxy=203.0.113.7
+type Config struct {
+	// DefaultMode is applied by the watch daemon when no profile matches
+	DefaultMode string
+	// Tunnel is the VPN interface DNS may use; empty means platform default
+	Tunnel string
+	// FirewallBackend forces "nftables" or "iptables" on Linux; empty
+	// means detect
+	FirewallBackend string
+	// LogSink is where the daemon logs: "file" (default), "system" or
+	// "both"
+	LogSink string
+	// MetricsAddr is the loopback address the watch daemon serves
+	// /metrics on; empty disables it
+	MetricsAddr string
+	// LogBlocked logs blocked DNS packets to pflog0 so the watch daemon
+	// can record leak attempts
+	LogBlocked bool
+	// Drift is what the watch daemon does when the live system no longer
+	// matches what saferay installed: "repair" (default), "alert" or "off"
+	Drift string
+	// Profiles in priority order, first match wins
+	Profiles []Profile
+	// SplitDNS routes domains to LAN resolvers while the tunnel is up
+	SplitDNS []SplitRoute
+	// Exemptions are users and groups whose DNS bypasses the block rule
+	Exemptions []Exemption
+	// XrayConfig is the Xray config.json 'xray install' reads; empty
+	// means look in the usual places
+	XrayConfig string
+	// XrayPasses are addresses Xray itself uses on port 53, derived from
+	// its config by 'xray install'
+	XrayPasses []XrayPass
+}
+
+// loadConfig reads the config file, returning defaults if it doesn't exist
+func loadConfig() *Config {
+	cfg := &Config{DefaultMode: modeXray}
+
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return cfg
+	}
+
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		cfg.set(strings.TrimSpace(key), strings.TrimSpace(value))
+	}
+
+	return cfg
+}
+
+// set applies a single key=value pair, ignoring unknown keys
+func (c *Config) set(key, value string) {
+	switch {
+	case key == "default_mode":
+		c.DefaultMode = value
+	case key == "tunnel":
+		c.Tunnel = value
+	case key == "firewall_backend":
+		c.FirewallBackend = value
+	case key == "log_sink":
+		c.LogSink = value
+	case key == "metrics_addr":
+		c.MetricsAddr = value
+	case key == "log_blocked":
+		c.LogBlocked = value == "true"
+	case key == "drift":
+		c.Drift = value
+	case strings.HasPrefix(key, "profile."):
+		rest := strings.TrimPrefix(key, "profile.")
+		dot := strings.LastIndex(rest, ".")
+		if dot <= 0 {
+			return
+		}
+		p := c.profile(rest[:dot], true)
+		p.set(rest[dot+1:], value)
+	case strings.HasPrefix(key, "split."):
+		c.SplitDNS = append(c.SplitDNS, SplitRoute{
+			Domain:    strings.TrimPrefix(key, "split."),
+			Resolvers: strings.Fields(value),
+		})
+	case key == "xray_config":
+		c.XrayConfig = value
+	case strings.HasPrefix(key, "xray."):
+		c.XrayPasses = append(c.XrayPasses, XrayPass{
+			Tag:       strings.TrimPrefix(key, "xray."),
+			Addresses: strings.Fields(value),
+		})
+	case key == "exempt.user" || key == "exempt.group":
+		c.Exemptions = append(c.Exemptions, Exemption{
+			Kind: strings.TrimPrefix(key, "exempt."),
+			Name: value,
+		})
+	}
+}
+
+// profile returns the named profile, optionally creating it
+func (c *Config) profile(name string, create bool) *Profile {
+	for i := range c.Profiles {
+		if c.Profiles[i].Name == name {
+			return &c.Profiles[i]
+		}
+	}
+	if !create {
+		return nil
+	}
+	c.Profiles = append(c.Profiles, Profile{Name: name})
+	return &c.Profiles[len(c.Profiles)-1]
+}
+
+// String renders the config in its on-disk format
+func (c *Config) String() string {
+	var b strings.Builder
+	b.WriteString("# saferay configuration\n")
+	fmt.Fprintf(&b, "default_mode=%s\n", c.DefaultMode)
+	if c.Tunnel != "" {
+		fmt.Fprintf(&b, "tunnel=%s\n", c.Tunnel)
+	}
+	if c.FirewallBackend != "" {
+		fmt.Fprintf(&b, "firewall_backend=%s\n", c.FirewallBackend)
+	}
+	if c.LogSink != "" {
+		fmt.Fprintf(&b, "log_sink=%s\n", c.LogSink)
+	}
+	if c.MetricsAddr != "" {
+		fmt.Fprintf(&b, "metrics_addr=%s\n", c.MetricsAddr)
+	}
+	if c.LogBlocked {
+		b.WriteString("log_blocked=true\n")
+	}
+	if c.Drift != "" {
+		fmt.Fprintf(&b, "drift=%s\n", c.Drift)
+	}
+
+	for _, p := range c.Profiles {
+		b.WriteString("\n")
+		for _, kv := range p.fields() {
+			fmt.Fprintf(&b, "profile.%s.%s=%s\n", p.Name, kv[0], kv[1])
+		}
+	}
+
+	if len(c.SplitDNS) > 0 {
+		b.WriteString("\n")
+	}
+	for _, route := range c.SplitDNS {
+		fmt.Fprintf(&b, "split.%s=%s\n", route.Domain, strings.Join(route.Resolvers, " "))
+	}
+
+	if len(c.Exemptions) > 0 {
+		b.WriteString("\n")
+	}
+	for _, e := range c.Exemptions {
+		fmt.Fprintf(&b, "exempt.%s=%s\n", e.Kind, e.Name)
+	}
+
+	if c.XrayConfig != "" || len(c.XrayPasses) > 0 {
+		b.WriteString("\n")
+	}
+	if c.XrayConfig != "" {
+		fmt.Fprintf(&b, "xray_config=%s\n", c.XrayConfig)
+	}
+	for _, p := range c.XrayPasses {
+		fmt.Fprintf(&b, "xray.%s=%s\n", p.Tag, strings.Join(p.Addresses, " "))
+	}
+
+	return b.String()
+}
+
+// saveConfig writes the config file with sudo
+func saveConfig(c *Config) error {
+	return sys.writeFile(configPath, []byte(c.String()), 0644)
+}
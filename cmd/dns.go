@@ -3,104 +3,77 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"os/exec"
-	"strings"
-)
+	"runtime"
 
-const (
-	daemonLabel = "com.saferay.dnsflush"
-	daemonPath  = "/Library/LaunchDaemons/com.saferay.dnsflush.plist"
-	daemonPlist = `<?xml version="1.0" encoding="UTF-8"?>
-<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
-<plist version="1.0">
-<dict>
-    <key>Label</key>
-    <string>com.saferay.dnsflush</string>
-    <key>ProgramArguments</key>
-    <array>
-        <string>/bin/bash</string>
-        <string>-c</string>
-        <string>dscacheutil -flushcache; killall -HUP mDNSResponder</string>
-    </array>
-    <key>RunAtLoad</key>
-    <true/>
-</dict>
-</plist>`
+	"github.com/spf13/cobra"
 )
 
-func cmdDNS(action string) {
-	switch action {
-	case "setup":
-		setupDNSDaemon()
-	case "remove":
-		removeDNSDaemon()
-	case "status":
-		statusDNSDaemon()
-	case "flush":
-		flushDNS()
-	default:
-		fmt.Printf("Unknown dns action: %s\n", action)
-		os.Exit(1)
-	}
+func newDNSCmd() *cobra.Command {
+	cmd := groupCmd("dns", "Manage the DNS cache flush daemon")
+	onPlatforms(cmd, "darwin", "linux")
+	cmd.AddCommand(
+		actionCmd("setup", "Setup DNS cache flush on reboot", setupDNSDaemon),
+		actionCmd("remove", "Remove DNS flush daemon", removeDNSDaemon),
+		actionCmd("status", "Check DNS flush daemon status", statusDNSDaemon),
+		actionCmd("flush", "Flush DNS cache now", flushDNS),
+	)
+	return cmd
 }
 
 func setupDNSDaemon() {
-	// Write plist to temp and move with sudo
-	tmpPath := "/tmp/saferay_dns.plist"
-	if err := os.WriteFile(tmpPath, []byte(daemonPlist), 0644); err != nil {
-		fmt.Printf("Error writing plist: %v\n", err)
+	sm := newServiceManager()
+	if err := sm.install(dnsFlushService()); err != nil {
+		fmt.Printf("Error installing %s service: %v\n", sm.name(), err)
 		os.Exit(1)
 	}
 
-	cmds := [][]string{
-		{"sudo", "mv", tmpPath, daemonPath},
-		{"sudo", "chown", "root:wheel", daemonPath},
-		{"sudo", "chmod", "644", daemonPath},
-		{"sudo", "launchctl", "load", "-w", daemonPath},
-	}
-
-	for _, args := range cmds {
-		cmd := exec.Command(args[0], args[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		cmd.Stdin = os.Stdin
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Error running %v: %v\n", args, err)
-			os.Exit(1)
-		}
-	}
-
 	fmt.Println("✓ DNS flush daemon installed (will flush DNS on every reboot)")
 }
 
 func removeDNSDaemon() {
-	_ = exec.Command("sudo", "launchctl", "unload", "-w", daemonPath).Run()
-	_ = exec.Command("sudo", "rm", "-f", daemonPath).Run()
+	_ = newServiceManager().remove(dnsFlushService())
 	fmt.Println("✓ DNS flush daemon removed")
 }
 
-func statusDNSDaemon() {
-	if _, err := os.Stat(daemonPath); os.IsNotExist(err) {
-		fmt.Println("DNS flush daemon: not installed")
-		return
-	}
+func getDNSDaemonStatus() serviceStatus {
+	return newServiceManager().status(dnsFlushService())
+}
 
-	out, _ := exec.Command("sudo", "launchctl", "list", daemonLabel).CombinedOutput()
-	if strings.Contains(string(out), daemonLabel) {
+func printDNSDaemonStatus(st serviceStatus) {
+	switch {
+	case !st.Installed:
+		fmt.Println("DNS flush daemon: not installed")
+	case st.Loaded:
 		fmt.Println("DNS flush daemon: ✓ installed and loaded")
-	} else {
+	default:
 		fmt.Println("DNS flush daemon: installed but not loaded")
 	}
+	st.printIssues(dnsFlushService())
 }
 
-func flushDNS() {
-	cmd := exec.Command("sudo", "dscacheutil", "-flushcache")
-	cmd.Stdin = os.Stdin
-	_ = cmd.Run()
+func statusDNSDaemon() {
+	result := struct {
+		report
+		serviceStatus
+	}{report: newReport("dns status"), serviceStatus: getDNSDaemonStatus()}
+
+	if result.Installed && !result.Loaded {
+		result.notActive("DNS flush daemon is installed but not loaded")
+	}
+	if problem := result.problem(); problem != "" {
+		result.notActive("DNS flush daemon: %s", problem)
+	}
+
+	finish(&result.report, result, func() { printDNSDaemonStatus(result.serviceStatus) })
+}
 
-	cmd = exec.Command("sudo", "killall", "-HUP", "mDNSResponder")
-	cmd.Stdin = os.Stdin
-	_ = cmd.Run()
+func flushDNS() {
+	if runtime.GOOS == "linux" {
+		_ = sys.quiet("sudo", resolvectl, "flush-caches")
+	} else {
+		_ = sys.quiet("sudo", "dscacheutil", "-flushcache")
+		_ = sys.quiet("sudo", "killall", "-HUP", "mDNSResponder")
+	}
 
 	fmt.Println("✓ DNS cache flushed")
 }
@@ -0,0 +1,628 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/cobra"
+)
+
+func newDoctorCmd() *cobra.Command {
+	var fix bool
+
+	cmd := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose why protection isn't working and repair drift",
+		Long: `Go beyond 'saferay check': parse pf.conf and the ruleset, check the anchor's
+place in pf.conf, the tunnel the rules pass DNS on, other pf anchors and
+firewalls, conflicting /etc/resolver files, daemon health, stale binaries,
+and the ownership and permissions of saferay's files. Every warning or
+error comes with a hint on how to fix it.
+
+It also compares the live system with what saferay installed: the ruleset
+file, its hook into pf.conf or OUTPUT, the loaded rules, split DNS
+resolver files and light mode DNS. OS updates and other tools change these
+behind saferay's back, leaving protection installed but inert. With --fix
+each drifted item is put back; every repair is recorded in the audit log.
+The watch daemon does the same every minute unless the config says
+drift=alert or drift=off.`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			runDoctor(fix)
+		},
+	}
+	cmd.Flags().BoolVar(&fix, "fix", false, "repair what drifted")
+
+	return onPlatforms(cmd, "darwin", "linux")
+}
+
+// Severities of doctor findings. Errors mean protection isn't in effect.
+const (
+	severityOK      = "ok"
+	severityWarning = "warning"
+	severityError   = "error"
+)
+
+// finding is one result of 'saferay doctor'
+type finding struct {
+	Check    string `json:"check"`
+	Severity string `json:"severity"`
+	Detail   string `json:"detail"`
+	// Hint says how to resolve a warning or error
+	Hint string `json:"hint,omitempty"`
+}
+
+// findingFunc records a finding
+type findingFunc func(check, severity, detail, hint string)
+
+// doctorReport is the result of 'saferay doctor'
+type doctorReport struct {
+	report
+	Findings []finding `json:"findings"`
+	Drift    []drift   `json:"drift"`
+}
+
+func runDoctor(fix bool) {
+	st := doctorReport{report: newReport("doctor"), Findings: []finding{}, Drift: []drift{}}
+	cfg := loadConfig()
+	fw := newFirewall()
+
+	add := func(check, severity, detail, hint string) {
+		st.Findings = append(st.Findings, finding{check, severity, detail, hint})
+		if severity == severityError {
+			st.notActive("%s: %s", check, detail)
+		}
+	}
+
+	rules, err := os.ReadFile(fw.rulesPath())
+	installed := err == nil
+	if installed {
+		diagnoseRuleset(cfg, fw, string(rules), add)
+	} else {
+		add("Ruleset", severityOK, fw.rulesPath()+" not installed (xray mode unused)", "")
+	}
+	if runtime.GOOS == "darwin" {
+		if installed {
+			diagnosePfConf(add)
+			diagnoseResolvers(cfg, add)
+		}
+		diagnosePfUsers(add)
+	} else {
+		diagnoseLinuxFirewalls(fw, add)
+	}
+	diagnoseXrayConfig(cfg, add)
+	diagnoseDaemons(add)
+	diagnoseBinary(add)
+	diagnosePermissions(fw, add)
+
+	// Only auto mode promises the firewall is on whenever it should be
+	wantEnabled := false
+	if newServiceManager().status(autoService()).Installed {
+		_, mode, _ := currentMode(cfg)
+		wantEnabled = wantPf(mode, isVPNConnected())
+	}
+
+	st.Drift = append(st.Drift, detectDrift(cfg, fw, wantEnabled)...)
+	for i := range st.Drift {
+		d := &st.Drift[i]
+		if !fix {
+			st.notActive("%s: %s", d.What, d.Detail)
+			continue
+		}
+		if err := d.fix(); err != nil {
+			st.fail(exitFailure, "repairing %s: %v", d.What, err)
+		}
+	}
+
+	finish(&st.report, st, func() {
+		fmt.Println("=== saferay doctor ===")
+		fmt.Println()
+
+		for _, f := range st.Findings {
+			symbol := "✓"
+			switch f.Severity {
+			case severityError:
+				symbol = "✗"
+			case severityWarning:
+				symbol = "⚠"
+			}
+			fmt.Printf("%-17s%s %s\n", f.Check+":", symbol, f.Detail)
+			if f.Hint != "" {
+				fmt.Printf("%-17s  → %s\n", "", f.Hint)
+			}
+		}
+
+		fmt.Println()
+		if len(st.Drift) == 0 {
+			fmt.Println("✓ Nothing drifted from what saferay installed")
+			return
+		}
+
+		fmt.Println("Drift:")
+		for _, d := range st.Drift {
+			fmt.Printf("⚠ %s: %s\n", d.What, d.Detail)
+			if d.Diff != "" {
+				for _, line := range splitLines(d.Diff) {
+					fmt.Println("    " + line)
+				}
+			}
+			switch {
+			case d.Error != "":
+				fmt.Printf("  ✗ Repair failed: %s\n", d.Error)
+			case d.Repaired && sys.dryRun:
+				fmt.Println("  Would be repaired")
+			case d.Repaired:
+				fmt.Println("  ✓ Repaired")
+			}
+		}
+
+		if !fix {
+			fmt.Println("\nRun 'saferay doctor --fix' to repair")
+		}
+	})
+}
+
+// diagnoseRuleset checks the installed ruleset parses and that the tunnel
+// it passes DNS on is the one the VPN uses
+func diagnoseRuleset(cfg *Config, fw firewall, rules string, add findingFunc) {
+	what := fw.rulesPath()
+	if fw.name() == "pf" {
+		what = "pf.conf and the " + anchorName + " anchor"
+	}
+	if err := fw.validate(); err != nil {
+		add("Ruleset", severityError, fmt.Sprintf("%s don't parse: %v", what, err),
+			"fix the reported lines, or run 'saferay xray install' to rewrite saferay's")
+	} else {
+		add("Ruleset", severityOK, what+" parse cleanly", "")
+	}
+
+	tunnel := rulesTunnel(fw, rules)
+	active := activeTunnels()
+	switch {
+	case tunnel == "":
+		add("Tunnel", severityError, "the ruleset passes DNS on no tunnel", "run 'saferay xray install' to rewrite it")
+	case contains(active, tunnel):
+		add("Tunnel", severityOK, tunnel+" is up", "")
+	case tunPassed(cfg) != "":
+		add("Tunnel", severityOK, tunPassed(cfg)+" carries the client's tun network, which the rules pass", "")
+	case len(active) > 0:
+		add("Tunnel", severityError,
+			fmt.Sprintf("the rules pass DNS on %s, but the VPN is on %s; DNS will fail", tunnel, strings.Join(active, ", ")),
+			fmt.Sprintf("set tunnel=%s in %s and run 'saferay xray install'", active[0], configPath))
+	case interfaceExists(tunnel):
+		add("Tunnel", severityWarning, tunnel+" exists but has no address (VPN down?)", "connect the VPN")
+	default:
+		add("Tunnel", severityWarning, tunnel+" doesn't exist (VPN down?)", "connect the VPN, or set tunnel= to the interface it creates")
+	}
+
+	if cfg.Tunnel != "" && tunnel != "" && tunnel != cfg.Tunnel {
+		add("Tunnel", severityWarning, fmt.Sprintf("config says tunnel=%s but the rules use %s", cfg.Tunnel, tunnel),
+			"run 'saferay xray install' to rewrite the rules")
+	}
+}
+
+// tunPassed returns the interface holding the client's tun network, when
+// the config passes that network rather than naming the tunnel
+func tunPassed(cfg *Config) string {
+	for _, p := range cfg.XrayPasses {
+		if p.Tag == "tun" {
+			return interfaceWithin(p.Addresses)
+		}
+	}
+	return ""
+}
+
+// tunNetworksPassed reports whether the config passes exactly networks
+func tunNetworksPassed(cfg *Config, networks []string) bool {
+	for _, p := range cfg.XrayPasses {
+		if p.Tag == "tun" {
+			return strings.Join(p.Addresses, " ") == strings.Join(networks, " ")
+		}
+	}
+	return false
+}
+
+// rulesTunnel finds the interface an installed ruleset passes DNS on, by
+// matching it against a ruleset rendered for a placeholder tunnel
+func rulesTunnel(fw firewall, rules string) string {
+	const placeholder = "saferay-tunnel"
+
+	var prefix, suffix string
+	for _, line := range strings.Split(fw.render(&Config{Tunnel: placeholder}), "\n") {
+		if before, after, ok := strings.Cut(line, placeholder); ok {
+			prefix, suffix = before, after
+			break
+		}
+	}
+	for _, line := range strings.Split(rules, "\n") {
+		if len(line) > len(prefix)+len(suffix) && strings.HasPrefix(line, prefix) && strings.HasSuffix(line, suffix) {
+			return line[len(prefix) : len(line)-len(suffix)]
+		}
+	}
+	return ""
+}
+
+// activeTunnels lists the VPN tunnels that are up with an address: utun
+// interfaces on macOS, tun devices on Linux
+func activeTunnels() []string {
+	ifaces, _ := net.Interfaces()
+	tuns := tunnelDevices()
+
+	var active []string
+	for _, iface := range ifaces {
+		if runtime.GOOS == "linux" && !contains(tuns, iface.Name) {
+			continue
+		}
+		if runtime.GOOS != "linux" && !strings.HasPrefix(iface.Name, "utun") {
+			continue
+		}
+		if iface.Flags&net.FlagUp != 0 && hasRoutableAddr(iface) {
+			active = append(active, iface.Name)
+		}
+	}
+	return active
+}
+
+// hasRoutableAddr reports whether iface has an address other than a
+// link-local one; macOS keeps utun0-3 up with only those
+func hasRoutableAddr(iface net.Interface) bool {
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.IsGlobalUnicast() {
+			return true
+		}
+	}
+	return false
+}
+
+func interfaceExists(name string) bool {
+	_, err := net.InterfaceByName(name)
+	return err == nil
+}
+
+// diagnosePfConf checks where pf.conf puts the anchor: pf refuses filter
+// rules before translation rules, and quick pass rules ahead of the anchor
+// win over its block rule
+func diagnosePfConf(add findingFunc) {
+	content, err := os.ReadFile(pfConf)
+	if err != nil {
+		add("Anchor order", severityError, "can't read "+pfConf, "")
+		return
+	}
+
+	anchorLine := fmt.Sprintf("anchor \"%s\"", anchorName)
+	anchorIdx, lastTranslation := -1, -1
+	var bypass []string
+	for i, line := range strings.Split(string(content), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		switch {
+		case line == anchorLine:
+			anchorIdx = i
+		case isPfTranslation(fields[0]):
+			lastTranslation = i
+		case anchorIdx < 0 && fields[0] == "pass" && contains(fields, "quick") && (!contains(fields, "port") || strings.Contains(line, "53") || strings.Contains(line, "domain")):
+			bypass = append(bypass, line)
+		}
+	}
+
+	switch {
+	case anchorIdx < 0:
+		// Reported as drift
+		return
+	case lastTranslation > anchorIdx:
+		add("Anchor order", severityError, "the "+anchorName+" anchor comes before translation rules, so pf won't load pf.conf",
+			"move the "+anchorName+" lines to the end of "+pfConf)
+	case len(bypass) > 0:
+		add("Anchor order", severityWarning, fmt.Sprintf("%s passes DNS before the %s anchor: %s", pfConf, anchorName, bypass[0]),
+			"move the "+anchorName+" lines above it, or narrow it to other ports")
+	default:
+		add("Anchor order", severityOK, "the "+anchorName+" anchor follows translation rules and nothing passes DNS before it", "")
+	}
+}
+
+// isPfTranslation reports whether a pf.conf keyword starts a rule that
+// must come before filter rules
+func isPfTranslation(keyword string) bool {
+	for _, prefix := range []string{"scrub", "nat", "rdr", "binat", "dummynet", "altq", "queue"} {
+		if strings.HasPrefix(keyword, prefix) {
+			return true
+		}
+	}
+	return keyword == "set" || keyword == "table"
+}
+
+// diagnosePfUsers lists other software loading pf anchors, whose quick
+// rules run before saferay's, and processes holding pf enable tokens
+func diagnosePfUsers(add findingFunc) {
+	out, err := sudoQuery("pfctl", "-s", "Anchors").CombinedOutput()
+	if err != nil {
+		add("pf users", severityWarning, "can't list pf anchors", "run 'saferay doctor' with sudo")
+		return
+	}
+	var others []string
+	for _, line := range strings.Split(string(out), "\n") {
+		name := strings.TrimSpace(line)
+		if name != "" && name != anchorName && !strings.HasPrefix(name, "com.apple") && !strings.Contains(name, "ALTQ") {
+			others = append(others, name)
+		}
+	}
+
+	// TOKENS: then "PID  Process Name  TOKEN  TIMESTAMP" rows
+	out, _ = sudoQuery("pfctl", "-s", "References").CombinedOutput()
+	var holders []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && strings.Trim(fields[0], "0123456789") == "" && !contains(holders, fields[1]) {
+			holders = append(holders, fields[1])
+		}
+	}
+	tokens := ""
+	if len(holders) > 0 {
+		tokens = "; pf kept enabled by " + strings.Join(holders, ", ")
+	}
+
+	if len(others) > 0 {
+		add("pf users", severityWarning, "other pf anchors loaded: "+strings.Join(others, ", ")+tokens,
+			"check they don't pass port 53 with quick rules, disable pf or reload pf.conf")
+		return
+	}
+	add("pf users", severityOK, "only Apple's anchors and saferay's"+tokens, "")
+}
+
+// diagnoseResolvers finds /etc/resolver files that send queries to
+// servers the firewall blocks, and saferay's own files for routes that
+// were removed
+func diagnoseResolvers(cfg *Config, add findingFunc) {
+	entries, _ := os.ReadDir(resolverDir)
+
+	allowed := map[string]bool{}
+	for _, route := range cfg.SplitDNS {
+		for _, ip := range route.Resolvers {
+			allowed[ip] = true
+		}
+	}
+
+	problems := 0
+	for _, entry := range entries {
+		domain := entry.Name()
+		path := filepath.Join(resolverDir, domain)
+		content, err := os.ReadFile(path)
+		if err != nil || entry.IsDir() {
+			continue
+		}
+
+		if strings.HasPrefix(string(content), resolverMarker) {
+			if cfg.splitRoute(domain) == nil {
+				problems++
+				add("Resolvers", severityWarning, path+" is left over from a removed split DNS route", "sudo rm "+path)
+			}
+			continue
+		}
+
+		var blocked []string
+		for _, line := range strings.Split(string(content), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 || fields[0] != "nameserver" {
+				continue
+			}
+			ip := net.ParseIP(fields[1])
+			if ip != nil && !ip.IsLoopback() && !allowed[fields[1]] {
+				blocked = append(blocked, fields[1])
+			}
+		}
+		if len(blocked) > 0 {
+			problems++
+			add("Resolvers", severityWarning,
+				fmt.Sprintf("%s sends %s queries to %s, which the firewall blocks", path, domain, strings.Join(blocked, ", ")),
+				fmt.Sprintf("run 'saferay xray split add %s %s', or remove the file", domain, strings.Join(blocked, " ")))
+		}
+	}
+
+	if problems == 0 {
+		add("Resolvers", severityOK, "no conflicting files in "+resolverDir, "")
+	}
+}
+
+// diagnoseXrayConfig checks the Xray or sing-box config agrees with the
+// firewall: the tunnel it creates, and DNS servers whose queries the
+// firewall blocks
+func diagnoseXrayConfig(cfg *Config, add findingFunc) {
+	path := findXrayConfig(cfg)
+	if path == "" {
+		add("Client config", severityOK, "no Xray, sing-box or Hiddify config found", "")
+		return
+	}
+	info, err := readXrayConfig(path)
+	if err != nil {
+		problem := err.Error()
+		if path == cfg.XrayConfig {
+			problem += "; the tunnel is guessed from tun devices"
+		}
+		add("Client config", severityWarning, problem, "set xray_config in "+configPath+" to the client's config")
+		return
+	}
+
+	problems := 0
+	if info.Tunnel != "" && info.Tunnel != tunnelInterface(cfg) {
+		problems++
+		add("Client config", severityWarning,
+			fmt.Sprintf("the tun inbound creates %s, but the rules pass DNS on %s", info.Tunnel, tunnelInterface(cfg)),
+			fmt.Sprintf("set tunnel=%s in %s and run 'saferay xray install'", info.Tunnel, configPath))
+	}
+	if info.Tunnel == "" && len(info.TunnelNetworks) > 0 && !tunNetworksPassed(cfg, info.TunnelNetworks) {
+		problems++
+		add("Client config", severityWarning,
+			fmt.Sprintf("the rules don't pass DNS to the tun's network %s", strings.Join(info.TunnelNetworks, ", ")),
+			"run 'saferay xray install' to take it from "+path)
+	}
+	for _, s := range info.DNSServers {
+		if s.Blocked {
+			problems++
+			add("Client config", severityWarning,
+				fmt.Sprintf("DNS server %s sends plaintext queries outside the tunnel (%s), which the firewall blocks", s.Address, s.Via),
+				"use a DoH server such as https://dns.google/dns-query, or route it through the proxy")
+		}
+	}
+
+	if problems == 0 {
+		add("Client config", severityOK, path+" agrees with the firewall", "")
+	}
+}
+
+// diagnoseLinuxFirewalls warns about firewall managers that flush
+// iptables chains they don't own when they reload
+func diagnoseLinuxFirewalls(fw firewall, add findingFunc) {
+	var active []string
+	for _, manager := range []string{"firewalld", "ufw"} {
+		if exec.Command("systemctl", "is-active", "--quiet", manager).Run() == nil {
+			active = append(active, manager)
+		}
+	}
+
+	switch {
+	case len(active) == 0:
+		add("Firewalls", severityOK, "no other firewall manager running", "")
+	case fw.name() == backendIptables:
+		add("Firewalls", severityWarning, strings.Join(active, ", ")+" may flush the "+iptablesChain+" chain when reloading",
+			"the watch daemon restores it within a minute; or set firewall_backend=nftables")
+	default:
+		add("Firewalls", severityOK, strings.Join(active, ", ")+" running alongside saferay's own nftables table", "")
+	}
+}
+
+// diagnoseDaemons reports health problems of the installed daemons
+func diagnoseDaemons(add findingFunc) {
+	sm := newServiceManager()
+	daemons := []struct {
+		check string
+		s     service
+		// severity of problems: only the auto daemon keeps protection on
+		severity string
+	}{
+		{"Auto daemon", autoService(), severityError},
+		{"Flush daemon", dnsFlushService(), severityWarning},
+	}
+
+	for _, d := range daemons {
+		st := sm.status(d.s)
+		switch {
+		case !st.Installed:
+			add(d.check, severityOK, "not installed", "")
+			continue
+		case d.s.KeepAlive && !st.Running:
+			add(d.check, d.severity, "installed but not running", "run '"+d.s.Setup+"'")
+		case !st.Loaded:
+			add(d.check, d.severity, "installed but not loaded", "run '"+d.s.Setup+"'")
+		}
+
+		for _, issue := range st.Issues {
+			detail, hint, _ := strings.Cut(issue, "; ")
+			add(d.check, d.severity, detail, hint)
+		}
+		for _, drift := range st.Drift {
+			add(d.check, severityWarning, "out of date: "+drift, "run '"+d.s.Setup+"'")
+		}
+
+		if len(st.Issues) == 0 && len(st.Drift) == 0 && (st.Running || !d.s.KeepAlive && st.Loaded) {
+			detail := "loaded"
+			if st.Running {
+				detail = fmt.Sprintf("running (pid %d)", st.PID)
+			}
+			add(d.check, severityOK, detail, "")
+		}
+	}
+}
+
+// diagnoseBinary checks that the installed binary the daemons run is
+// this one
+func diagnoseBinary(add findingFunc) {
+	if _, err := os.Stat(installPath); err != nil {
+		add("Binary", severityOK, installPath+" not installed", "")
+		return
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		exe, err = filepath.EvalSymlinks(exe)
+	}
+	if err != nil || exe == installPath {
+		add("Binary", severityOK, installPath+" is saferay "+version, "")
+		return
+	}
+	if fileHash(exe) != fileHash(installPath) {
+		add("Binary", severityWarning, fmt.Sprintf("%s differs from this saferay %s (%s)", installPath, version, exe),
+			"run 'saferay install' to update it, then restart the daemons")
+		return
+	}
+	add("Binary", severityOK, installPath+" matches this saferay "+version, "")
+}
+
+// diagnosePermissions checks that saferay's files are owned by root and
+// writable only by it: anyone who can write them can turn protection off
+func diagnosePermissions(fw firewall, add findingFunc) {
+	paths := []string{configDir, configPath, fw.rulesPath(), lightConfigPath, installPath, auditDir(), auditPath()}
+	if fw.name() == "pf" {
+		paths = append(paths, pfConf)
+	}
+	sm := newServiceManager()
+	for _, s := range []service{autoService(), dnsFlushService()} {
+		paths = append(paths, sm.path(s))
+	}
+
+	problems := 0
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		stat, ok := info.Sys().(*syscall.Stat_t)
+		if !ok {
+			continue
+		}
+
+		switch {
+		case stat.Uid != 0:
+			problems++
+			add("Permissions", severityWarning, fmt.Sprintf("%s is owned by uid %d, not root", path, stat.Uid), "sudo chown root "+path)
+		case info.Mode().Perm()&0022 != 0:
+			problems++
+			add("Permissions", severityWarning, fmt.Sprintf("%s is writable by group or others (%s)", path, info.Mode().Perm()), "sudo chmod go-w "+path)
+		}
+	}
+	if problems == 0 {
+		add("Permissions", severityOK, "saferay's files are root-owned and not writable by others", "")
+	}
+
+	if runtime.GOOS != "darwin" {
+		return
+	}
+	out, _ := exec.Command("csrutil", "status").CombinedOutput()
+	switch {
+	case strings.Contains(string(out), "enabled."):
+		add("SIP", severityOK, "System Integrity Protection is enabled", "")
+	case strings.Contains(string(out), "disabled"):
+		add("SIP", severityWarning, "System Integrity Protection is disabled, so root malware can tamper with system daemons",
+			"boot into Recovery and run 'csrutil enable'")
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
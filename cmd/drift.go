@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// driftInterval is how often the watch daemon looks for drift
+const driftInterval = time.Minute
+
+// What the watch daemon does about drift, for the drift config key
+const (
+	driftRepair = "repair"
+	driftAlert  = "alert"
+	driftOff    = "off"
+)
+
+// drift is a difference between the live system and the state saferay
+// set up, e.g. pf.conf rewritten by a macOS update
+type drift struct {
+	// What drifted: a file, the loaded rules or a service's DNS
+	What   string `json:"what"`
+	Detail string `json:"detail"`
+	// Diff shows how a file changed from what saferay wrote
+	Diff     string `json:"diff,omitempty"`
+	Repaired bool   `json:"repaired"`
+	Error    string `json:"error,omitempty"`
+
+	// repair puts the expected state back
+	repair func() error
+}
+
+// fix runs the repair and records the outcome
+func (d *drift) fix() error {
+	err := d.repair()
+	d.Repaired = err == nil
+	if err != nil {
+		d.Error = err.Error()
+	}
+	return err
+}
+
+// detectDrift compares the live system with what saferay installed for
+// cfg: the firewall ruleset, its hook and loaded rules, split DNS
+// resolvers and light mode DNS. wantEnabled says protection should be
+// on right now, as the watch daemon decides it.
+func detectDrift(cfg *Config, fw firewall, wantEnabled bool) []drift {
+	var drifts []drift
+
+	// Only what was installed can drift
+	if content, err := os.ReadFile(fw.rulesPath()); err == nil {
+		drifts = append(drifts, firewallDrift(cfg, fw, string(content), wantEnabled)...)
+	}
+	return append(drifts, dnsDrift(cfg)...)
+}
+
+func firewallDrift(cfg *Config, fw firewall, installed string, wantEnabled bool) []drift {
+	var drifts []drift
+
+	if want := fw.render(cfg); installed != want {
+		drifts = append(drifts, drift{
+			What:   fw.rulesPath(),
+			Detail: "changed since saferay wrote it",
+			Diff:   unifiedDiff(fw.rulesPath(), want, installed),
+			repair: func() error { return fw.reload(cfg) },
+		})
+	}
+
+	enabled := fw.status().Enabled
+	if wantEnabled && !enabled {
+		drifts = append(drifts, drift{
+			What:   fw.name(),
+			Detail: "disabled while protection should be on",
+			repair: fw.enable,
+		})
+	}
+	return append(drifts, fw.drift(cfg, enabled)...)
+}
+
+// dnsDrift checks the DNS settings saferay manages outside the firewall
+func dnsDrift(cfg *Config) []drift {
+	var drifts []drift
+
+	// Split DNS resolver files are macOS only
+	if runtime.GOOS == "darwin" {
+		for _, route := range cfg.SplitDNS {
+			if resolverFileMatches(route) {
+				continue
+			}
+			path := resolverDir + "/" + route.Domain
+			content, _ := os.ReadFile(path)
+			route := route
+			drifts = append(drifts, drift{
+				What:   path,
+				Detail: "missing or changed",
+				Diff:   unifiedDiff(path, resolverFileContent(route), string(content)),
+				repair: func() error { return writeResolverFile(route) },
+			})
+		}
+	}
+
+	// Only the service whose DNS light mode saved is light mode's to
+	// repair; another one's original settings were never saved
+	service := lightService()
+	if service == "" || lightDNSSet(service) {
+		return drifts
+	}
+	servers := getDNSServers(service)
+	if len(servers) == 0 {
+		servers = []string{"automatic"}
+	}
+	return append(drifts, drift{
+		What:   "DNS on " + service,
+		Detail: fmt.Sprintf("%s instead of %s, %s", strings.Join(servers, ", "), defaultDNS, defaultDNS2),
+		repair: func() error {
+			setDNS(service, defaultDNS, defaultDNS2)
+			if !sys.dryRun && !lightDNSSet(service) {
+				return fmt.Errorf("DNS on %s is still not %s", service, defaultDNS)
+			}
+			return nil
+		},
+	})
+}
+
+// lightDNSSet reports whether service uses light mode's DNS servers
+func lightDNSSet(service string) bool {
+	servers := getDNSServers(service)
+	return len(servers) > 0 && servers[0] == defaultDNS
+}
+
+// heal looks for drift and, unless the config only asks for alerts,
+// repairs it. Each drift is logged once until it changes or is fixed.
+func (w *watcher) heal() {
+	cfg := loadConfig()
+	if cfg.Drift == driftOff {
+		return
+	}
+
+	seen := map[string]string{}
+	for _, d := range detectDrift(cfg, w.fw, wantPf(w.mode, w.vpnConnected)) {
+		seen[d.What] = d.Detail
+		known := w.drifted[d.What] == d.Detail
+		if !known {
+			daemonLog.warn("drift_detected", "System state drifted from saferay's", "what", d.What, "detail", d.Detail)
+		}
+		if cfg.Drift == driftAlert {
+			continue
+		}
+
+		if err := d.fix(); err != nil {
+			if !known {
+				daemonLog.log(levelError, "drift_repair_failed", "Could not repair drift", "what", d.What, "error", err)
+			}
+			continue
+		}
+		delete(seen, d.What)
+		daemonLog.info("drift_repaired", "Repaired drift", "what", d.What)
+		w.metrics.transition("drift_repaired")
+	}
+	w.drifted = seen
+}
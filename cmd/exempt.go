@@ -0,0 +1,164 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Exemption lets DNS from a user's or group's sockets bypass the block rule
+type Exemption struct {
+	// Kind is "user" or "group", matching the pf rule keyword
+	Kind string
+	Name string
+}
+
+func newXrayExemptCmd() *cobra.Command {
+	cmd := groupCmd("exempt", "Let a user's or group's DNS bypass protection")
+	cmd.AddCommand(
+		exemptActionCmd("add", "Exempt DNS sent by a user or group", addExemption),
+		exemptActionCmd("remove", "Remove an exemption", removeExemption),
+		actionCmd("list", "List exemptions", func() {
+			printExemptions(getExemptionStatus())
+		}),
+	)
+	return cmd
+}
+
+// exemptActionCmd builds add/remove, which take exactly one of --user/--group
+func exemptActionCmd(use, short string, fn func(Exemption)) *cobra.Command {
+	var userName, groupName string
+
+	cmd := &cobra.Command{
+		Use:   use + " (--user <name> | --group <name>)",
+		Short: short,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if userName != "" {
+				fn(Exemption{Kind: "user", Name: userName})
+			} else {
+				fn(Exemption{Kind: "group", Name: groupName})
+			}
+		},
+	}
+	cmd.Flags().StringVar(&userName, "user", "", "user whose DNS is exempt")
+	cmd.Flags().StringVar(&groupName, "group", "", "group whose members' DNS is exempt")
+	cmd.MarkFlagsOneRequired("user", "group")
+	cmd.MarkFlagsMutuallyExclusive("user", "group")
+
+	return cmd
+}
+
+func addExemption(e Exemption) {
+	if err := e.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg := loadConfig()
+	for _, existing := range cfg.Exemptions {
+		if existing == e {
+			fmt.Printf("%s %s is already exempt\n", e.Kind, e.Name)
+			return
+		}
+	}
+	cfg.Exemptions = append(cfg.Exemptions, e)
+
+	if err := saveConfig(cfg); err != nil {
+		fmt.Printf("Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := newFirewall().reload(cfg); err != nil {
+		fmt.Printf("Error updating firewall rules: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ DNS from %s %s is exempt from protection\n", e.Kind, e.Name)
+}
+
+func removeExemption(e Exemption) {
+	cfg := loadConfig()
+
+	var kept []Exemption
+	for _, existing := range cfg.Exemptions {
+		if existing != e {
+			kept = append(kept, existing)
+		}
+	}
+	if len(kept) == len(cfg.Exemptions) {
+		fmt.Printf("No exemption for %s %s\n", e.Kind, e.Name)
+		os.Exit(1)
+	}
+	cfg.Exemptions = kept
+
+	if err := saveConfig(cfg); err != nil {
+		fmt.Printf("Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := newFirewall().reload(cfg); err != nil {
+		fmt.Printf("Error updating firewall rules: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Exemption for %s %s removed\n", e.Kind, e.Name)
+}
+
+// exemptionStatus is a configured exemption and whether the ruleset has it
+type exemptionStatus struct {
+	Kind            string `json:"kind"`
+	Name            string `json:"name"`
+	PfRuleInstalled bool   `json:"pf_rule_installed"`
+}
+
+func getExemptionStatus() []exemptionStatus {
+	fw := newFirewall()
+	rules, _ := os.ReadFile(fw.rulesPath())
+
+	exemptions := []exemptionStatus{}
+	for _, e := range loadConfig().Exemptions {
+		exemptions = append(exemptions, exemptionStatus{
+			Kind:            e.Kind,
+			Name:            e.Name,
+			PfRuleInstalled: strings.Contains(string(rules), fw.exemptRule(e)),
+		})
+	}
+	return exemptions
+}
+
+// printExemptions lists configured exemptions and whether the ruleset has them
+func printExemptions(exemptions []exemptionStatus) {
+	if len(exemptions) == 0 {
+		fmt.Println("\nExemptions:      none")
+		return
+	}
+
+	fmt.Println("\nExemptions:")
+	for _, e := range exemptions {
+		state := "✓ active"
+		if !e.PfRuleInstalled {
+			state = "⚠ rule missing (run 'saferay xray install')"
+		}
+		fmt.Printf("  %-6s %-24s %s\n", e.Kind, e.Name, state)
+	}
+}
+
+// validate checks that the user or group exists on this machine
+func (e Exemption) validate() error {
+	if strings.ContainsAny(e.Name, " \t=\"{}") {
+		return fmt.Errorf("invalid %s name %q", e.Kind, e.Name)
+	}
+
+	var err error
+	if e.Kind == "user" {
+		_, err = user.Lookup(e.Name)
+	} else {
+		_, err = user.LookupGroup(e.Name)
+	}
+	if err != nil {
+		return fmt.Errorf("unknown %s %q", e.Kind, e.Name)
+	}
+	return nil
+}
@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// firewall is the packet filter backend behind the xray commands:
+// pf on macOS, nftables or iptables on Linux
+type firewall interface {
+	name() string
+	// rulesPath is where the rendered ruleset is stored
+	rulesPath() string
+	// render builds the ruleset for cfg: tunnel and loopback passes,
+	// configured exceptions, then the catch-all DNS block
+	render(cfg *Config) string
+	// splitRules, exemptRule and xrayRules are the lines render emits for
+	// each exception, so status can check them against the installed
+	// ruleset
+	splitRules(route SplitRoute) []string
+	exemptRule(e Exemption) string
+	xrayRules(p XrayPass) []string
+
+	// install writes the ruleset and hooks it into the system config
+	install(cfg *Config) error
+	// reload rewrites the ruleset after a config change and loads it
+	reload(cfg *Config) error
+	enable() error
+	disable() error
+	// reset removes everything install added
+	reset() error
+
+	// status queries the live firewall state
+	status() firewallStatus
+	// enabled is a cheap check for the watch daemon, which runs as root
+	enabled() bool
+	// counters reads the loaded rule count and what the block rule dropped
+	counters() firewallCounters
+	// drift checks the hook into the system config and, when enabled,
+	// the loaded rules against what install and enable set up for cfg
+	drift(cfg *Config, enabled bool) []drift
+	// validate parses the installed ruleset, and for pf all of pf.conf,
+	// without loading it
+	validate() error
+}
+
+// firewallStatus is the live state of a firewall backend
+type firewallStatus struct {
+	Installed bool
+	Enabled   bool
+	Loaded    bool
+	Rules     []string
+}
+
+// firewallCounters are the packet counters of the loaded ruleset. They
+// reset whenever the rules are reloaded.
+type firewallCounters struct {
+	Rules          int
+	BlockedPackets uint64
+	BlockedBytes   uint64
+}
+
+// Linux firewall backends, for the firewall_backend config key
+const (
+	backendNftables = "nftables"
+	backendIptables = "iptables"
+)
+
+func newFirewall() firewall {
+	if runtime.GOOS != "linux" {
+		return pfFirewall{}
+	}
+
+	switch loadConfig().FirewallBackend {
+	case backendNftables:
+		return nftFirewall{}
+	case backendIptables:
+		return iptablesFirewall{}
+	}
+	return detectLinuxFirewall()
+}
+
+// detectLinuxFirewall picks the backend whose rules are installed, so
+// status and reset find them, otherwise the best one the host supports
+func detectLinuxFirewall() firewall {
+	for _, fw := range []firewall{nftFirewall{}, iptablesFirewall{}} {
+		if _, err := os.Stat(fw.rulesPath()); err == nil {
+			return fw
+		}
+	}
+
+	if _, err := exec.LookPath("nft"); err == nil {
+		return nftFirewall{}
+	}
+	if _, err := exec.LookPath("iptables"); err == nil {
+		return iptablesFirewall{}
+	}
+	// Neither is installed; nftables errors suggest installing it
+	return nftFirewall{}
+}
+
+// tunnelInterface returns the configured VPN interface or the platform default
+func tunnelInterface(cfg *Config) string {
+	if cfg.Tunnel != "" {
+		return cfg.Tunnel
+	}
+	if runtime.GOOS == "linux" {
+		return "tun0"
+	}
+	return "utun4"
+}
+
+// isVPNConnected checks if a VPN tunnel is up and a client serves it
+func isVPNConnected() bool {
+	return detectVPN().Connected
+}
+
+// tunnelUp checks if a VPN tunnel interface is up: the one the client
+// config describes, or else the configured or any tun device
+func tunnelUp(cfg *Config) bool {
+	if up, known := clientTunnelUp(cfg); known {
+		return up
+	}
+	if runtime.GOOS == "linux" {
+		return isTunnelUpLinux(cfg.Tunnel)
+	}
+	return isVPNConnectedDarwin()
+}
+
+// clientTunnelUp checks the tun of the client config 'xray install' read:
+// the interface it names, or one holding an address in its networks.
+// known is false when there is no such config or it has no tun.
+func clientTunnelUp(cfg *Config) (up, known bool) {
+	if cfg.XrayConfig == "" {
+		return false, false
+	}
+	info, err := readXrayConfig(cfg.XrayConfig)
+	switch {
+	case err != nil:
+		return false, false
+	case info.Tunnel != "":
+		iface, err := net.InterfaceByName(info.Tunnel)
+		return err == nil && iface.Flags&net.FlagUp != 0, true
+	case len(info.TunnelNetworks) > 0:
+		return interfaceWithin(info.TunnelNetworks) != "", true
+	}
+	return false, false
+}
+
+// interfaceWithin returns the up interface holding an address in one of
+// networks, if any
+func interfaceWithin(networks []string) string {
+	var nets []*net.IPNet
+	for _, n := range networks {
+		if _, ipnet, err := net.ParseCIDR(n); err == nil {
+			nets = append(nets, ipnet)
+		}
+	}
+
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 {
+			continue
+		}
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			for _, n := range nets {
+				if n.Contains(ipnet.IP) {
+					return iface.Name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// parseAddress parses an IP address or a CIDR network's address
+func parseAddress(s string) net.IP {
+	if ip, _, err := net.ParseCIDR(s); err == nil {
+		return ip
+	}
+	return net.ParseIP(s)
+}
+
+// isTunnelUpLinux checks sysfs for an up tun device. With a configured
+// tunnel only that interface counts, otherwise any tun device does.
+func isTunnelUpLinux(tunnel string) bool {
+	entries, err := os.ReadDir("/sys/class/net")
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if tunnel != "" && name != tunnel {
+			continue
+		}
+		if tunnel == "" {
+			// Only tun/tap devices have tun_flags
+			if _, err := os.Stat("/sys/class/net/" + name + "/tun_flags"); err != nil {
+				continue
+			}
+		}
+
+		flags, err := os.ReadFile("/sys/class/net/" + name + "/flags")
+		if err != nil {
+			continue
+		}
+		value, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(string(flags)), "0x"), 16, 32)
+		if err == nil && value&0x1 != 0 { // IFF_UP
+			return true
+		}
+	}
+
+	return false
+}
+
+// tunnelDevices lists tun devices on Linux, for 'saferay check'
+func tunnelDevices() []string {
+	entries, _ := os.ReadDir("/sys/class/net")
+
+	var devices []string
+	for _, entry := range entries {
+		if _, err := os.Stat("/sys/class/net/" + entry.Name() + "/tun_flags"); err == nil {
+			devices = append(devices, entry.Name())
+		}
+	}
+	return devices
+}
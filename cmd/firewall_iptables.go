@@ -0,0 +1,427 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	iptablesChain     = "SAFERAY-DNS"
+	iptablesRulesPath = "/etc/saferay/saferay.iptables"
+)
+
+// iptablesFirewall keeps the DNS rules in a dedicated SAFERAY-DNS chain for
+// IPv4 and IPv6. Port 53 traffic is hooked into the chain from OUTPUT, so
+// enabling and disabling only adds or deletes the hook rules.
+type iptablesFirewall struct{}
+
+// iptablesFamily is one of the two iptables commands and its loopback range
+type iptablesFamily struct {
+	name     string
+	iptables string
+	restore  string
+	loopback string
+}
+
+var iptablesFamilies = []iptablesFamily{
+	{"ipv4", "iptables", "iptables-restore", "127.0.0.0/8"},
+	{"ipv6", "ip6tables", "ip6tables-restore", "::1"},
+}
+
+// available reports whether the family's tools are installed. Hosts with
+// IPv6 disabled may lack ip6tables; IPv4 is always required.
+func (f iptablesFamily) available() bool {
+	_, err := exec.LookPath(f.iptables)
+	return err == nil
+}
+
+func (f iptablesFamily) isV6() bool { return f.name == "ipv6" }
+
+// own returns the addresses in ips that belong to the family
+func (f iptablesFamily) own(ips []string) []string {
+	var own []string
+	for _, ip := range ips {
+		if parsed := parseAddress(ip); parsed != nil && (parsed.To4() == nil) == f.isV6() {
+			own = append(own, ip)
+		}
+	}
+	return own
+}
+
+func (iptablesFirewall) name() string { return backendIptables }
+
+func (iptablesFirewall) rulesPath() string { return iptablesRulesPath }
+
+// render builds one iptables-restore section per family, each introduced
+// by a "# ipv4"/"# ipv6" line so enable can feed them to the right tool
+func (f iptablesFirewall) render(cfg *Config) string {
+	var b strings.Builder
+	b.WriteString("# saferay DNS rules, loaded with iptables-restore --noflush\n")
+
+	for _, family := range iptablesFamilies {
+		fmt.Fprintf(&b, "\n# %s\n*filter\n:%s - [0:0]\n", family.name, iptablesChain)
+		fmt.Fprintf(&b, "-A %s -o %s -j ACCEPT\n", iptablesChain, tunnelInterface(cfg))
+		fmt.Fprintf(&b, "-A %s -o lo -d %s -j ACCEPT\n", iptablesChain, family.loopback)
+
+		// Each family only gets the addresses it can reach
+		for _, route := range cfg.SplitDNS {
+			own := SplitRoute{Domain: route.Domain, Resolvers: family.own(route.Resolvers)}
+			for _, rule := range f.splitRules(own) {
+				b.WriteString(rule + "\n")
+			}
+		}
+
+		for _, e := range cfg.Exemptions {
+			b.WriteString(f.exemptRule(e) + "\n")
+		}
+
+		for _, pass := range cfg.XrayPasses {
+			own := XrayPass{Tag: pass.Tag, Addresses: family.own(pass.Addresses)}
+			for _, rule := range f.xrayRules(own) {
+				b.WriteString(rule + "\n")
+			}
+		}
+
+		fmt.Fprintf(&b, "-A %s -j DROP\nCOMMIT\n", iptablesChain)
+	}
+
+	return b.String()
+}
+
+func (iptablesFirewall) splitRules(route SplitRoute) []string {
+	var rules []string
+	for _, ip := range route.Resolvers {
+		rules = append(rules, fmt.Sprintf("-A %s -d %s -m comment --comment \"split %s\" -j ACCEPT", iptablesChain, ip, route.Domain))
+	}
+	return rules
+}
+
+func (iptablesFirewall) xrayRules(p XrayPass) []string {
+	var rules []string
+	for _, ip := range p.Addresses {
+		rules = append(rules, fmt.Sprintf("-A %s -d %s -m comment --comment \"xray %s\" -j ACCEPT", iptablesChain, ip, p.Tag))
+	}
+	return rules
+}
+
+func (iptablesFirewall) exemptRule(e Exemption) string {
+	match := "--uid-owner"
+	if e.Kind == "group" {
+		match = "--gid-owner"
+	}
+	return fmt.Sprintf("-A %s -m owner %s %s -j ACCEPT", iptablesChain, match, e.Name)
+}
+
+func (f iptablesFirewall) install(cfg *Config) error {
+	if _, err := exec.LookPath("iptables"); err != nil {
+		return fmt.Errorf("iptables not found: install the iptables package")
+	}
+
+	ruleset := f.render(cfg)
+	if err := f.load(ruleset, true); err != nil {
+		return err
+	}
+	return sys.writeFile(iptablesRulesPath, []byte(ruleset), 0644)
+}
+
+func (f iptablesFirewall) reload(cfg *Config) error {
+	if _, err := os.Stat(iptablesRulesPath); os.IsNotExist(err) {
+		// Not installed yet, 'xray install' will render it
+		return nil
+	}
+
+	if err := f.install(cfg); err != nil {
+		return err
+	}
+
+	// Declaring the chain again replaces its rules; the OUTPUT hook is
+	// left as it is, so a disabled firewall stays disabled
+	if !f.status().Loaded {
+		return nil
+	}
+	return f.load(f.render(cfg), false)
+}
+
+func (f iptablesFirewall) enable() error {
+	content, err := os.ReadFile(iptablesRulesPath)
+	if err != nil {
+		return fmt.Errorf("reading rules: %w", err)
+	}
+	if err := f.load(string(content), false); err != nil {
+		return err
+	}
+
+	for _, family := range iptablesFamilies {
+		if !family.available() {
+			continue
+		}
+		for _, hook := range iptablesHooks() {
+			if family.check("-C", hook...) {
+				continue
+			}
+			args := append([]string{"sudo", family.iptables, "-I", "OUTPUT", "1"}, hook[1:]...)
+			if err := sys.quiet(args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (iptablesFirewall) disable() error {
+	for _, family := range iptablesFamilies {
+		if !family.available() {
+			continue
+		}
+		for _, hook := range iptablesHooks() {
+			if !family.check("-C", hook...) {
+				continue
+			}
+			args := append([]string{"sudo", family.iptables, "-D"}, hook...)
+			if err := sys.quiet(args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (f iptablesFirewall) reset() error {
+	_ = f.disable()
+
+	for _, family := range iptablesFamilies {
+		if !family.available() || !family.check("-S", iptablesChain) {
+			continue
+		}
+		if err := sys.quiet("sudo", family.iptables, "-F", iptablesChain); err != nil {
+			return err
+		}
+		if err := sys.quiet("sudo", family.iptables, "-X", iptablesChain); err != nil {
+			return err
+		}
+	}
+
+	return sys.removeFile(iptablesRulesPath)
+}
+
+func (iptablesFirewall) status() firewallStatus {
+	var st firewallStatus
+
+	_, err := os.Stat(iptablesRulesPath)
+	st.Installed = err == nil
+
+	// Enabled and loaded only if every available family is; IPv4 is
+	// always required
+	st.Enabled = iptablesFamilies[0].available()
+	st.Loaded = st.Enabled
+	for _, family := range iptablesFamilies {
+		if !family.available() {
+			continue
+		}
+
+		out, err := sudoQuery(family.iptables, "-S", iptablesChain).CombinedOutput()
+		if err != nil {
+			st.Loaded = false
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "-A ") {
+				st.Rules = append(st.Rules, family.iptables+" "+line)
+			}
+		}
+
+		for _, hook := range iptablesHooks() {
+			if !family.check("-C", hook...) {
+				st.Enabled = false
+			}
+		}
+	}
+
+	return st
+}
+
+func (f iptablesFirewall) enabled() bool {
+	return f.status().Enabled
+}
+
+func (iptablesFirewall) counters() firewallCounters {
+	var c firewallCounters
+	for _, family := range iptablesFamilies {
+		if !family.available() {
+			continue
+		}
+		out, _ := sudoQuery(family.iptables, "-L", iptablesChain, "-n", "-v", "-x").CombinedOutput()
+		own := parseIptablesCounters(string(out))
+		c.Rules += own.Rules
+		c.BlockedPackets += own.BlockedPackets
+		c.BlockedBytes += own.BlockedBytes
+	}
+	return c
+}
+
+func (f iptablesFirewall) drift(cfg *Config, enabled bool) []drift {
+	// enabled needs every family hooked; protection is on, and a family
+	// missing its hooks has drifted, as long as any family is hooked
+	hooked := map[string]bool{}
+	for _, family := range iptablesFamilies {
+		if !family.available() {
+			continue
+		}
+		hooked[family.name] = true
+		for _, hook := range iptablesHooks() {
+			if !family.check("-C", hook...) {
+				hooked[family.name] = false
+			}
+		}
+		enabled = enabled || hooked[family.name]
+	}
+	if !enabled {
+		return nil
+	}
+
+	var drifts []drift
+	ruleset := f.render(cfg)
+	for _, family := range iptablesFamilies {
+		if !family.available() {
+			continue
+		}
+		if !hooked[family.name] {
+			drifts = append(drifts, drift{
+				What:   family.iptables + " OUTPUT",
+				Detail: "DNS is no longer sent to the " + iptablesChain + " chain",
+				repair: f.enable,
+			})
+		}
+
+		out, _ := sudoQuery(family.iptables, "-S", iptablesChain).CombinedOutput()
+		loaded, want := iptablesRuleCount(string(out)), iptablesRuleCount(iptablesSection(ruleset, family.name))
+		if loaded != want {
+			drifts = append(drifts, drift{
+				What:   family.iptables + " " + iptablesChain,
+				Detail: fmt.Sprintf("%d rules loaded, %d expected", loaded, want),
+				repair: f.enable,
+			})
+		}
+	}
+	return drifts
+}
+
+func (f iptablesFirewall) validate() error {
+	content, err := os.ReadFile(iptablesRulesPath)
+	if err != nil {
+		return err
+	}
+	return f.load(string(content), true)
+}
+
+// iptablesRuleCount counts the -A lines of 'iptables -S' output or a
+// rendered section
+func iptablesRuleCount(rules string) int {
+	count := 0
+	for _, line := range strings.Split(rules, "\n") {
+		if strings.HasPrefix(line, "-A ") {
+			count++
+		}
+	}
+	return count
+}
+
+// parseIptablesCounters reads 'iptables -L -n -v -x' output: a chain
+// header, a column header, then "pkts bytes target ..." per rule
+func parseIptablesCounters(out string) firewallCounters {
+	var c firewallCounters
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 {
+			continue
+		}
+		packets, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		c.Rules++
+		if fields[2] == "DROP" {
+			bytes, _ := strconv.ParseUint(fields[1], 10, 64)
+			c.BlockedPackets += packets
+			c.BlockedBytes += bytes
+		}
+	}
+	return c
+}
+
+// load feeds each family's section of ruleset to iptables-restore. With
+// test set the rules are only checked, like 'nft -c'.
+func (iptablesFirewall) load(ruleset string, test bool) error {
+	for _, family := range iptablesFamilies {
+		if !family.available() {
+			continue
+		}
+
+		section := iptablesSection(ruleset, family.name)
+		if section == "" {
+			return fmt.Errorf("no %s section in %s", family.name, iptablesRulesPath)
+		}
+
+		if err := family.load(section, test); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// load hands one family's section to its restore command
+func (f iptablesFamily) load(section string, test bool) error {
+	tmp, err := os.CreateTemp("", "saferay-*."+f.name)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(section + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	if test {
+		out, err := sudoQuery(f.restore, "--test", "--noflush", tmp.Name()).CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("invalid %s ruleset: %s", f.name, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+	return sys.quiet("sudo", f.restore, "--noflush", tmp.Name())
+}
+
+// check runs a read-only iptables query and reports whether it succeeded
+func (f iptablesFamily) check(op string, args ...string) bool {
+	return sudoQuery(append([]string{f.iptables, op}, args...)...).Run() == nil
+}
+
+// iptablesHooks are the OUTPUT rules that send DNS into the saferay chain,
+// as arguments after the -C/-I/-D operation
+func iptablesHooks() [][]string {
+	var hooks [][]string
+	for _, proto := range []string{"udp", "tcp"} {
+		hooks = append(hooks, []string{"OUTPUT", "-p", proto, "--dport", "53", "-j", iptablesChain})
+	}
+	return hooks
+}
+
+// iptablesSection extracts one family's section from a rendered ruleset
+func iptablesSection(ruleset, family string) string {
+	var b strings.Builder
+	in := false
+	for _, line := range strings.Split(ruleset, "\n") {
+		if strings.HasPrefix(line, "# ipv") {
+			in = line == "# "+family
+			continue
+		}
+		if in {
+			b.WriteString(line + "\n")
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
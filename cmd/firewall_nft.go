@@ -0,0 +1,246 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	nftTable     = "saferay"
+	nftRulesPath = "/etc/saferay/saferay.nft"
+	nftDNS       = "meta l4proto { tcp, udp } th dport 53"
+)
+
+// nftFirewall loads the DNS rules as a dedicated nftables table.
+// Loading the table enables protection and deleting it disables it, so
+// other nftables users are never touched.
+type nftFirewall struct{}
+
+func (nftFirewall) name() string { return backendNftables }
+
+func (nftFirewall) rulesPath() string { return nftRulesPath }
+
+func (f nftFirewall) render(cfg *Config) string {
+	var b strings.Builder
+
+	// Declaring then deleting the table makes 'nft -f' replace it atomically
+	fmt.Fprintf(&b, "table inet %s\ndelete table inet %s\n\n", nftTable, nftTable)
+	fmt.Fprintf(&b, "table inet %s {\n", nftTable)
+	b.WriteString("\tchain output {\n")
+	b.WriteString("\t\ttype filter hook output priority 0; policy accept;\n\n")
+
+	fmt.Fprintf(&b, "\t\toifname %q %s accept\n", tunnelInterface(cfg), nftDNS)
+	fmt.Fprintf(&b, "\t\toifname \"lo\" ip daddr 127.0.0.0/8 %s accept\n", nftDNS)
+	fmt.Fprintf(&b, "\t\toifname \"lo\" ip6 daddr ::1 %s accept\n", nftDNS)
+
+	for _, route := range cfg.SplitDNS {
+		for _, rule := range f.splitRules(route) {
+			b.WriteString("\t\t" + rule + "\n")
+		}
+	}
+
+	for _, e := range cfg.Exemptions {
+		b.WriteString("\t\t" + f.exemptRule(e) + "\n")
+	}
+
+	for _, pass := range cfg.XrayPasses {
+		for _, rule := range f.xrayRules(pass) {
+			b.WriteString("\t\t" + rule + "\n")
+		}
+	}
+
+	fmt.Fprintf(&b, "\t\t%s counter drop\n", nftDNS)
+	b.WriteString("\t}\n}\n")
+	return b.String()
+}
+
+func (nftFirewall) splitRules(route SplitRoute) []string {
+	var rules []string
+	for _, ip := range route.Resolvers {
+		rules = append(rules, fmt.Sprintf("%s daddr %s %s accept comment \"split %s\"", nftFamily(ip), ip, nftDNS, route.Domain))
+	}
+	return rules
+}
+
+func (nftFirewall) xrayRules(p XrayPass) []string {
+	var rules []string
+	for _, ip := range p.Addresses {
+		rules = append(rules, fmt.Sprintf("%s daddr %s %s accept comment \"xray %s\"", nftFamily(ip), ip, nftDNS, p.Tag))
+	}
+	return rules
+}
+
+// nftFamily is the address match prefix for ip: "ip" or "ip6"
+func nftFamily(ip string) string {
+	if parsed := parseAddress(ip); parsed != nil && parsed.To4() == nil {
+		return "ip6"
+	}
+	return "ip"
+}
+
+func (nftFirewall) exemptRule(e Exemption) string {
+	key := "skuid"
+	if e.Kind == "group" {
+		key = "skgid"
+	}
+	return fmt.Sprintf("meta %s %q %s accept", key, e.Name, nftDNS)
+}
+
+func (f nftFirewall) install(cfg *Config) error {
+	ruleset := f.render(cfg)
+	if err := nftCheck(ruleset); err != nil {
+		return err
+	}
+	return sys.writeFile(nftRulesPath, []byte(ruleset), 0644)
+}
+
+func (f nftFirewall) reload(cfg *Config) error {
+	if _, err := os.Stat(nftRulesPath); os.IsNotExist(err) {
+		// Not installed yet, 'xray install' will render it
+		return nil
+	}
+
+	if err := f.install(cfg); err != nil {
+		return err
+	}
+
+	// Only reload if protection is currently on
+	if !f.status().Enabled {
+		return nil
+	}
+	return f.enable()
+}
+
+func (nftFirewall) enable() error {
+	return sys.quiet("sudo", "nft", "-f", nftRulesPath)
+}
+
+func (f nftFirewall) disable() error {
+	if !f.status().Enabled {
+		return nil
+	}
+	return sys.quiet("sudo", "nft", "delete", "table", "inet", nftTable)
+}
+
+func (f nftFirewall) reset() error {
+	_ = f.disable()
+	return sys.removeFile(nftRulesPath)
+}
+
+func (nftFirewall) status() firewallStatus {
+	var st firewallStatus
+
+	_, err := os.Stat(nftRulesPath)
+	st.Installed = err == nil
+
+	out, err := sudoQuery("nft", "list", "chain", "inet", nftTable, "output").CombinedOutput()
+	st.Enabled = err == nil
+	st.Loaded = st.Enabled
+	st.Rules = nftRuleLines(string(out))
+
+	return st
+}
+
+// nftRuleLines returns the rules of a chain, as listed by nft or as
+// rendered
+func nftRuleLines(out string) []string {
+	var rules []string
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasSuffix(line, "accept") || strings.HasSuffix(line, "drop") || strings.Contains(line, " comment ") {
+			rules = append(rules, line)
+		}
+	}
+	return rules
+}
+
+func (nftFirewall) enabled() bool {
+	return exec.Command("nft", "list", "table", "inet", nftTable).Run() == nil
+}
+
+func (nftFirewall) counters() firewallCounters {
+	out, _ := sudoQuery("nft", "list", "chain", "inet", nftTable, "output").CombinedOutput()
+	return parseNftCounters(string(out))
+}
+
+func (f nftFirewall) drift(cfg *Config, enabled bool) []drift {
+	// The table is loaded directly, with nothing else to hook into
+	if !enabled {
+		return nil
+	}
+
+	out, _ := sudoQuery("nft", "list", "chain", "inet", nftTable, "output").CombinedOutput()
+	loaded, want := len(nftRuleLines(string(out))), len(nftRuleLines(f.render(cfg)))
+	if loaded == want {
+		return nil
+	}
+	return []drift{{
+		What:   "table inet " + nftTable,
+		Detail: fmt.Sprintf("%d rules loaded, %d expected", loaded, want),
+		// Loading the file replaces the table atomically
+		repair: f.enable,
+	}}
+}
+
+func (nftFirewall) validate() error {
+	content, err := os.ReadFile(nftRulesPath)
+	if err != nil {
+		return err
+	}
+	return nftCheck(string(content))
+}
+
+// parseNftCounters reads 'nft list chain' output; the drop rule carries a
+// "counter packets N bytes M" statement
+func parseNftCounters(out string) firewallCounters {
+	var c firewallCounters
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		if !strings.HasSuffix(line, "accept") && !strings.HasSuffix(line, "drop") {
+			continue
+		}
+		c.Rules++
+		if !strings.HasSuffix(line, "drop") {
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			n, _ := strconv.ParseUint(fields[i+1], 10, 64)
+			switch fields[i] {
+			case "packets":
+				c.BlockedPackets += n
+			case "bytes":
+				c.BlockedBytes += n
+			}
+		}
+	}
+	return c
+}
+
+// nftCheck validates a ruleset with 'nft -c' without loading it
+func nftCheck(ruleset string) error {
+	if _, err := exec.LookPath("nft"); err != nil {
+		return fmt.Errorf("nft not found: install the nftables package")
+	}
+
+	tmp, err := os.CreateTemp("", "saferay-*.nft")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(ruleset); err != nil {
+		tmp.Close()
+		return err
+	}
+	tmp.Close()
+
+	out, err := sudoQuery("nft", "-c", "-f", tmp.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("invalid nftables ruleset: %s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
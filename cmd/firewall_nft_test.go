@@ -0,0 +1,121 @@
+package cmd
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// nftAvailable skips the test unless nft can check rulesets, which needs
+// CAP_NET_ADMIN even in check mode
+func nftAvailable(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("nft"); err != nil {
+		t.Skip("nft not installed")
+	}
+	cmd := exec.Command("nft", "-c", "-f", "-")
+	cmd.Stdin = strings.NewReader("table inet saferay_probe\n")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Skipf("nft can't check rulesets here: %s", strings.TrimSpace(string(out)))
+	}
+}
+
+func TestNftRender(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  Config
+		// rules must appear in the output chain in this order, before the
+		// drop rule
+		rules []string
+	}{
+		{
+			name: "defaults",
+			cfg:  Config{Tunnel: "tun0"},
+			rules: []string{
+				`oifname "tun0" meta l4proto { tcp, udp } th dport 53 accept`,
+				`oifname "lo" ip daddr 127.0.0.0/8 meta l4proto { tcp, udp } th dport 53 accept`,
+				`oifname "lo" ip6 daddr ::1 meta l4proto { tcp, udp } th dport 53 accept`,
+			},
+		},
+		{
+			name: "split routes, exemptions and xray passes",
+			cfg: Config{
+				Tunnel: "wg0",
+				SplitDNS: []SplitRoute{
+					{Domain: "corp.example", Resolvers: []string{"10.0.0.53", "fd00::53"}},
+					{Domain: "home.arpa", Resolvers: []string{"192.168.1.1"}},
+				},
+				Exemptions: []Exemption{
+					{Kind: "user", Name: "root"},
+					{Kind: "group", Name: "root"},
+				},
+				XrayPasses: []XrayPass{
+					{Tag: "proxy", Addresses: []string{"203.0.113.5", "2001:db8::5"}},
+					{Tag: "tun", Addresses: []string{"172.19.0.0/28", "fdfe:dcba:9876::/126"}},
+				},
+			},
+			rules: []string{
+				`oifname "wg0" meta l4proto { tcp, udp } th dport 53 accept`,
+				`ip daddr 10.0.0.53 meta l4proto { tcp, udp } th dport 53 accept comment "split corp.example"`,
+				`ip6 daddr fd00::53 meta l4proto { tcp, udp } th dport 53 accept comment "split corp.example"`,
+				`ip daddr 192.168.1.1 meta l4proto { tcp, udp } th dport 53 accept comment "split home.arpa"`,
+				`meta skuid "root" meta l4proto { tcp, udp } th dport 53 accept`,
+				`meta skgid "root" meta l4proto { tcp, udp } th dport 53 accept`,
+				`ip daddr 203.0.113.5 meta l4proto { tcp, udp } th dport 53 accept comment "xray proxy"`,
+				`ip6 daddr 2001:db8::5 meta l4proto { tcp, udp } th dport 53 accept comment "xray proxy"`,
+				`ip daddr 172.19.0.0/28 meta l4proto { tcp, udp } th dport 53 accept comment "xray tun"`,
+				`ip6 daddr fdfe:dcba:9876::/126 meta l4proto { tcp, udp } th dport 53 accept comment "xray tun"`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ruleset := nftFirewall{}.render(&tt.cfg)
+
+			var lines []string
+			for _, line := range strings.Split(ruleset, "\n") {
+				lines = append(lines, strings.TrimSpace(line))
+			}
+			drop := indexOf(lines, nftDNS+" counter drop")
+			if drop < 0 {
+				t.Fatalf("no drop rule in:\n%s", ruleset)
+			}
+			last := -1
+			for _, rule := range tt.rules {
+				i := indexOf(lines, rule)
+				switch {
+				case i < 0:
+					t.Errorf("missing rule %s", rule)
+				case i < last:
+					t.Errorf("rule out of order: %s", rule)
+				case i > drop:
+					t.Errorf("rule after the drop rule: %s", rule)
+				}
+				last = i
+			}
+			if t.Failed() {
+				t.Logf("ruleset:\n%s", ruleset)
+			}
+
+			t.Run("nft -c", func(t *testing.T) {
+				nftAvailable(t)
+				cmd := exec.Command("nft", "-c", "-f", "-")
+				cmd.Stdin = strings.NewReader(ruleset)
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Errorf("nft rejected the ruleset: %s\n%s", strings.TrimSpace(string(out)), ruleset)
+				}
+			})
+		})
+	}
+}
+
+// indexOf returns the index of s in lines, or -1
+func indexOf(lines []string, s string) int {
+	for i, line := range lines {
+		if line == s {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,323 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const (
+	pfConf      = "/etc/pf.conf"
+	anchorPath  = "/etc/pf.anchors/xray-dns"
+	anchorName  = "xray-dns"
+	anchorRules = `pass out quick on %s proto { udp tcp } to any port 53
+pass out quick on lo0 proto { udp tcp } to 127.0.0.0/8 port 53
+`
+	anchorBlockRule = "block out quick proto { udp tcp } to any port 53\n"
+	// anchorLogBlockRule also logs blocked packets, with the sending
+	// process, to pflog0
+	anchorLogBlockRule = "block out log (user) quick proto { udp tcp } to any port 53\n"
+)
+
+// pfFirewall loads the DNS rules as a pf anchor referenced from pf.conf
+type pfFirewall struct{}
+
+func (pfFirewall) name() string { return "pf" }
+
+func (pfFirewall) rulesPath() string { return anchorPath }
+
+func (f pfFirewall) render(cfg *Config) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, anchorRules, tunnelInterface(cfg))
+
+	for _, route := range cfg.SplitDNS {
+		for _, rule := range f.splitRules(route) {
+			b.WriteString(rule + "\n")
+		}
+	}
+
+	for _, e := range cfg.Exemptions {
+		b.WriteString(f.exemptRule(e) + "\n")
+	}
+
+	for _, pass := range cfg.XrayPasses {
+		for _, rule := range f.xrayRules(pass) {
+			b.WriteString(rule + "\n")
+		}
+	}
+
+	if cfg.LogBlocked {
+		b.WriteString(anchorLogBlockRule)
+	} else {
+		b.WriteString(anchorBlockRule)
+	}
+	return b.String()
+}
+
+func (pfFirewall) splitRules(route SplitRoute) []string {
+	var rules []string
+	for _, ip := range route.Resolvers {
+		rules = append(rules, fmt.Sprintf("pass out quick proto { udp tcp } to %s port 53 # split %s", ip, route.Domain))
+	}
+	return rules
+}
+
+func (pfFirewall) exemptRule(e Exemption) string {
+	return fmt.Sprintf("pass out quick proto { udp tcp } to any port 53 %s %s", e.Kind, e.Name)
+}
+
+func (pfFirewall) xrayRules(p XrayPass) []string {
+	var rules []string
+	for _, ip := range p.Addresses {
+		rules = append(rules, fmt.Sprintf("pass out quick proto { udp tcp } to %s port 53 # xray %s", ip, p.Tag))
+	}
+	return rules
+}
+
+func (f pfFirewall) install(cfg *Config) error {
+	if err := sys.writeFile(anchorPath, []byte(f.render(cfg)), 0644); err != nil {
+		return fmt.Errorf("writing anchor: %w", err)
+	}
+
+	// Read current pf.conf
+	pfContent, err := os.ReadFile(pfConf)
+	if err != nil {
+		return fmt.Errorf("reading pf.conf: %w", err)
+	}
+
+	// Remove existing xray-dns lines first, then add anchor lines
+	newContent := removeAnchorLines(string(pfContent))
+	newContent = strings.TrimRight(newContent, "\n\t ")
+	newContent += fmt.Sprintf("\nanchor \"%s\"\nload anchor \"%s\" from \"%s\"\n", anchorName, anchorName, anchorPath)
+
+	if err := sys.writeFile(pfConf, []byte(newContent), 0644); err != nil {
+		return fmt.Errorf("updating pf.conf: %w", err)
+	}
+	return nil
+}
+
+func (f pfFirewall) reload(cfg *Config) error {
+	if _, err := os.Stat(anchorPath); os.IsNotExist(err) {
+		// Not installed yet, 'xray install' will render it
+		return nil
+	}
+
+	if err := sys.writeFile(anchorPath, []byte(f.render(cfg)), 0644); err != nil {
+		return err
+	}
+
+	return sys.quiet("sudo", "pfctl", "-a", anchorName, "-f", anchorPath)
+}
+
+func (pfFirewall) enable() error {
+	return sys.quiet("sudo", "pfctl", "-ef", pfConf)
+}
+
+func (pfFirewall) disable() error {
+	return sys.quiet("sudo", "pfctl", "-d")
+}
+
+func (f pfFirewall) reset() error {
+	// Disable pf first
+	_ = f.disable()
+
+	// Clean pf.conf
+	pfContent, err := os.ReadFile(pfConf)
+	if err == nil {
+		newContent := removeAnchorLines(string(pfContent))
+		if newContent != string(pfContent) {
+			if err := sys.writeFile(pfConf, []byte(newContent), 0644); err != nil {
+				return fmt.Errorf("updating pf.conf: %w", err)
+			}
+		}
+	}
+
+	return sys.removeFile(anchorPath)
+}
+
+func (pfFirewall) status() firewallStatus {
+	var st firewallStatus
+
+	// Check anchor file
+	_, err := os.Stat(anchorPath)
+	st.Installed = err == nil
+
+	// Check pf status
+	out, _ := sudoQuery("pfctl", "-s", "info").CombinedOutput()
+	st.Enabled = strings.Contains(string(out), "Status: Enabled")
+
+	// Check anchor loaded
+	out, _ = sudoQuery("pfctl", "-s", "Anchors").CombinedOutput()
+	st.Loaded = strings.Contains(string(out), anchorName)
+
+	// Loaded rules
+	out, _ = sudoQuery("pfctl", "-a", anchorName, "-s", "rules").CombinedOutput()
+	st.Rules = pfRuleLines(string(out))
+
+	return st
+}
+
+// pfRuleLines returns the rules in 'pfctl -s rules' output, without ALTQ
+// warnings
+func pfRuleLines(out string) []string {
+	var rules []string
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "ALTQ") && strings.TrimSpace(line) != "" {
+			rules = append(rules, line)
+		}
+	}
+	return rules
+}
+
+func (pfFirewall) enabled() bool {
+	out, _ := exec.Command("pfctl", "-s", "info").CombinedOutput()
+	return strings.Contains(string(out), "Status: Enabled")
+}
+
+func (pfFirewall) counters() firewallCounters {
+	out, _ := sudoQuery("pfctl", "-a", anchorName, "-vsr").CombinedOutput()
+	return parsePfCounters(string(out))
+}
+
+// parsePfCounters reads 'pfctl -vsr' output, where each rule is followed
+// by indented lines like "[ Evaluations: 9  Packets: 2  Bytes: 120  States: 0 ]"
+func parsePfCounters(out string) firewallCounters {
+	var c firewallCounters
+	blocking := false
+	for _, line := range strings.Split(out, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "" || strings.Contains(line, "ALTQ"):
+		case !strings.HasPrefix(line, " ") && !strings.HasPrefix(line, "\t"):
+			c.Rules++
+			blocking = strings.HasPrefix(trimmed, "block")
+		case blocking && strings.HasPrefix(trimmed, "[ Evaluations:"):
+			fields := strings.Fields(strings.Trim(trimmed, "[]"))
+			for i := 0; i+1 < len(fields); i++ {
+				n, _ := strconv.ParseUint(fields[i+1], 10, 64)
+				switch fields[i] {
+				case "Packets:":
+					c.BlockedPackets += n
+				case "Bytes:":
+					c.BlockedBytes += n
+				}
+			}
+		}
+	}
+	return c
+}
+
+func (f pfFirewall) drift(cfg *Config, enabled bool) []drift {
+	var drifts []drift
+
+	pfContent, _ := os.ReadFile(pfConf)
+	if !pfConfHooked(string(pfContent)) {
+		drifts = append(drifts, drift{
+			What:   pfConf,
+			Detail: "no longer loads the " + anchorName + " anchor",
+			repair: func() error { return f.install(cfg) },
+		})
+	}
+	if !enabled {
+		return drifts
+	}
+
+	out, _ := sudoQuery("pfctl", "-s", "Anchors").CombinedOutput()
+	if !strings.Contains(string(out), anchorName) {
+		// Reloading pf.conf brings the anchor back
+		return append(drifts, drift{
+			What:   "pf ruleset",
+			Detail: "pf is enabled without the " + anchorName + " anchor",
+			repair: f.enable,
+		})
+	}
+
+	out, _ = sudoQuery("pfctl", "-a", anchorName, "-s", "rules").CombinedOutput()
+	loaded, want := len(pfRuleLines(string(out))), pfRuleCount(f.render(cfg))
+	if loaded != want {
+		drifts = append(drifts, drift{
+			What:   "anchor " + anchorName,
+			Detail: fmt.Sprintf("%d rules loaded, %d expected", loaded, want),
+			repair: func() error { return sys.quiet("sudo", "pfctl", "-a", anchorName, "-f", anchorPath) },
+		})
+	}
+	return drifts
+}
+
+func (pfFirewall) validate() error {
+	out, err := sudoQuery("pfctl", "-nf", pfConf).CombinedOutput()
+	if err == nil {
+		return nil
+	}
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if !strings.Contains(line, "ALTQ") && strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.TrimSpace(line))
+		}
+	}
+	if len(lines) == 0 {
+		return err
+	}
+	return fmt.Errorf("%s", strings.Join(lines, "; "))
+}
+
+// pfConfHooked reports whether pf.conf has both lines install adds
+func pfConfHooked(pfContent string) bool {
+	anchor := fmt.Sprintf("anchor \"%s\"", anchorName)
+	load := fmt.Sprintf("load anchor \"%s\" from \"%s\"", anchorName, anchorPath)
+
+	var hasAnchor, hasLoad bool
+	for _, line := range strings.Split(pfContent, "\n") {
+		switch strings.TrimSpace(line) {
+		case anchor:
+			hasAnchor = true
+		case load:
+			hasLoad = true
+		}
+	}
+	return hasAnchor && hasLoad
+}
+
+// pfRuleCount is how many rules pf loads for a ruleset: it expands each
+// { } list, so "proto { udp tcp }" becomes two rules
+func pfRuleCount(ruleset string) int {
+	count := 0
+	for _, line := range strings.Split(ruleset, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		n := 1
+		for {
+			_, rest, ok := strings.Cut(line, "{")
+			if !ok {
+				break
+			}
+			list, after, _ := strings.Cut(rest, "}")
+			if items := len(strings.FieldsFunc(list, func(r rune) bool { return r == ' ' || r == ',' })); items > 0 {
+				n *= items
+			}
+			line = after
+		}
+		count += n
+	}
+	return count
+}
+
+// removeAnchorLines drops saferay's anchor lines from pf.conf content
+func removeAnchorLines(pfContent string) string {
+	if !strings.Contains(pfContent, anchorName) {
+		return pfContent
+	}
+
+	var filtered []string
+	for _, line := range strings.Split(pfContent, "\n") {
+		if !strings.Contains(line, anchorName) {
+			filtered = append(filtered, line)
+		}
+	}
+	return strings.Join(filtered, "\n")
+}
@@ -2,13 +2,29 @@ package cmd
 
 import (
 	"fmt"
-	"io"
 	"os"
-	"os/exec"
+
+	"github.com/spf13/cobra"
 )
 
 const installPath = "/usr/local/bin/saferay"
 
+func newInstallCmd() *cobra.Command {
+	var lightMode bool
+
+	cmd := &cobra.Command{
+		Use:   "install",
+		Short: "Install saferay to /usr/local/bin",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			cmdInstallWithOptions(lightMode)
+		},
+	}
+	cmd.Flags().BoolVarP(&lightMode, "light", "l", false, "also set up light mode (DNS flush + 8.8.8.8)")
+
+	return cmd
+}
+
 func cmdInstallWithOptions(lightMode bool) {
 	cmdInstall()
 
@@ -30,35 +46,8 @@ func cmdInstall() {
 		return
 	}
 
-	// Copy binary to temp first
-	src, err := os.Open(execPath)
-	if err != nil {
-		fmt.Printf("Error opening source: %v\n", err)
-		os.Exit(1)
-	}
-	defer src.Close()
-
-	tmpPath := "/tmp/saferay_install"
-	dst, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
-	if err != nil {
-		fmt.Printf("Error creating temp file: %v\n", err)
-		os.Exit(1)
-	}
-
-	if _, err := io.Copy(dst, src); err != nil {
-		dst.Close()
-		fmt.Printf("Error copying binary: %v\n", err)
-		os.Exit(1)
-	}
-	dst.Close()
-
-	// Move to /usr/local/bin with sudo
-	cmd := exec.Command("sudo", "mv", tmpPath, installPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-
-	if err := cmd.Run(); err != nil {
+	// Copy to /usr/local/bin with sudo
+	if err := sys.run("sudo", "install", "-m", "0755", execPath, installPath); err != nil {
 		fmt.Printf("Error installing (need sudo): %v\n", err)
 		os.Exit(1)
 	}
@@ -68,12 +57,7 @@ func cmdInstall() {
 
 func cmdUninstall() {
 	// Remove binary
-	cmd := exec.Command("sudo", "rm", "-f", installPath)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-
-	if err := cmd.Run(); err != nil {
+	if err := sys.run("sudo", "rm", "-f", installPath); err != nil {
 		fmt.Printf("Error removing binary: %v\n", err)
 	}
 
@@ -88,8 +72,8 @@ func cmdUninstall() {
 		if service != "" {
 			resetDNS(service)
 		}
-		_ = exec.Command("sudo", "rm", "-rf", "/etc/saferay").Run()
 	}
+	_ = sys.removeFile(configDir)
 
 	fmt.Println("✓ saferay uninstalled")
 }
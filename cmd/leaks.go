@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"saferay/internal/capture"
+)
+
+// With log_blocked=true the pf block rule logs to pflog0. The watch daemon
+// reads it through tcpdump's pcap output, decodes the DNS question and
+// records each attempt in the leak log, which 'saferay leaks' summarises.
+
+const (
+	leakLogPath = "/var/log/saferay-leaks.log"
+	pflogIface  = "pflog0"
+	leakEvent   = "dns_leak_blocked"
+)
+
+// leakLog is the leak log, written by the watch daemon
+var leakLog = &eventLogger{}
+
+// leakAttempt is one blocked DNS packet
+type leakAttempt struct {
+	Time    time.Time `json:"time"`
+	Process string    `json:"process"`
+	PID     int       `json:"pid,omitempty"`
+	UID     int       `json:"uid"`
+	Proto   string    `json:"proto"`
+	Dst     string    `json:"dst"`
+	Query   string    `json:"query"`
+	Type    string    `json:"type"`
+}
+
+// decodeLeak turns a packet captured on pflog0 into a leak attempt
+func decodeLeak(pkt capture.Packet) (leakAttempt, error) {
+	if pkt.LinkType != capture.LinkPflog {
+		return leakAttempt{}, fmt.Errorf("link type %s is not pflog", pkt.LinkType)
+	}
+	frame, err := capture.Decode(pkt)
+	if err != nil {
+		return leakAttempt{}, err
+	}
+	hdr, ip := frame.Pflog, frame.IP
+
+	leak := leakAttempt{
+		Time:  pkt.Time,
+		UID:   -1,
+		Proto: ip.Proto,
+		Dst:   ip.Dst.String(),
+		// A blocked TCP query is only its SYN, without a question
+		Query: "-",
+		Type:  "-",
+	}
+	if hdr.PID > 0 && hdr.PID != capture.PflogNoPID {
+		leak.PID = int(hdr.PID)
+		leak.UID = int(hdr.UID)
+	}
+	payload := ip.Payload
+	if ip.Proto == "tcp" {
+		msgs, _ := capture.SplitTCPDNS(payload)
+		payload = nil
+		if len(msgs) > 0 {
+			payload = msgs[0]
+		}
+	}
+	if msg, err := capture.ParseDNS(payload); err == nil && len(msg.Questions) > 0 {
+		leak.Query, leak.Type = msg.Questions[0].Name, msg.Questions[0].TypeName()
+	}
+	return leak, nil
+}
+
+// leakFromEntry reads a leak attempt back from the leak log
+func leakFromEntry(e logEntry) leakAttempt {
+	leak := leakAttempt{
+		Time:    e.Time,
+		Process: e.Fields["process"],
+		Proto:   e.Fields["proto"],
+		Dst:     e.Fields["dst"],
+		Query:   e.Fields["query"],
+		Type:    e.Fields["type"],
+	}
+	leak.PID, _ = strconv.Atoi(e.Fields["pid"])
+	leak.UID, _ = strconv.Atoi(e.Fields["uid"])
+	return leak
+}
+
+// watchLeaks records blocked DNS packets until the daemon exits,
+// restarting tcpdump if it stops
+func watchLeaks() {
+	if logFile, err := openRotatingFile(leakLogPath); err == nil {
+		leakLog.out = logFile
+	} else {
+		daemonLog.warn("leak_log_failed", "Can't open the leak log", "path", leakLogPath, "error", err)
+		return
+	}
+	// Leaks are security telemetry, so they go to the system log too
+	leakLog.system = daemonLog.system
+
+	for ; ; time.Sleep(watchInterval) {
+		if err := captureLeaks(); err != nil {
+			daemonLog.warn("leak_capture_error", "Leak capture stopped, restarting", "error", err)
+		}
+	}
+}
+
+// captureLeaks runs tcpdump on pflog0 and logs each packet it decodes
+func captureLeaks() error {
+	// pflog0 only exists once something creates it
+	if exec.Command("ifconfig", pflogIface).Run() != nil {
+		if err := sys.quiet("sudo", "ifconfig", pflogIface, "create"); err != nil {
+			return fmt.Errorf("creating %s: %w", pflogIface, err)
+		}
+	}
+
+	// -U writes each packet as it arrives instead of buffering
+	tcpdump := exec.Command("tcpdump", "-n", "-U", "-i", pflogIface, "-w", "-")
+	out, err := tcpdump.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := tcpdump.Start(); err != nil {
+		return err
+	}
+	defer func() { _ = tcpdump.Wait() }()
+	defer func() { _ = tcpdump.Process.Kill() }()
+
+	pcap, err := capture.NewReader(out)
+	if err != nil {
+		return err
+	}
+	names := map[int]string{}
+	for {
+		pkt, err := pcap.Next()
+		if err != nil {
+			return err
+		}
+		leak, err := decodeLeak(pkt)
+		if err != nil {
+			continue
+		}
+		// Look the process up now, while it's likely still running
+		leak.Process = processName(leak.PID, names)
+		leakLog.warn(leakEvent, "Blocked DNS query outside the tunnel",
+			"process", leak.Process, "pid", leak.PID, "uid", leak.UID,
+			"proto", leak.Proto, "dst", leak.Dst, "query", leak.Query, "type", leak.Type)
+	}
+}
+
+// processName looks up a pid's command name, caching it in names
+func processName(pid int, names map[int]string) string {
+	if pid == 0 {
+		return "unknown"
+	}
+	if name, ok := names[pid]; ok {
+		return name
+	}
+
+	name := fmt.Sprintf("pid %d", pid)
+	if out, err := exec.Command("ps", "-p", strconv.Itoa(pid), "-o", "comm=").Output(); err == nil {
+		if comm := strings.TrimSpace(string(out)); comm != "" {
+			// comm is the executable path on macOS
+			name = comm[strings.LastIndex(comm, "/")+1:]
+		}
+	}
+	// Pids are reused; the cache only has to outlive a burst of retries
+	if len(names) > 1000 {
+		clear(names)
+	}
+	names[pid] = name
+	return name
+}
+
+func newLeaksCmd() *cobra.Command {
+	var since, file string
+
+	cmd := &cobra.Command{
+		Use:   "leaks",
+		Short: "Summarise blocked DNS leak attempts",
+		Long: `Summarise the DNS queries pf blocked outside the tunnel, by process
+and query name.
+
+Attempts are recorded by the auto daemon when log_blocked=true is set in
+the config. --file reads a pflog capture instead, e.g. one recorded with
+'sudo tcpdump -i pflog0 -w leaks.pcap'.`,
+		Example: "  saferay leaks --since 1h\n  saferay leaks --file leaks.pcap",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var from time.Time
+			if since != "" {
+				var err error
+				if from, err = parseSince(since, time.Now()); err != nil {
+					return err
+				}
+			}
+			showLeaks(from, file)
+			return nil
+		},
+	}
+	cmd.Flags().StringVar(&since, "since", "", "only attempts newer than this (30m, 2h, 7d, date)")
+	cmd.Flags().StringVar(&file, "file", "", "read a pflog pcap capture instead of the leak log")
+
+	return cmd
+}
+
+// leakGroup is the attempts made by one process
+type leakGroup struct {
+	Process  string      `json:"process"`
+	Count    int         `json:"count"`
+	First    time.Time   `json:"first"`
+	Last     time.Time   `json:"last"`
+	Queries  []leakQuery `json:"queries"`
+	PIDs     []int       `json:"pids,omitempty"`
+	byQuery  map[string]*leakQuery
+	pidsSeen map[int]bool
+}
+
+// leakQuery is how often a process tried to resolve one name
+type leakQuery struct {
+	Query string `json:"query"`
+	Type  string `json:"type"`
+	Count int    `json:"count"`
+}
+
+// leaksReport is the result of 'saferay leaks'
+type leaksReport struct {
+	report
+	Source    string      `json:"source"`
+	Since     *time.Time  `json:"since,omitempty"`
+	Total     int         `json:"total"`
+	Processes []leakGroup `json:"processes"`
+}
+
+func showLeaks(since time.Time, file string) {
+	st := leaksReport{report: newReport("leaks"), Source: leakLogPath, Processes: []leakGroup{}}
+	if !since.IsZero() {
+		st.Since = &since
+	}
+
+	var leaks []leakAttempt
+	var err error
+	if file != "" {
+		st.Source = file
+		leaks, err = readLeakCapture(file)
+	} else {
+		leaks, err = readLeakLog()
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	groups := map[string]*leakGroup{}
+	for _, leak := range leaks {
+		if !since.IsZero() && leak.Time.Before(since) {
+			continue
+		}
+		st.Total++
+
+		g := groups[leak.Process]
+		if g == nil {
+			g = &leakGroup{Process: leak.Process, First: leak.Time, byQuery: map[string]*leakQuery{}, pidsSeen: map[int]bool{}}
+			groups[leak.Process] = g
+		}
+		g.Count++
+		g.Last = leak.Time
+		if leak.PID > 0 && !g.pidsSeen[leak.PID] {
+			g.pidsSeen[leak.PID] = true
+			g.PIDs = append(g.PIDs, leak.PID)
+		}
+		key := leak.Query + " " + leak.Type
+		if g.byQuery[key] == nil {
+			g.byQuery[key] = &leakQuery{Query: leak.Query, Type: leak.Type}
+		}
+		g.byQuery[key].Count++
+	}
+
+	for _, g := range groups {
+		for _, q := range g.byQuery {
+			g.Queries = append(g.Queries, *q)
+		}
+		sort.Slice(g.Queries, func(i, j int) bool {
+			if g.Queries[i].Count != g.Queries[j].Count {
+				return g.Queries[i].Count > g.Queries[j].Count
+			}
+			return g.Queries[i].Query < g.Queries[j].Query
+		})
+		st.Processes = append(st.Processes, *g)
+	}
+	sort.Slice(st.Processes, func(i, j int) bool {
+		if st.Processes[i].Count != st.Processes[j].Count {
+			return st.Processes[i].Count > st.Processes[j].Count
+		}
+		return st.Processes[i].Process < st.Processes[j].Process
+	})
+
+	finish(&st.report, st, func() {
+		if st.Total == 0 {
+			fmt.Println("No blocked DNS queries" + sinceSuffix(since))
+			if file == "" && !loadConfig().LogBlocked {
+				fmt.Println("  Leak logging is off: set log_blocked=true in " + configPath + ",")
+				fmt.Println("  then run 'saferay xray install' and restart auto mode")
+			}
+			return
+		}
+
+		fmt.Printf("=== %d blocked DNS queries%s ===\n", st.Total, sinceSuffix(since))
+		for _, g := range st.Processes {
+			fmt.Printf("\n%s  %d blocked, %s to %s\n", g.Process, g.Count,
+				g.First.Local().Format("2006-01-02 15:04"), g.Last.Local().Format("2006-01-02 15:04"))
+			for _, q := range g.Queries {
+				fmt.Printf("  %5d  %-6s %s\n", q.Count, q.Type, q.Query)
+			}
+		}
+	})
+}
+
+func sinceSuffix(since time.Time) string {
+	if since.IsZero() {
+		return ""
+	}
+	return " since " + since.Local().Format("2006-01-02 15:04")
+}
+
+// readLeakLog reads attempts from the leak log and its rotated files
+func readLeakLog() ([]leakAttempt, error) {
+	var leaks []leakAttempt
+	for _, path := range logFiles(leakLogPath) {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			if entry := parseLogLine(scanner.Text()); entry.Event == leakEvent {
+				leaks = append(leaks, leakFromEntry(entry))
+			}
+		}
+		f.Close()
+	}
+	return leaks, nil
+}
+
+// readLeakCapture decodes the attempts in a pflog capture file
+func readLeakCapture(path string) ([]leakAttempt, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	pcap, err := capture.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	var leaks []leakAttempt
+	for {
+		pkt, err := pcap.Next()
+		if err == io.EOF {
+			return leaks, nil
+		}
+		if err != nil {
+			return leaks, err
+		}
+		if pkt.LinkType != capture.LinkPflog {
+			return nil, fmt.Errorf("%s: link type %s is not pflog; capture with 'tcpdump -i %s', or use 'saferay analyze'", path, pkt.LinkType, pflogIface)
+		}
+		leak, err := decodeLeak(pkt)
+		if err != nil {
+			continue
+		}
+		// The processes are long gone, so only the pid is known
+		leak.Process = "unknown"
+		if leak.PID > 0 {
+			leak.Process = fmt.Sprintf("pid %d", leak.PID)
+		}
+		leaks = append(leaks, leak)
+	}
+}
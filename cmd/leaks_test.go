@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"saferay/internal/capture"
+)
+
+// captureFixture is a capture shared with the decoder's tests
+func captureFixture(name string) string {
+	return filepath.Join("..", "internal", "capture", "testdata", name)
+}
+
+func TestDecodeLeak(t *testing.T) {
+	t0 := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	want := []leakAttempt{
+		{Time: t0.Add(125 * time.Millisecond), Process: "pid 4242", PID: 4242, UID: 501, Proto: "udp", Dst: "8.8.8.8", Query: "example.com", Type: "A"},
+		// pf found no socket, so neither pid nor uid is known
+		{Time: t0.Add(250 * time.Millisecond), Process: "unknown", UID: -1, Proto: "udp", Dst: "2001:4860:4860::8888", Query: "www.example.org", Type: "AAAA"},
+		// A blocked connection never gets past its SYN
+		{Time: t0.Add(1500 * time.Millisecond), Process: "pid 4242", PID: 4242, UID: 501, Proto: "tcp", Dst: "1.1.1.1", Query: "-", Type: "-"},
+		{Time: t0.Add(2 * time.Second), Process: "pid 5150", PID: 5150, UID: 0, Proto: "tcp", Dst: "9.9.9.9", Query: "api.example.net", Type: "HTTPS"},
+	}
+
+	// The capture is synthetic, as recording pflog0 needs a Mac. Its last
+	// packet is cut off and ends it.
+	leaks, err := readLeakCapture(captureFixture("synthetic-pflog.pcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaks) != len(want) {
+		t.Fatalf("decoded %d leaks, want %d: %+v", len(leaks), len(want), leaks)
+	}
+	for i, leak := range leaks {
+		if !leak.Time.Equal(want[i].Time) {
+			t.Errorf("leak %d: time %s, want %s", i+1, leak.Time, want[i].Time)
+		}
+		leak.Time = want[i].Time
+		if !reflect.DeepEqual(leak, want[i]) {
+			t.Errorf("leak %d: %+v, want %+v", i+1, leak, want[i])
+		}
+	}
+}
+
+func TestDecodeLeakRejects(t *testing.T) {
+	if _, err := decodeLeak(capture.Packet{LinkType: capture.LinkEthernet}); err == nil {
+		t.Error("decoded a leak from an Ethernet packet")
+	}
+	if _, err := decodeLeak(capture.Packet{LinkType: capture.LinkPflog, Data: make([]byte, 64)}); err == nil {
+		t.Error("decoded a leak from a pflog header without a packet")
+	}
+
+	_, err := readLeakCapture(captureFixture("synthetic-lo0.pcapng"))
+	if err == nil || !strings.Contains(err.Error(), "is not pflog") {
+		t.Errorf("reading a loopback capture: %v", err)
+	}
+}
@@ -4,41 +4,50 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"runtime"
 	"strings"
+
+	"github.com/spf13/cobra"
 )
 
 const (
-	defaultDNS      = "8.8.8.8"
-	defaultDNS2     = "8.8.4.4"
-	lightConfigPath = "/etc/saferay/light.conf"
+	defaultDNS  = "8.8.8.8"
+	defaultDNS2 = "8.8.4.4"
 )
 
-func cmdLight(action string) {
-	switch action {
-	case "setup":
-		setupLightMode()
-	case "reset":
-		resetLightMode()
-	case "status":
-		statusLightMode()
-	default:
-		fmt.Printf("Unknown light action: %s\n", action)
-		fmt.Println("Usage: saferay light [setup|reset|status]")
-		os.Exit(1)
-	}
+// lightConfigPath saves the DNS light mode replaced; a variable so tests
+// can keep it elsewhere
+var lightConfigPath = "/etc/saferay/light.conf"
+
+func newLightCmd() *cobra.Command {
+	cmd := groupCmd("light", "Light mode: Google DNS + DNS flush, no VPN required")
+	onPlatforms(cmd, "darwin", "linux")
+	cmd.AddCommand(
+		actionCmd("setup", "Setup light mode: DNS flush on reboot + set DNS 8.8.8.8", setupLightMode),
+		actionCmd("reset", "Remove light mode settings", resetLightMode),
+		actionCmd("status", "Show light mode status", statusLightMode),
+	)
+	return cmd
 }
 
 func setupLightMode() {
 	fmt.Println("Setting up light mode...")
 
-	// 1. Setup DNS flush daemon
-	setupDNSDaemon()
+	// 1. Setup DNS flush daemon. systemd-resolved's cache doesn't survive
+	// a reboot, so Linux doesn't need one.
+	if runtime.GOOS == "darwin" {
+		setupDNSDaemon()
+	}
 
 	// 2. Get active network service
 	service := getActiveNetworkService()
 	if service == "" {
 		fmt.Println("Warning: Could not detect active network service")
-		fmt.Println("Please set DNS manually: networksetup -setdnsservers \"Wi-Fi\" 8.8.8.8 8.8.4.4")
+		if runtime.GOOS == "linux" {
+			fmt.Println("Please set DNS manually: resolvectl dns <link> 8.8.8.8 8.8.4.4")
+		} else {
+			fmt.Println("Please set DNS manually: networksetup -setdnsservers \"Wi-Fi\" 8.8.8.8 8.8.4.4")
+		}
 		return
 	}
 
@@ -50,6 +59,10 @@ func setupLightMode() {
 
 	fmt.Println()
 	fmt.Println("✓ Light mode enabled:")
+	if runtime.GOOS == "linux" {
+		fmt.Printf("  - DNS set to %s, %s over TLS on %s\n", defaultDNS, defaultDNS2, service)
+		return
+	}
 	fmt.Println("  - DNS cache will flush on every reboot")
 	fmt.Printf("  - DNS set to %s, %s on %s\n", defaultDNS, defaultDNS2, service)
 }
@@ -58,42 +71,117 @@ func resetLightMode() {
 	fmt.Println("Resetting light mode...")
 
 	// 1. Remove DNS flush daemon
-	removeDNSDaemon()
+	if runtime.GOOS == "darwin" {
+		removeDNSDaemon()
+	}
 
-	// 2. Reset DNS to automatic
-	service := getActiveNetworkService()
+	// 2. Reset DNS on the service light mode took over, which may not be
+	// the active one any more
+	service := lightService()
+	if service == "" {
+		service = getActiveNetworkService()
+	}
 	if service != "" {
 		resetDNS(service)
 	}
 
-	// 3. Remove config
-	_ = exec.Command("sudo", "rm", "-rf", "/etc/saferay").Run()
+	// 3. Remove light config (keep profiles in saferay.conf)
+	_ = sys.removeFile(lightConfigPath)
 
 	fmt.Println("✓ Light mode disabled")
 }
 
-func statusLightMode() {
-	fmt.Println("=== Light Mode Status ===")
-	fmt.Println()
+// lightStatus is the state of light mode
+type lightStatus struct {
+	report
+	Configured   bool          `json:"configured"`
+	FlushDaemon  serviceStatus `json:"flush_daemon"`
+	Service      string        `json:"service"`
+	DNSServers   []string      `json:"dns_servers"`
+	AutomaticDNS bool          `json:"automatic_dns"`
+	// DNSOverTLS is the systemd-resolved mode of the link, Linux only
+	DNSOverTLS string `json:"dns_over_tls,omitempty"`
+}
 
-	// Check DNS flush daemon
-	statusDNSDaemon()
+func statusLightMode() {
+	st := lightStatus{
+		report:      newReport("light status"),
+		FlushDaemon: getDNSDaemonStatus(),
+		DNSServers:  []string{},
+	}
+	_, err := os.Stat(lightConfigPath)
+	st.Configured = err == nil
 
 	// Check current DNS
-	service := getActiveNetworkService()
-	if service != "" {
-		fmt.Printf("\nNetwork service: %s\n", service)
-		out, _ := exec.Command("networksetup", "-getdnsservers", service).CombinedOutput()
-		outStr := strings.TrimSpace(string(out))
-		if strings.Contains(outStr, "There aren't any DNS Servers") {
-			fmt.Println("DNS servers:     automatic (DHCP)")
-		} else {
-			fmt.Printf("DNS servers:     %s\n", strings.ReplaceAll(outStr, "\n", ", "))
+	st.Service = getActiveNetworkService()
+	if st.Service != "" {
+		st.DNSServers = getDNSServers(st.Service)
+		st.AutomaticDNS = len(st.DNSServers) == 0
+		if runtime.GOOS == "linux" {
+			st.DNSOverTLS = resolvedDNSOverTLS(st.Service)
+		}
+	}
+
+	if st.Configured {
+		if runtime.GOOS == "darwin" && !st.FlushDaemon.Loaded {
+			st.notActive("DNS flush daemon is not loaded")
+		}
+		if runtime.GOOS == "linux" && st.DNSOverTLS != "yes" {
+			st.notActive("DNS-over-TLS is not enabled on %s", st.Service)
+		}
+		if st.Service != "" && (len(st.DNSServers) == 0 || st.DNSServers[0] != defaultDNS) {
+			st.notActive("DNS on %s is not set to %s", st.Service, defaultDNS)
+		}
+	}
+
+	finish(&st.report, st, func() {
+		fmt.Println("=== Light Mode Status ===")
+		fmt.Println()
+
+		if runtime.GOOS == "darwin" {
+			printDNSDaemonStatus(st.FlushDaemon)
+			fmt.Println()
 		}
+		fmt.Println("Light mode:      " + mark(st.Configured, "Configured", "Not configured"))
+
+		if st.Service != "" {
+			if runtime.GOOS == "linux" {
+				fmt.Printf("Network link:    %s\n", st.Service)
+			} else {
+				fmt.Printf("Network service: %s\n", st.Service)
+			}
+			if st.AutomaticDNS {
+				fmt.Println("DNS servers:     automatic (DHCP)")
+			} else {
+				fmt.Printf("DNS servers:     %s\n", strings.Join(st.DNSServers, ", "))
+			}
+			if st.DNSOverTLS != "" {
+				fmt.Printf("DNS-over-TLS:    %s\n", st.DNSOverTLS)
+			}
+		}
+	})
+}
+
+// getDNSServers returns the manually configured DNS servers of a service,
+// or nothing when it uses automatic (DHCP) DNS
+func getDNSServers(service string) []string {
+	if runtime.GOOS == "linux" {
+		return resolvedServers(service)
 	}
+
+	out, _ := exec.Command("networksetup", "-getdnsservers", service).CombinedOutput()
+	outStr := strings.TrimSpace(string(out))
+	if strings.Contains(outStr, "There aren't any DNS Servers") {
+		return []string{}
+	}
+	return strings.Fields(outStr)
 }
 
 func getActiveNetworkService() string {
+	if runtime.GOOS == "linux" {
+		return resolvedLink()
+	}
+
 	// Try to find active network service
 	// Priority: Wi-Fi > Ethernet > any other
 
@@ -147,9 +235,23 @@ func getActiveNetworkService() string {
 	return ""
 }
 
+// lightService returns the service light mode took over, as saved in
+// light.conf, or "" if light mode isn't set up
+func lightService() string {
+	content, _ := os.ReadFile(lightConfigPath)
+	for _, line := range strings.Split(string(content), "\n") {
+		if service, ok := strings.CutPrefix(line, "service="); ok {
+			return service
+		}
+	}
+	return ""
+}
+
 func saveOriginalDNS(service string) {
-	// Create config directory
-	_ = exec.Command("sudo", "mkdir", "-p", "/etc/saferay").Run()
+	if runtime.GOOS == "linux" {
+		saveResolvedLink(service)
+		return
+	}
 
 	// Get current DNS
 	out, _ := exec.Command("networksetup", "-getdnsservers", service).CombinedOutput()
@@ -163,20 +265,17 @@ func saveOriginalDNS(service string) {
 		content = fmt.Sprintf("service=%s\ndns=%s\n", service, dns)
 	}
 
-	// Write to temp and move
-	tmpFile := "/tmp/saferay_light.conf"
-	_ = os.WriteFile(tmpFile, []byte(content), 0644)
-	_ = exec.Command("sudo", "mv", tmpFile, lightConfigPath).Run()
+	_ = sys.writeFile(lightConfigPath, []byte(content), 0644)
 }
 
 func setDNS(service string, dns ...string) {
-	args := append([]string{"networksetup", "-setdnsservers", service}, dns...)
-	cmd := exec.Command("sudo", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
+	if runtime.GOOS == "linux" {
+		setResolvedDNS(service, dns...)
+		return
+	}
 
-	if err := cmd.Run(); err != nil {
+	args := append([]string{"sudo", "networksetup", "-setdnsservers", service}, dns...)
+	if err := sys.run(args...); err != nil {
 		fmt.Printf("Error setting DNS: %v\n", err)
 		return
 	}
@@ -185,6 +284,11 @@ func setDNS(service string, dns ...string) {
 }
 
 func resetDNS(service string) {
+	if runtime.GOOS == "linux" {
+		resetResolvedDNS(service)
+		return
+	}
+
 	// Try to read original config
 	content, err := os.ReadFile(lightConfigPath)
 	if err == nil {
@@ -194,18 +298,14 @@ func resetDNS(service string) {
 				dns := strings.TrimPrefix(line, "dns=")
 				if dns == "auto" {
 					// Set to empty (automatic)
-					cmd := exec.Command("sudo", "networksetup", "-setdnsservers", service, "Empty")
-					cmd.Stdin = os.Stdin
-					_ = cmd.Run()
+					_ = sys.quiet("sudo", "networksetup", "-setdnsservers", service, "Empty")
 					fmt.Printf("✓ DNS reset to automatic on %s\n", service)
 					return
 				}
 				// Restore original DNS
 				dnsServers := strings.Fields(dns)
-				args := append([]string{"networksetup", "-setdnsservers", service}, dnsServers...)
-				cmd := exec.Command("sudo", args...)
-				cmd.Stdin = os.Stdin
-				_ = cmd.Run()
+				args := append([]string{"sudo", "networksetup", "-setdnsservers", service}, dnsServers...)
+				_ = sys.quiet(args...)
 				fmt.Printf("✓ DNS restored to %s on %s\n", dns, service)
 				return
 			}
@@ -213,9 +313,7 @@ func resetDNS(service string) {
 	}
 
 	// Fallback: set to empty (automatic)
-	cmd := exec.Command("sudo", "networksetup", "-setdnsservers", service, "Empty")
-	cmd.Stdin = os.Stdin
-	_ = cmd.Run()
+	_ = sys.quiet("sudo", "networksetup", "-setdnsservers", service, "Empty")
 	fmt.Printf("✓ DNS reset to automatic on %s\n", service)
 }
 
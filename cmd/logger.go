@@ -0,0 +1,252 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The auto daemon logs one logfmt line per event:
+//
+//	time=2026-01-02T15:04:05Z level=info event=vpn_up msg="VPN connected"
+//
+// It writes the file itself so it can rotate it; stdout and stderr only
+// catch panics and stray output.
+
+// Log levels
+const (
+	levelInfo  = "info"
+	levelWarn  = "warn"
+	levelError = "error"
+)
+
+// Rotation limits for the daemon log
+const (
+	logMaxSize = 5 << 20
+	logMaxAge  = 24 * time.Hour
+	// logKeep is how many rotated files (.1 to .7) are kept
+	logKeep = 7
+)
+
+// eventLogger writes structured log lines to out and, if set, to the
+// system log
+type eventLogger struct {
+	mu     sync.Mutex
+	out    io.Writer
+	system logSink
+}
+
+// daemonLog is the watch daemon's log; it goes to stdout until the daemon
+// opens its log file
+var daemonLog = &eventLogger{out: os.Stdout}
+
+// log writes an event with a message and key/value pairs
+func (l *eventLogger) log(level, event, msg string, kv ...any) {
+	entry := logEntry{Time: time.Now().UTC(), Level: level, Event: event, Msg: msg}
+	for i := 0; i+1 < len(kv); i += 2 {
+		if entry.Fields == nil {
+			entry.Fields = map[string]string{}
+		}
+		entry.Fields[fmt.Sprint(kv[i])] = fmt.Sprint(kv[i+1])
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out != nil {
+		_, _ = io.WriteString(l.out, entry.logfmt()+"\n")
+	}
+	if l.system != nil {
+		_ = l.system.write(entry)
+	}
+}
+
+func (l *eventLogger) info(event, msg string, kv ...any) {
+	l.log(levelInfo, event, msg, kv...)
+}
+
+func (l *eventLogger) warn(event, msg string, kv ...any) {
+	l.log(levelWarn, event, msg, kv...)
+}
+
+// logfmtValue quotes a value if it's empty or has spaces, quotes or '='
+func logfmtValue(v string) string {
+	if v == "" || strings.ContainsAny(v, " \t\"=\n") {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// logEntry is a parsed log line
+type logEntry struct {
+	Time   time.Time         `json:"time"`
+	Level  string            `json:"level"`
+	Event  string            `json:"event"`
+	Msg    string            `json:"msg"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// parseLogLine reads a logfmt line. Lines from before structured logging
+// (or stray output) come back with only Msg set.
+func parseLogLine(line string) logEntry {
+	entry := logEntry{}
+	fields := map[string]string{}
+
+	rest := strings.TrimSpace(line)
+	for rest != "" {
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok || strings.ContainsAny(key, " \t\"") {
+			return logEntry{Msg: strings.TrimSpace(line)}
+		}
+
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return logEntry{Msg: strings.TrimSpace(line)}
+			}
+			rest = strings.TrimSpace(value[len(quoted):])
+			value, _ = strconv.Unquote(quoted)
+		} else {
+			value, rest, _ = strings.Cut(value, " ")
+			rest = strings.TrimSpace(rest)
+		}
+		fields[key] = value
+	}
+
+	entry.Time, _ = time.Parse(time.RFC3339, fields["time"])
+	entry.Level, entry.Event, entry.Msg = fields["level"], fields["event"], fields["msg"]
+	for _, key := range []string{"time", "level", "event", "msg"} {
+		delete(fields, key)
+	}
+	if len(fields) > 0 {
+		entry.Fields = fields
+	}
+	if entry.Time.IsZero() && entry.Level == "" {
+		return logEntry{Msg: strings.TrimSpace(line)}
+	}
+	return entry
+}
+
+// logfmt renders an entry as a log file line, fields sorted by key
+func (e logEntry) logfmt() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "time=%s level=%s event=%s msg=%s",
+		e.Time.UTC().Format(time.RFC3339), e.Level, e.Event, logfmtValue(e.Msg))
+	for _, k := range e.fieldKeys() {
+		fmt.Fprintf(&b, " %s=%s", k, logfmtValue(e.Fields[k]))
+	}
+	return b.String()
+}
+
+// fieldKeys returns the field names in sorted order
+func (e logEntry) fieldKeys() []string {
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// format renders an entry for the terminal
+func (e logEntry) format() string {
+	if e.Time.IsZero() {
+		return e.Msg
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s  %-5s  %s", e.Time.Local().Format("2006-01-02 15:04:05"), strings.ToUpper(e.Level), e.Msg)
+
+	for _, k := range e.fieldKeys() {
+		fmt.Fprintf(&b, "  %s=%s", k, logfmtValue(e.Fields[k]))
+	}
+	return b.String()
+}
+
+// rotatingFile is an append-only log file that rotates itself when it
+// grows past logMaxSize or its first entry is older than logMaxAge
+type rotatingFile struct {
+	path    string
+	f       *os.File
+	size    int64
+	started time.Time
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size, r.started = f, info.Size(), time.Now()
+	// An existing file is as old as its first entry
+	if first := firstLogTime(r.path); !first.IsZero() {
+		r.started = first
+	}
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	if r.size > 0 && (r.size+int64(len(p)) > logMaxSize || time.Since(r.started) > logMaxAge) {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// rotate shifts path.N to path.N+1, dropping the oldest, and starts a new file
+func (r *rotatingFile) rotate() error {
+	r.f.Close()
+
+	_ = os.Remove(fmt.Sprintf("%s.%d", r.path, logKeep))
+	for i := logKeep - 1; i >= 1; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", r.path, i), fmt.Sprintf("%s.%d", r.path, i+1))
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	return r.f.Close()
+}
+
+// firstLogTime returns the time of the first entry in a log file
+func firstLogTime(path string) time.Time {
+	f, err := os.Open(path)
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if entry := parseLogLine(scanner.Text()); !entry.Time.IsZero() {
+			return entry.Time
+		}
+	}
+	return time.Time{}
+}
@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+func newLogsCmd() *cobra.Command {
+	var follow bool
+	var since string
+
+	cmd := &cobra.Command{
+		Use:   "logs",
+		Short: "Show the auto daemon log",
+		Long: `Show the auto daemon log, including rotated files, oldest first.
+
+--since takes a duration (30m, 2h, 7d), a date (2006-01-02) or an
+RFC 3339 time. With the global --json flag each entry is printed as a
+JSON object per line.`,
+		Example: "  saferay logs --since 1h\n  saferay logs -f",
+		Args:    cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var from time.Time
+			if since != "" {
+				var err error
+				if from, err = parseSince(since, time.Now()); err != nil {
+					return err
+				}
+			}
+			showLogs(from, follow)
+			return nil
+		},
+	}
+	cmd.Flags().BoolVarP(&follow, "follow", "f", false, "keep printing new entries")
+	cmd.Flags().StringVar(&since, "since", "", "only entries newer than this")
+
+	return onPlatforms(cmd, "darwin", "linux")
+}
+
+// parseSince reads a --since value relative to now
+func parseSince(value string, now time.Time) (time.Time, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		if n, err := strconv.Atoi(days); err == nil {
+			return now.AddDate(0, 0, -n), nil
+		}
+	}
+	if d, err := time.ParseDuration(value); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", value, time.Local); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("invalid --since %q: want a duration (2h, 7d), date or RFC 3339 time", value)
+}
+
+func showLogs(since time.Time, follow bool) {
+	// With log_sink=system the file only has entries from before the switch
+	systemOnly := loadConfig().LogSink == sinkSystem
+	if systemOnly && !jsonOutput {
+		fmt.Printf("The daemon logs to the system log (log_sink=system); read it with:\n  %s\n\n", systemLogHint())
+	}
+
+	found := false
+	for _, path := range logFiles(xrayLogPath) {
+		f, err := os.Open(path)
+		if err != nil {
+			continue
+		}
+		found = true
+		printLogEntries(f, since)
+		f.Close()
+	}
+
+	if systemOnly && !follow {
+		return
+	}
+	if !found && !follow {
+		fmt.Printf("No log at %s (is auto mode running?)\n", xrayLogPath)
+		os.Exit(1)
+	}
+	if follow {
+		followLog(xrayLogPath, found)
+	}
+}
+
+// logFiles returns a log's rotated files and then the log itself, oldest
+// to newest
+func logFiles(path string) []string {
+	var paths []string
+	for i := logKeep; i >= 1; i-- {
+		paths = append(paths, fmt.Sprintf("%s.%d", path, i))
+	}
+	return append(paths, path)
+}
+
+// printLogEntries prints the entries of r that are newer than since
+func printLogEntries(r io.Reader, since time.Time) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		entry := parseLogLine(scanner.Text())
+		if !since.IsZero() && entry.Time.Before(since) {
+			continue
+		}
+		printLogEntry(entry)
+	}
+}
+
+func printLogEntry(entry logEntry) {
+	if !jsonOutput {
+		fmt.Println(entry.format())
+		return
+	}
+	data, _ := json.Marshal(entry)
+	fmt.Println(string(data))
+}
+
+// followLog prints lines appended to path, reopening it after rotation.
+// With skipExisting the lines already in the file are not printed again.
+func followLog(path string, skipExisting bool) {
+	var f *os.File
+	var info os.FileInfo
+	var pending string
+
+	for ; ; time.Sleep(500 * time.Millisecond) {
+		current, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+
+		// Rotated or truncated: start over on the new file
+		if f != nil && (!os.SameFile(info, current) || current.Size() < offset(f)) {
+			f.Close()
+			f = nil
+		}
+		if f == nil {
+			if f, err = os.Open(path); err != nil {
+				continue
+			}
+			info = current
+			// The first open continues after what showLogs printed
+			if skipExisting {
+				_, _ = f.Seek(current.Size(), io.SeekStart)
+				skipExisting = false
+			}
+		}
+
+		data, _ := io.ReadAll(f)
+		pending += string(data)
+		for {
+			line, rest, ok := strings.Cut(pending, "\n")
+			if !ok {
+				break
+			}
+			pending = rest
+			if strings.TrimSpace(line) != "" {
+				printLogEntry(parseLogLine(line))
+			}
+		}
+	}
+}
+
+// offset returns the read position of f
+func offset(f *os.File) int64 {
+	pos, _ := f.Seek(0, io.SeekCurrent)
+	return pos
+}
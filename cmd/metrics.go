@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The watch daemon can serve its state in the OpenMetrics text format for
+// a local Prometheus or agent to scrape. It's off unless metrics_addr is
+// set, and only ever listens on loopback.
+
+const metricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// defaultMetricsHost is used when metrics_addr is only a port
+const defaultMetricsHost = "127.0.0.1"
+
+// daemonMetrics is the watch loop's state as exported on /metrics. The
+// loop updates it and scrapes read it from the server's goroutines.
+type daemonMetrics struct {
+	mu           sync.Mutex
+	started      time.Time
+	mode         string
+	vpnConnected bool
+	protected    bool
+	// transitions counts state changes by log event, e.g. vpn_up
+	transitions    map[string]uint64
+	firewallErrors uint64
+	// probe is how long the last VPN check took
+	probe time.Duration
+}
+
+func newDaemonMetrics() *daemonMetrics {
+	return &daemonMetrics{started: time.Now(), transitions: map[string]uint64{}}
+}
+
+// update records the state after a watch loop tick
+func (m *daemonMetrics) update(w *watcher, probe time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mode, m.vpnConnected, m.protected, m.probe = w.mode, w.vpnConnected, w.pfEnabled, probe
+}
+
+// transition counts a state change by its log event
+func (m *daemonMetrics) transition(event string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.transitions[event]++
+}
+
+func (m *daemonMetrics) firewallError() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.firewallErrors++
+}
+
+// metricsListenAddr resolves a metrics_addr value, which may be just a
+// port, and rejects anything that isn't loopback
+func metricsListenAddr(value string) (string, error) {
+	if !strings.Contains(value, ":") {
+		value = ":" + value
+	}
+	host, port, err := net.SplitHostPort(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid metrics_addr %q: %w", value, err)
+	}
+	if host == "" {
+		host = defaultMetricsHost
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("metrics_addr %q is not a loopback address", value)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// serveMetrics starts the /metrics endpoint in the background
+func serveMetrics(addr string, m *daemonMetrics, fw firewall) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", metricsContentType)
+		m.write(w, fw.name(), fw.counters())
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 5 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil {
+			daemonLog.warn("metrics_error", "Metrics server stopped", "error", err)
+		}
+	}()
+	return nil
+}
+
+// write renders the metrics in the OpenMetrics text format
+func (m *daemonMetrics) write(w io.Writer, backend string, counters firewallCounters) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	family := func(name, kind, help string) {
+		fmt.Fprintf(w, "# TYPE %s %s\n# HELP %s %s\n", name, kind, name, help)
+	}
+
+	family("saferay_build", "info", "saferay version.")
+	fmt.Fprintf(w, "saferay_build_info{version=\"%s\"} 1\n", metricsLabel(version))
+
+	family("saferay_daemon_start_time_seconds", "gauge", "When the watch daemon started.")
+	fmt.Fprintf(w, "saferay_daemon_start_time_seconds %d\n", m.started.Unix())
+
+	family("saferay_mode", "stateset", "Current protection mode.")
+	for _, mode := range profileModes {
+		fmt.Fprintf(w, "saferay_mode{saferay_mode=\"%s\"} %d\n", mode, metricsBool(mode == m.mode))
+	}
+
+	family("saferay_vpn_connected", "gauge", "Whether the VPN tunnel is up.")
+	fmt.Fprintf(w, "saferay_vpn_connected %d\n", metricsBool(m.vpnConnected))
+
+	family("saferay_firewall_enabled", "gauge", "Whether the DNS block rules are enforced.")
+	fmt.Fprintf(w, "saferay_firewall_enabled{backend=\"%s\"} %d\n", metricsLabel(backend), metricsBool(m.protected))
+
+	family("saferay_firewall_rules", "gauge", "Rules loaded in the saferay anchor, table or chain.")
+	fmt.Fprintf(w, "saferay_firewall_rules{backend=\"%s\"} %d\n", metricsLabel(backend), counters.Rules)
+
+	family("saferay_dns_blocked_packets", "counter", "DNS packets dropped by the block rule since the rules were loaded.")
+	fmt.Fprintf(w, "saferay_dns_blocked_packets_total{backend=\"%s\"} %d\n", metricsLabel(backend), counters.BlockedPackets)
+
+	family("saferay_dns_blocked_bytes", "counter", "DNS bytes dropped by the block rule since the rules were loaded.")
+	fmt.Fprintf(w, "saferay_dns_blocked_bytes_total{backend=\"%s\"} %d\n", metricsLabel(backend), counters.BlockedBytes)
+
+	family("saferay_transitions", "counter", "State changes by event.")
+	events := make([]string, 0, len(m.transitions))
+	for event := range m.transitions {
+		events = append(events, event)
+	}
+	sort.Strings(events)
+	for _, event := range events {
+		fmt.Fprintf(w, "saferay_transitions_total{event=\"%s\"} %d\n", metricsLabel(event), m.transitions[event])
+	}
+
+	family("saferay_firewall_errors", "counter", "Failed attempts to enable or disable the firewall.")
+	fmt.Fprintf(w, "saferay_firewall_errors_total %d\n", m.firewallErrors)
+
+	family("saferay_probe_duration_seconds", "gauge", "How long the last VPN check took.")
+	fmt.Fprintf(w, "saferay_probe_duration_seconds %g\n", m.probe.Seconds())
+
+	fmt.Fprintln(w, "# EOF")
+}
+
+// metricsLabel escapes a label value
+func metricsLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func metricsBool(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,60 @@
+//go:build darwin && cgo
+
+package cmd
+
+/*
+#include <os/log.h>
+#include <stdlib.h>
+
+// os_log_with_type is a macro that needs a literal format string
+static void saferay_os_log(os_log_t log, os_log_type_t type, const char *msg) {
+	os_log_with_type(log, type, "%{public}s", msg);
+}
+*/
+import "C"
+
+import (
+	"strings"
+	"unsafe"
+)
+
+// osLogSink writes entries to the unified log under the com.saferay
+// subsystem, with the event as the category
+type osLogSink struct {
+	logs map[string]C.os_log_t
+}
+
+func newOSLogSink() (logSink, error) {
+	return &osLogSink{logs: map[string]C.os_log_t{}}, nil
+}
+
+func (s *osLogSink) write(e logEntry) error {
+	log, ok := s.logs[e.Event]
+	if !ok {
+		subsystem := C.CString(logSubsystem)
+		category := C.CString(e.Event)
+		defer C.free(unsafe.Pointer(subsystem))
+		defer C.free(unsafe.Pointer(category))
+
+		// os_log objects are never freed; there is one per event name
+		log = C.os_log_create(subsystem, category)
+		s.logs[e.Event] = log
+	}
+
+	// Default messages are persisted, unlike info, so events survive for
+	// log show; warnings have no type of their own
+	logType := C.os_log_type_t(C.OS_LOG_TYPE_DEFAULT)
+	if e.Level == levelError {
+		logType = C.os_log_type_t(C.OS_LOG_TYPE_ERROR)
+	}
+
+	// The unified log has its own timestamp; the rest of the line keeps
+	// the fields visible in Console
+	_, line, _ := strings.Cut(e.logfmt(), " ")
+	msg := C.CString(line)
+	defer C.free(unsafe.Pointer(msg))
+	C.saferay_os_log(log, logType, msg)
+	return nil
+}
+
+func (s *osLogSink) close() error { return nil }
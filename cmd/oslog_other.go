@@ -0,0 +1,10 @@
+//go:build !(darwin && cgo)
+
+package cmd
+
+import "errors"
+
+// newOSLogSink needs cgo on macOS; without it syslog is used instead
+func newOSLogSink() (logSink, error) {
+	return nil, errors.New("os_log needs a cgo build on macOS")
+}
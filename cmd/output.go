@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// jsonSchemaVersion is bumped whenever a field in the JSON output is
+// renamed or removed. Adding fields doesn't change it.
+const jsonSchemaVersion = 1
+
+// Exit codes for status and check commands
+const (
+	exitOK = 0
+	// exitFailure is a failed command or a failed required check
+	exitFailure = 1
+	// exitNotActive means protection is configured but not in effect
+	exitNotActive = 2
+)
+
+// jsonOutput is set by the global --json flag
+var jsonOutput bool
+
+// report is the common header of every status/check result
+type report struct {
+	SchemaVersion int      `json:"schema_version"`
+	Command       string   `json:"command"`
+	OK            bool     `json:"ok"`
+	Problems      []string `json:"problems"`
+
+	exitCode int
+}
+
+func newReport(command string) report {
+	return report{
+		SchemaVersion: jsonSchemaVersion,
+		Command:       command,
+		OK:            true,
+		Problems:      []string{},
+	}
+}
+
+// notActive records that configured protection isn't in effect
+func (r *report) notActive(format string, args ...any) {
+	r.fail(exitNotActive, format, args...)
+}
+
+// fail records a problem; the first problem decides the exit code
+func (r *report) fail(code int, format string, args ...any) {
+	r.OK = false
+	r.Problems = append(r.Problems, fmt.Sprintf(format, args...))
+	if r.exitCode == exitOK {
+		r.exitCode = code
+	}
+}
+
+// finish prints result as JSON when --json is set, otherwise calls
+// printText, then exits with the report's exit code
+func finish(r *report, result any, printText func()) {
+	if jsonOutput {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(result)
+	} else {
+		printText()
+	}
+
+	if r.exitCode != exitOK {
+		os.Exit(r.exitCode)
+	}
+}
+
+// mark renders a boolean as the checkmarks used in text output
+func mark(ok bool, yes, no string) string {
+	if ok {
+		return "✓ " + yes
+	}
+	return "✗ " + no
+}
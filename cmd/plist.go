@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A small XML property list encoder and decoder, enough for launchd.plist(5).
+// Values are string, bool, int, []string, map[string]string and plistDict,
+// which keeps keys in the order they were added.
+
+const plistHeader = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+`
+
+// plistDict is a dictionary with ordered keys
+type plistDict []plistEntry
+
+type plistEntry struct {
+	Key   string
+	Value any
+}
+
+// encodePlist renders a value as an XML plist, indented like Apple's tools
+func encodePlist(v any) (string, error) {
+	var b strings.Builder
+	b.WriteString(plistHeader)
+	if err := encodePlistValue(&b, v, ""); err != nil {
+		return "", err
+	}
+	b.WriteString("</plist>")
+	return b.String(), nil
+}
+
+func encodePlistValue(b *strings.Builder, v any, indent string) error {
+	switch v := v.(type) {
+	case string:
+		fmt.Fprintf(b, "%s<string>%s</string>\n", indent, html.EscapeString(v))
+	case bool:
+		fmt.Fprintf(b, "%s<%t/>\n", indent, v)
+	case int:
+		fmt.Fprintf(b, "%s<integer>%d</integer>\n", indent, v)
+	case []string:
+		fmt.Fprintf(b, "%s<array>\n", indent)
+		for _, s := range v {
+			fmt.Fprintf(b, "%s    <string>%s</string>\n", indent, html.EscapeString(s))
+		}
+		fmt.Fprintf(b, "%s</array>\n", indent)
+	case map[string]string:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		dict := plistDict{}
+		for _, k := range keys {
+			dict = append(dict, plistEntry{k, v[k]})
+		}
+		return encodePlistValue(b, dict, indent)
+	case plistDict:
+		fmt.Fprintf(b, "%s<dict>\n", indent)
+		for _, e := range v {
+			// The top-level dict isn't indented, its contents are
+			inner := indent + "    "
+			fmt.Fprintf(b, "%s<key>%s</key>\n", inner, html.EscapeString(e.Key))
+			if err := encodePlistValue(b, e.Value, inner); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(b, "%s</dict>\n", indent)
+	default:
+		return fmt.Errorf("plist: unsupported type %T", v)
+	}
+	return nil
+}
+
+// decodePlist parses an XML plist into map[string]any, []any, string,
+// bool, int64 and float64 values. Other elements decode as their text.
+func decodePlist(data []byte) (any, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	// launchd plists sometimes carry a DOCTYPE the decoder can't resolve
+	d.Strict = false
+
+	for {
+		tok, err := d.Token()
+		if err == io.EOF {
+			return nil, fmt.Errorf("plist: no value")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("plist: %w", err)
+		}
+		if start, ok := tok.(xml.StartElement); ok && start.Name.Local != "plist" {
+			return decodePlistValue(d, start)
+		}
+	}
+}
+
+func decodePlistValue(d *xml.Decoder, start xml.StartElement) (any, error) {
+	switch start.Name.Local {
+	case "dict":
+		dict := map[string]any{}
+		key := ""
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, fmt.Errorf("plist: %w", err)
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				if tok.Name.Local == "key" {
+					if err := d.DecodeElement(&key, &tok); err != nil {
+						return nil, err
+					}
+					continue
+				}
+				value, err := decodePlistValue(d, tok)
+				if err != nil {
+					return nil, err
+				}
+				dict[key] = value
+			case xml.EndElement:
+				return dict, nil
+			}
+		}
+	case "array":
+		array := []any{}
+		for {
+			tok, err := d.Token()
+			if err != nil {
+				return nil, fmt.Errorf("plist: %w", err)
+			}
+			switch tok := tok.(type) {
+			case xml.StartElement:
+				value, err := decodePlistValue(d, tok)
+				if err != nil {
+					return nil, err
+				}
+				array = append(array, value)
+			case xml.EndElement:
+				return array, nil
+			}
+		}
+	case "true", "false":
+		if err := d.Skip(); err != nil {
+			return nil, err
+		}
+		return start.Name.Local == "true", nil
+	}
+
+	var text string
+	if err := d.DecodeElement(&text, &start); err != nil {
+		return nil, err
+	}
+	text = strings.TrimSpace(text)
+
+	switch start.Name.Local {
+	case "integer":
+		return strconv.ParseInt(text, 10, 64)
+	case "real":
+		return strconv.ParseFloat(text, 64)
+	}
+	return text, nil
+}
+
+// launchdPlist is the part of launchd.plist(5) saferay's daemons use
+type launchdPlist struct {
+	Label            string
+	ProgramArguments []string
+	Environment      map[string]string
+	RunAtLoad        bool
+	KeepAlive        bool
+	// ThrottleInterval is the minimum seconds between restarts
+	ThrottleInterval  int
+	StandardOutPath   string
+	StandardErrorPath string
+}
+
+// encode renders the plist, leaving out empty optional keys
+func (p launchdPlist) encode() string {
+	dict := plistDict{
+		{"Label", p.Label},
+		{"ProgramArguments", p.ProgramArguments},
+	}
+	if len(p.Environment) > 0 {
+		dict = append(dict, plistEntry{"EnvironmentVariables", p.Environment})
+	}
+	dict = append(dict, plistEntry{"RunAtLoad", p.RunAtLoad})
+	if p.KeepAlive {
+		dict = append(dict, plistEntry{"KeepAlive", true})
+	}
+	if p.ThrottleInterval > 0 {
+		dict = append(dict, plistEntry{"ThrottleInterval", p.ThrottleInterval})
+	}
+	if p.StandardOutPath != "" {
+		dict = append(dict, plistEntry{"StandardOutPath", p.StandardOutPath})
+	}
+	if p.StandardErrorPath != "" {
+		dict = append(dict, plistEntry{"StandardErrorPath", p.StandardErrorPath})
+	}
+
+	// Every value above is a supported type
+	out, _ := encodePlist(dict)
+	return out
+}
+
+// parseLaunchdPlist reads back an installed plist. Keys saferay doesn't
+// use are ignored.
+func parseLaunchdPlist(data []byte) (launchdPlist, error) {
+	var p launchdPlist
+
+	v, err := decodePlist(data)
+	if err != nil {
+		return p, err
+	}
+	dict, ok := v.(map[string]any)
+	if !ok {
+		return p, fmt.Errorf("plist: top level is not a dict")
+	}
+
+	p.Label, _ = dict["Label"].(string)
+	p.RunAtLoad, _ = dict["RunAtLoad"].(bool)
+	// KeepAlive may also be a dict of conditions, which still restarts
+	_, conditional := dict["KeepAlive"].(map[string]any)
+	keepAlive, _ := dict["KeepAlive"].(bool)
+	p.KeepAlive = keepAlive || conditional
+	if throttle, ok := dict["ThrottleInterval"].(int64); ok {
+		p.ThrottleInterval = int(throttle)
+	}
+	p.StandardOutPath, _ = dict["StandardOutPath"].(string)
+	p.StandardErrorPath, _ = dict["StandardErrorPath"].(string)
+
+	if args, ok := dict["ProgramArguments"].([]any); ok {
+		for _, arg := range args {
+			s, _ := arg.(string)
+			p.ProgramArguments = append(p.ProgramArguments, s)
+		}
+	} else if program, ok := dict["Program"].(string); ok {
+		p.ProgramArguments = []string{program}
+	}
+
+	if env, ok := dict["EnvironmentVariables"].(map[string]any); ok {
+		p.Environment = map[string]string{}
+		for k, v := range env {
+			p.Environment[k], _ = v.(string)
+		}
+	}
+
+	return p, nil
+}
+
+// diff lists how an installed plist differs from the wanted one
+func (p launchdPlist) diff(want launchdPlist) []string {
+	var changes []string
+	check := func(key, got, want string) {
+		if got != want {
+			changes = append(changes, fmt.Sprintf("%s is %q, want %q", key, got, want))
+		}
+	}
+
+	check("Label", p.Label, want.Label)
+	check("ProgramArguments", strings.Join(p.ProgramArguments, " "), strings.Join(want.ProgramArguments, " "))
+	check("RunAtLoad", strconv.FormatBool(p.RunAtLoad), strconv.FormatBool(want.RunAtLoad))
+	check("KeepAlive", strconv.FormatBool(p.KeepAlive), strconv.FormatBool(want.KeepAlive))
+	check("ThrottleInterval", strconv.Itoa(p.ThrottleInterval), strconv.Itoa(want.ThrottleInterval))
+	check("StandardOutPath", p.StandardOutPath, want.StandardOutPath)
+	check("StandardErrorPath", p.StandardErrorPath, want.StandardErrorPath)
+	check("EnvironmentVariables", strings.Join(envPairs(p.Environment), " "), strings.Join(envPairs(want.Environment), " "))
+
+	return changes
+}
+
+// envPairs returns environment variables as sorted KEY=value pairs
+func envPairs(env map[string]string) []string {
+	pairs := make([]string, 0, len(env))
+	for k, v := range env {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// golden compares got with testdata/name, or rewrites it with -update
+func golden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (run with -update to create it)", err)
+	}
+	if got != string(want) {
+		t.Errorf("%s differs from the golden file:\n%s", name, unifiedDiff(path, string(want), got))
+	}
+}
+
+// plistServices are the launchd services with their golden files. Only
+// macOS runs launchd, so the flush service is built as it is there.
+func plistServices() map[string]service {
+	return map[string]service{
+		"com.saferay.xray-auto.plist": autoService(),
+		"com.saferay.dnsflush.plist":  dnsFlushServiceFor("darwin"),
+	}
+}
+
+func TestLaunchdPlistGolden(t *testing.T) {
+	for name, s := range plistServices() {
+		t.Run(name, func(t *testing.T) {
+			golden(t, name, launchdManager{}.render(s))
+		})
+	}
+}
+
+func TestLaunchdPlistRoundTrip(t *testing.T) {
+	for name, s := range plistServices() {
+		t.Run(name, func(t *testing.T) {
+			want := launchdManager{}.plist(s)
+			got, err := parseLaunchdPlist([]byte(want.encode()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+			if diff := got.diff(want); len(diff) > 0 {
+				t.Errorf("diff of a round trip: %v", diff)
+			}
+		})
+	}
+}
+
+func TestParseLaunchdPlist(t *testing.T) {
+	// Written by hand like an admin would: tabs, a Program key instead of
+	// ProgramArguments, KeepAlive conditions and keys saferay ignores
+	data := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>com.saferay.xray-auto</string>
+	<key>Program</key>
+	<string>/usr/local/bin/saferay</string>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	<key>ThrottleInterval</key>
+	<integer> 10 </integer>
+	<key>Nice</key>
+	<real>1.5</real>
+	<key>EnvironmentVariables</key>
+	<dict>
+		<key>A</key>
+		<string>x &amp; y</string>
+	</dict>
+</dict>
+</plist>`
+
+	got, err := parseLaunchdPlist([]byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := launchdPlist{
+		Label:            "com.saferay.xray-auto",
+		ProgramArguments: []string{"/usr/local/bin/saferay"},
+		Environment:      map[string]string{"A": "x & y"},
+		KeepAlive:        true,
+		ThrottleInterval: 10,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parsed %+v, want %+v", got, want)
+	}
+
+	if _, err := parseLaunchdPlist([]byte(`<plist><array><string>x</string></array></plist>`)); err == nil {
+		t.Error("a top-level array parsed without an error")
+	}
+}
+
+func TestLaunchdDrift(t *testing.T) {
+	dir := t.TempDir()
+	saved := launchDaemonsDir
+	launchDaemonsDir = dir
+	t.Cleanup(func() { launchDaemonsDir = saved })
+
+	// The program has to exist, or that is drift too
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := autoService()
+	s.Args = append([]string{exe}, s.Args[1:]...)
+	m := launchdManager{}
+
+	tests := []struct {
+		name   string
+		change func(p *launchdPlist)
+		want   []string
+	}{
+		{
+			name:   "in sync",
+			change: func(p *launchdPlist) {},
+		},
+		{
+			name:   "stale binary path",
+			change: func(p *launchdPlist) { p.ProgramArguments = []string{"/opt/saferay-old/saferay", "xray", "watch"} },
+			want: []string{
+				`ProgramArguments is "/opt/saferay-old/saferay xray watch", want "` + exe + ` xray watch"`,
+				"program /opt/saferay-old/saferay not found",
+			},
+		},
+		{
+			name:   "changed ThrottleInterval",
+			change: func(p *launchdPlist) { p.ThrottleInterval = 30 },
+			want:   []string{`ThrottleInterval is "30", want "5"`},
+		},
+		{
+			name:   "log path and environment",
+			change: func(p *launchdPlist) { p.StandardErrorPath = ""; p.Environment = map[string]string{"DEBUG": "1"} },
+			want: []string{
+				`StandardErrorPath is "", want "` + s.LogPath + `"`,
+				`EnvironmentVariables is "DEBUG=1", want ""`,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installed := m.plist(s)
+			tt.change(&installed)
+			if err := os.WriteFile(m.path(s), []byte(installed.encode()), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if got := m.drift(s); strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("drift:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+
+	t.Run("unreadable", func(t *testing.T) {
+		if err := os.WriteFile(m.path(s), []byte("<plist><dict><key>Label</key>"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := m.drift(s); len(got) != 1 || !strings.Contains(got[0], m.path(s)) {
+			t.Errorf("drift of a broken plist: %v", got)
+		}
+	})
+}
@@ -0,0 +1,544 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// Protection modes a profile can bind a network to
+const (
+	modeOff        = "off"
+	modeLight      = "light"
+	modeXray       = "xray"
+	modeKillswitch = "killswitch"
+)
+
+var profileModes = []string{modeOff, modeLight, modeXray, modeKillswitch}
+
+// Profile binds networks matching all of its non-empty criteria to a mode
+type Profile struct {
+	Name       string `json:"name"`
+	Mode       string `json:"mode"`
+	SSID       string `json:"ssid,omitempty"`
+	GatewayMAC string `json:"gateway_mac,omitempty"`
+	DHCPDomain string `json:"dhcp_domain,omitempty"`
+	IPRange    string `json:"ip_range,omitempty"`
+}
+
+// networkInfo describes the network the machine is currently attached to
+type networkInfo struct {
+	Service    string `json:"service"`
+	Device     string `json:"device"`
+	SSID       string `json:"ssid"`
+	Gateway    string `json:"gateway"`
+	GatewayMAC string `json:"gateway_mac"`
+	DHCPDomain string `json:"dhcp_domain"`
+	IP         string `json:"ip"`
+}
+
+func newProfileCmd() *cobra.Command {
+	cmd := groupCmd("profile", "Switch protection mode by network (SSID, router, domain, IP range)")
+	cmd.Long = `Profiles bind networks to a protection mode. A profile matches when all of
+its criteria match the current network; the first matching profile wins.
+
+Profile modes: off, light, xray, killswitch (pf on even without VPN).
+With 'saferay xray auto start' profiles switch on network changes.`
+
+	cmd.AddCommand(
+		newProfileAddCmd(),
+		&cobra.Command{
+			Use:   "remove <name>",
+			Short: "Remove a profile",
+			Args:  cobra.ExactArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				removeProfile(args[0])
+			},
+		},
+		actionCmd("list", "List profiles in priority order", listProfiles),
+		&cobra.Command{
+			Use:       "default <off|light|xray|killswitch>",
+			Short:     "Mode for networks without a matching profile",
+			Args:      cobra.ExactArgs(1),
+			ValidArgs: profileModes,
+			Run: func(cmd *cobra.Command, args []string) {
+				setDefaultMode(args[0])
+			},
+		},
+		actionCmd("status", "Show current network and matched profile", statusProfile),
+		actionCmd("apply", "Apply the matched profile now", applyCurrentProfile),
+	)
+	return cmd
+}
+
+func newProfileAddCmd() *cobra.Command {
+	var p Profile
+
+	cmd := &cobra.Command{
+		Use:   "add <name> --mode <mode> [--ssid S] [--gateway-mac M] [--dhcp-domain D] [--ip-range CIDR]",
+		Short: "Bind matching networks to a mode",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			p.Name = args[0]
+			addProfile(p)
+		},
+	}
+
+	flags := cmd.Flags()
+	flags.StringVar(&p.Mode, "mode", "", "protection mode: off, light, xray, killswitch")
+	flags.StringVar(&p.SSID, "ssid", "", "Wi-Fi network name")
+	flags.StringVar(&p.GatewayMAC, "gateway-mac", "", "MAC address of the default gateway")
+	flags.StringVar(&p.DHCPDomain, "dhcp-domain", "", "DHCP search domain")
+	flags.StringVar(&p.IPRange, "ip-range", "", "local address range in CIDR notation")
+	_ = cmd.MarkFlagRequired("mode")
+	_ = cmd.RegisterFlagCompletionFunc("mode", cobra.FixedCompletions(profileModes, cobra.ShellCompDirectiveNoFileComp))
+
+	return cmd
+}
+
+func addProfile(p Profile) {
+	if strings.ContainsAny(p.Name, "= \t") {
+		fmt.Printf("Invalid profile name: %q\n", p.Name)
+		os.Exit(1)
+	}
+
+	if err := p.validate(); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	cfg := loadConfig()
+	if existing := cfg.profile(p.Name, false); existing != nil {
+		*existing = p
+	} else {
+		cfg.Profiles = append(cfg.Profiles, p)
+	}
+
+	if err := saveConfig(cfg); err != nil {
+		fmt.Printf("Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Profile %s saved (%s)\n", p.Name, p.describe())
+	if !newServiceManager().status(autoService()).Installed {
+		fmt.Println("  Run 'saferay xray auto start' to switch profiles automatically")
+	}
+}
+
+func removeProfile(name string) {
+	cfg := loadConfig()
+
+	var kept []Profile
+	for _, p := range cfg.Profiles {
+		if p.Name != name {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == len(cfg.Profiles) {
+		fmt.Printf("Profile not found: %s\n", name)
+		os.Exit(1)
+	}
+	cfg.Profiles = kept
+
+	if err := saveConfig(cfg); err != nil {
+		fmt.Printf("Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Profile %s removed\n", name)
+}
+
+func setDefaultMode(mode string) {
+	if !validMode(mode) {
+		fmt.Printf("Unknown mode: %s (expected one of: %s)\n", mode, strings.Join(profileModes, ", "))
+		os.Exit(1)
+	}
+
+	cfg := loadConfig()
+	cfg.DefaultMode = mode
+	if err := saveConfig(cfg); err != nil {
+		fmt.Printf("Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Networks without a matching profile will use mode=%s\n", mode)
+}
+
+// profileList is the result of 'saferay profile list'
+type profileList struct {
+	report
+	Profiles    []Profile `json:"profiles"`
+	DefaultMode string    `json:"default_mode"`
+}
+
+func listProfiles() {
+	cfg := loadConfig()
+	st := profileList{report: newReport("profile list"), Profiles: append([]Profile{}, cfg.Profiles...), DefaultMode: cfg.DefaultMode}
+
+	finish(&st.report, st, func() {
+		if len(st.Profiles) == 0 {
+			fmt.Println("No profiles configured")
+		}
+		for _, p := range st.Profiles {
+			fmt.Printf("%-16s %s\n", p.Name, p.describe())
+		}
+		fmt.Printf("\nOther networks:  mode=%s\n", st.DefaultMode)
+	})
+}
+
+// profileStatus is the result of 'saferay profile status'
+type profileStatus struct {
+	report
+	Network networkInfo `json:"network"`
+	// Profile is the matching profile, empty if none matches
+	Profile string `json:"profile"`
+	Mode    string `json:"mode"`
+}
+
+func statusProfile() {
+	st := profileStatus{report: newReport("profile status"), Network: currentNetwork()}
+
+	cfg := loadConfig()
+	st.Mode = cfg.DefaultMode
+	if p := cfg.match(st.Network); p != nil {
+		st.Profile, st.Mode = p.Name, p.Mode
+	}
+
+	finish(&st.report, st, func() {
+		fmt.Println("=== Network Profile Status ===")
+		fmt.Println()
+
+		info := st.Network
+		fmt.Printf("Service:         %s\n", orNone(info.Service))
+		fmt.Printf("Device:          %s\n", orNone(info.Device))
+		fmt.Printf("SSID:            %s\n", orNone(info.SSID))
+		fmt.Printf("Gateway:         %s\n", orNone(info.Gateway))
+		fmt.Printf("Gateway MAC:     %s\n", orNone(info.GatewayMAC))
+		fmt.Printf("DHCP domain:     %s\n", orNone(info.DHCPDomain))
+		fmt.Printf("IP address:      %s\n", orNone(info.IP))
+		fmt.Println()
+
+		if st.Profile != "" {
+			fmt.Printf("Matched profile: %s (mode=%s)\n", st.Profile, st.Mode)
+		} else {
+			fmt.Printf("Matched profile: none (mode=%s)\n", st.Mode)
+		}
+	})
+}
+
+// applyCurrentProfile applies the mode for the current network once
+func applyCurrentProfile() {
+	name, mode, info := currentMode(loadConfig())
+
+	fmt.Printf("Applying profile %s (mode=%s)...\n", name, mode)
+	applyModeDNS(mode, info.Service)
+
+	if wantPf(mode, isVPNConnected()) {
+		enableXray()
+	} else {
+		disableXray()
+	}
+}
+
+func (p *Profile) set(field, value string) {
+	switch field {
+	case "mode":
+		p.Mode = value
+	case "ssid":
+		p.SSID = value
+	case "gateway_mac":
+		p.GatewayMAC = value
+	case "dhcp_domain":
+		p.DHCPDomain = value
+	case "ip_range":
+		p.IPRange = value
+	}
+}
+
+// fields returns the profile's non-empty config fields in a stable order
+func (p *Profile) fields() [][2]string {
+	all := [][2]string{
+		{"mode", p.Mode},
+		{"ssid", p.SSID},
+		{"gateway_mac", p.GatewayMAC},
+		{"dhcp_domain", p.DHCPDomain},
+		{"ip_range", p.IPRange},
+	}
+
+	var out [][2]string
+	for _, kv := range all {
+		if kv[1] != "" {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+func (p *Profile) describe() string {
+	var parts []string
+	for _, kv := range p.fields() {
+		parts = append(parts, kv[0]+"="+kv[1])
+	}
+	return strings.Join(parts, " ")
+}
+
+func (p *Profile) validate() error {
+	if !validMode(p.Mode) {
+		return fmt.Errorf("--mode must be one of: %s", strings.Join(profileModes, ", "))
+	}
+	if p.SSID == "" && p.GatewayMAC == "" && p.DHCPDomain == "" && p.IPRange == "" {
+		return fmt.Errorf("at least one of --ssid, --gateway-mac, --dhcp-domain, --ip-range is required")
+	}
+	if p.GatewayMAC != "" {
+		if _, err := net.ParseMAC(normalizeMAC(p.GatewayMAC)); err != nil {
+			return fmt.Errorf("invalid gateway MAC %q", p.GatewayMAC)
+		}
+		p.GatewayMAC = normalizeMAC(p.GatewayMAC)
+	}
+	if p.IPRange != "" {
+		if _, _, err := net.ParseCIDR(p.IPRange); err != nil {
+			return fmt.Errorf("invalid IP range %q (expected CIDR, e.g. 10.0.0.0/8)", p.IPRange)
+		}
+	}
+	return nil
+}
+
+// matches reports whether every criterion set on the profile holds for info
+func (p *Profile) matches(info networkInfo) bool {
+	if p.SSID != "" && p.SSID != info.SSID {
+		return false
+	}
+	if p.GatewayMAC != "" && p.GatewayMAC != info.GatewayMAC {
+		return false
+	}
+	if p.DHCPDomain != "" && !strings.EqualFold(p.DHCPDomain, info.DHCPDomain) {
+		return false
+	}
+	if p.IPRange != "" {
+		_, ipNet, err := net.ParseCIDR(p.IPRange)
+		ip := net.ParseIP(info.IP)
+		if err != nil || ip == nil || !ipNet.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// currentMode resolves the profile and mode for the current network.
+// Without profiles the network isn't inspected and name is empty.
+func currentMode(cfg *Config) (name, mode string, info networkInfo) {
+	if len(cfg.Profiles) == 0 {
+		return "", cfg.DefaultMode, info
+	}
+
+	info = currentNetwork()
+	if p := cfg.match(info); p != nil {
+		return p.Name, p.Mode, info
+	}
+	return "default", cfg.DefaultMode, info
+}
+
+// match returns the first profile matching the network, or nil
+func (c *Config) match(info networkInfo) *Profile {
+	for i := range c.Profiles {
+		if c.Profiles[i].matches(info) {
+			return &c.Profiles[i]
+		}
+	}
+	return nil
+}
+
+func validMode(mode string) bool {
+	for _, m := range profileModes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+// wantPf reports whether pf should be enabled for a mode
+func wantPf(mode string, vpnConnected bool) bool {
+	switch mode {
+	case modeKillswitch:
+		// Fail closed: DNS only through the tunnel, even when it's down
+		return true
+	case modeXray:
+		return vpnConnected
+	default:
+		return false
+	}
+}
+
+// applyModeDNS sets or restores service DNS for a mode.
+// Only light mode overrides DNS; every other mode restores the original.
+func applyModeDNS(mode, service string) {
+	if service == "" {
+		return
+	}
+
+	_, err := os.Stat(lightConfigPath)
+	lightActive := err == nil
+
+	if mode == modeLight {
+		if saved := lightService(); lightActive && saved != "" && saved != service {
+			// Give the service light mode had its settings back before
+			// taking over this one
+			resetDNS(saved)
+			lightActive = false
+		}
+		if !lightActive {
+			saveOriginalDNS(service)
+		}
+		setDNS(service, defaultDNS, defaultDNS2)
+		return
+	}
+
+	if lightActive {
+		// The saved settings are those of the service light mode took over
+		if saved := lightService(); saved != "" {
+			service = saved
+		}
+		resetDNS(service)
+		_ = sys.removeFile(lightConfigPath)
+	}
+}
+
+// String names the network for log messages
+func (n networkInfo) String() string {
+	switch {
+	case n.SSID != "":
+		return fmt.Sprintf("%q", n.SSID)
+	case n.Gateway != "":
+		return fmt.Sprintf("%s via %s", orNone(n.Device), n.Gateway)
+	default:
+		return orNone(n.Service)
+	}
+}
+
+// currentNetwork collects the identifying facts of the active network
+func currentNetwork() networkInfo {
+	info := networkInfo{Service: getActiveNetworkService()}
+
+	// Default route gives gateway and interface
+	out, _ := exec.Command("route", "-n", "get", "default").CombinedOutput()
+	routeIface := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "gateway":
+			info.Gateway = strings.TrimSpace(value)
+		case "interface":
+			routeIface = strings.TrimSpace(value)
+		}
+	}
+
+	info.Device = serviceDevice(info.Service)
+	if info.Device == "" {
+		info.Device = routeIface
+	}
+	if info.Device == "" {
+		return info
+	}
+
+	info.SSID = currentSSID(info.Device)
+
+	out, _ = exec.Command("ipconfig", "getifaddr", info.Device).CombinedOutput()
+	if ip := strings.TrimSpace(string(out)); net.ParseIP(ip) != nil {
+		info.IP = ip
+	}
+
+	out, err := exec.Command("ipconfig", "getoption", info.Device, "domain_name").CombinedOutput()
+	if err == nil {
+		info.DHCPDomain = strings.TrimSpace(string(out))
+	}
+
+	if info.Gateway != "" {
+		info.GatewayMAC = arpLookup(info.Gateway)
+	}
+
+	return info
+}
+
+// serviceDevice maps a network service name to its BSD device (e.g. en0)
+func serviceDevice(service string) string {
+	if service == "" {
+		return ""
+	}
+
+	out, err := exec.Command("networksetup", "-listallhardwareports").CombinedOutput()
+	if err != nil {
+		return ""
+	}
+
+	port := ""
+	for _, line := range strings.Split(string(out), "\n") {
+		if strings.HasPrefix(line, "Hardware Port:") {
+			port = strings.TrimSpace(strings.TrimPrefix(line, "Hardware Port:"))
+		} else if strings.HasPrefix(line, "Device:") && port == service {
+			return strings.TrimSpace(strings.TrimPrefix(line, "Device:"))
+		}
+	}
+	return ""
+}
+
+// currentSSID returns the Wi-Fi network name on device, if any
+func currentSSID(device string) string {
+	// ipconfig getsummary works on recent macOS where networksetup redacts the SSID
+	out, _ := exec.Command("ipconfig", "getsummary", device).CombinedOutput()
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "SSID : ") {
+			return strings.TrimPrefix(line, "SSID : ")
+		}
+	}
+
+	out, _ = exec.Command("networksetup", "-getairportnetwork", device).CombinedOutput()
+	if _, ssid, ok := strings.Cut(strings.TrimSpace(string(out)), "Current Wi-Fi Network: "); ok {
+		return ssid
+	}
+	return ""
+}
+
+// arpLookup returns the normalized MAC address for ip from the ARP cache
+func arpLookup(ip string) string {
+	out, _ := exec.Command("arp", "-n", ip).CombinedOutput()
+	// ? (192.168.1.1) at 0:1b:2c:3d:4e:5f on en0 ifscope [ethernet]
+	fields := strings.Fields(string(out))
+	for i, f := range fields {
+		if f == "at" && i+1 < len(fields) {
+			mac := normalizeMAC(fields[i+1])
+			if _, err := net.ParseMAC(mac); err == nil {
+				return mac
+			}
+		}
+	}
+	return ""
+}
+
+// normalizeMAC lowercases a MAC and zero-pads each octet (arp prints 0:1b:...)
+func normalizeMAC(mac string) string {
+	parts := strings.FieldsFunc(strings.ToLower(mac), func(r rune) bool {
+		return r == ':' || r == '-'
+	})
+	for i, p := range parts {
+		if len(p) == 1 {
+			parts[i] = "0" + p
+		}
+	}
+	return strings.Join(parts, ":")
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,184 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/user"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Patterns the redactor replaces wherever they appear
+var (
+	macPattern  = regexp.MustCompile(`\b[0-9A-Fa-f]{1,2}(?::[0-9A-Fa-f]{1,2}){5}\b`)
+	ipv4Pattern = regexp.MustCompile(`\b(?:\d{1,3}\.){3}\d{1,3}\b`)
+	ipv6Pattern = regexp.MustCompile(`[0-9A-Fa-f]{0,4}(?::[0-9A-Fa-f]{0,4}){2,7}`)
+	// hostContexts are where lists of domain names appear: scutil --dns,
+	// resolvectl and resolv.conf
+	hostContexts = regexp.MustCompile(`(?m)(domain\s*(?:\[\d+\])?\s*:\s*|DNS Domain:\s*|^search\s+|^domain\s+)([^\n"]+)`)
+	// queryField is a query in the leak log, one logfmt field among others
+	queryField = regexp.MustCompile(`\b(query=)([^\s"]+)`)
+)
+
+// minLiteral is the shortest known name replaced as plain text; shorter
+// SSIDs would clobber unrelated words
+const minLiteral = 3
+
+// redactor replaces addresses and names with placeholders such as [ip-3].
+// The same value always gets the same placeholder, so a redacted bundle
+// can still be followed.
+type redactor struct {
+	tokens map[string]string
+	counts map[string]int
+	// literals are known names found as plain text, longest first, with
+	// their kind
+	literals []string
+	kinds    map[string]string
+}
+
+// newRedactor collects the names that can't be recognised by their
+// shape: hostnames, SSIDs and domains from the config and the network,
+// and the user's name and home directory
+func newRedactor() *redactor {
+	r := &redactor{tokens: map[string]string{}, counts: map[string]int{}, kinds: map[string]string{}}
+
+	if u := invokingUser(); u != nil {
+		r.knownUser(u)
+	}
+	if host, err := os.Hostname(); err == nil {
+		r.known("host", host)
+		short, _, _ := strings.Cut(host, ".")
+		r.known("host", short)
+	}
+	if runtime.GOOS == "darwin" {
+		for _, key := range []string{"ComputerName", "LocalHostName", "HostName"} {
+			out, err := exec.Command("scutil", "--get", key).Output()
+			if err == nil {
+				r.known("host", strings.TrimSpace(string(out)))
+			}
+		}
+		info := currentNetwork()
+		r.known("ssid", info.SSID)
+		r.known("domain", info.DHCPDomain)
+	}
+
+	cfg := loadConfig()
+	for _, p := range cfg.Profiles {
+		r.known("ssid", p.SSID)
+		r.known("domain", p.DHCPDomain)
+	}
+	for _, route := range cfg.SplitDNS {
+		r.known("domain", route.Domain)
+	}
+	entries, _ := os.ReadDir(resolverDir)
+	for _, entry := range entries {
+		r.known("domain", entry.Name())
+	}
+
+	sort.SliceStable(r.literals, func(i, j int) bool { return len(r.literals[i]) > len(r.literals[j]) })
+	return r
+}
+
+// invokingUser is who ran saferay, under sudo the user who ran sudo
+func invokingUser() *user.User {
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		if u, err := user.Lookup(name); err == nil {
+			return u
+		}
+	}
+	u, err := user.Current()
+	if err != nil {
+		return nil
+	}
+	return u
+}
+
+// knownUser adds a user's name and home directory, which paths such as
+// the client config's carry. Root names no one.
+func (r *redactor) knownUser(u *user.User) {
+	if u.Uid == "0" {
+		return
+	}
+	r.known("home", u.HomeDir)
+	r.known("user", u.Username)
+}
+
+// known adds a name to replace as plain text
+func (r *redactor) known(kind, value string) {
+	value = strings.TrimSpace(value)
+	if len(value) < minLiteral || r.kinds[value] != "" {
+		return
+	}
+	r.literals = append(r.literals, value)
+	r.kinds[value] = kind
+}
+
+// token returns the placeholder for a value
+func (r *redactor) token(kind, value string) string {
+	if t, ok := r.tokens[value]; ok {
+		return t
+	}
+	r.counts[kind]++
+	t := fmt.Sprintf("[%s-%d]", kind, r.counts[kind])
+	r.tokens[value] = t
+	return t
+}
+
+func (r *redactor) redact(s string) string {
+	for _, literal := range r.literals {
+		if strings.Contains(s, literal) {
+			s = strings.ReplaceAll(s, literal, r.token(r.kinds[literal], literal))
+		}
+	}
+
+	s = macPattern.ReplaceAllStringFunc(s, func(mac string) string {
+		mac = normalizeMAC(mac)
+		if mac == "00:00:00:00:00:00" || mac == "ff:ff:ff:ff:ff:ff" {
+			return mac
+		}
+		return r.token("mac", mac)
+	})
+	s = ipv4Pattern.ReplaceAllStringFunc(s, r.address)
+	s = ipv6Pattern.ReplaceAllStringFunc(s, r.address)
+
+	s = queryField.ReplaceAllStringFunc(s, func(match string) string {
+		m := queryField.FindStringSubmatch(match)
+		return m[1] + r.host(m[2])
+	})
+	return hostContexts.ReplaceAllStringFunc(s, func(match string) string {
+		m := hostContexts.FindStringSubmatch(match)
+		names := strings.Fields(m[2])
+		for i, name := range names {
+			names[i] = r.host(name)
+		}
+		return m[1] + strings.Join(names, " ")
+	})
+}
+
+// host replaces a domain name unless it is already a placeholder, the
+// root, an address, or the "-" of a packet without a query
+func (r *redactor) host(name string) string {
+	if strings.HasPrefix(name, "[") || name == "." || name == "-" || net.ParseIP(name) != nil {
+		return name
+	}
+	return r.token("host", strings.TrimSuffix(name, "."))
+}
+
+// address replaces an IP address unless it identifies nothing: loopback,
+// unspecified, netmasks, multicast, and light mode's public resolvers
+func (r *redactor) address(s string) string {
+	ip := net.ParseIP(s)
+	switch {
+	case ip == nil:
+		return s
+	case ip.IsLoopback(), ip.IsUnspecified(), ip.IsMulticast(), strings.HasPrefix(s, "255."):
+		return s
+	case s == defaultDNS || s == defaultDNS2:
+		return s
+	}
+	return r.token("ip", ip.String())
+}
@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	"os/user"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{name: "ipv4", in: "inet 192.168.1.23 netmask 255.255.255.0", want: "inet [ip-1] netmask 255.255.255.0"},
+		{name: "ipv6 with a zone", in: "nameserver fe80::1%en0", want: "nameserver [ip-1]%en0"},
+		{name: "mac", in: "ether A4:83:e7:0b:1c:2d", want: "ether [mac-1]"},
+		{name: "same value, same placeholder", in: "10.0.0.7 via 10.0.0.1, from 10.0.0.7", want: "[ip-1] via [ip-2], from [ip-1]"},
+		{name: "ssid", in: `profile office ssid="Cafe Corner"`, want: `profile office ssid="[ssid-1]"`},
+		{name: "hostname", in: "ComputerName: alices-macbook", want: "ComputerName: [host-1]"},
+		{name: "home directory", in: "xray_config=/Users/alice/Library/Application Support/Hiddify/config.json", want: "xray_config=[home-1]/Library/Application Support/Hiddify/config.json"},
+		{name: "user name", in: "SUDO_USER=alice", want: "SUDO_USER=[user-1]"},
+		{name: "resolv.conf search", in: "search corp.example lan.\nnameserver 127.0.0.53", want: "search [host-1] [host-2]\nnameserver 127.0.0.53"},
+		{name: "leak log query", in: "event=dns_leak query=intranet.corp.example. type=A uid=501", want: "event=dns_leak query=[host-1] type=A uid=501"},
+		{name: "leak log without a query", in: "proto=tcp query=- type=-", want: "proto=tcp query=- type=-"},
+		{name: "loopback", in: "listen 127.0.0.1:53 and [::1]:53", want: "listen 127.0.0.1:53 and [::1]:53"},
+		{name: "light mode resolvers", in: "DNS: 8.8.8.8 8.8.4.4", want: "DNS: 8.8.8.8 8.8.4.4"},
+		{name: "unspecified and broadcast mac", in: "0.0.0.0 ff:ff:ff:ff:ff:ff", want: "0.0.0.0 ff:ff:ff:ff:ff:ff"},
+		{name: "times", in: "at 12:00:05", want: "at 12:00:05"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &redactor{tokens: map[string]string{}, counts: map[string]int{}, kinds: map[string]string{}}
+			r.known("ssid", "Cafe Corner")
+			r.known("host", "alices-macbook")
+			r.knownUser(&user.User{Uid: "501", Username: "alice", HomeDir: "/Users/alice"})
+			if got := r.redact(tt.in); got != tt.want {
+				t.Errorf("redact(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Light mode on Linux sets per-link DNS in systemd-resolved with resolvectl.
+// The link plays the part of the macOS network service.
+
+// dnsTLSName is the certificate name for DNS-over-TLS to defaultDNS
+const dnsTLSName = "dns.google"
+
+// resolvectl is the program that talks to systemd-resolved; a variable so
+// tests can run a stand-in
+var resolvectl = "resolvectl"
+
+// resolvedLink returns the interface of the default route
+func resolvedLink() string {
+	out, err := exec.Command("ip", "route", "show", "default").CombinedOutput()
+	if err != nil {
+		return ""
+	}
+
+	// default via 192.168.1.1 dev wlan0 proto dhcp metric 600
+	fields := strings.Fields(string(out))
+	for i, field := range fields {
+		if field == "dev" && i+1 < len(fields) {
+			return fields[i+1]
+		}
+	}
+	return ""
+}
+
+// resolvedQuery returns the values resolvectl reports for a link setting,
+// e.g. "resolvectl dns wlan0" -> "Link 3 (wlan0): 1.1.1.1 9.9.9.9"
+func resolvedQuery(setting, link string) []string {
+	out, err := exec.Command(resolvectl, setting, link).CombinedOutput()
+	if err != nil {
+		return []string{}
+	}
+	_, values, _ := strings.Cut(strings.TrimSpace(string(out)), ":")
+	return strings.Fields(values)
+}
+
+// resolvedServers returns the link's DNS servers without the TLS name
+// (8.8.8.8#dns.google) or interface (fe80::1%3) suffixes
+func resolvedServers(link string) []string {
+	servers := resolvedQuery("dns", link)
+	for i, server := range servers {
+		server, _, _ = strings.Cut(server, "#")
+		server, _, _ = strings.Cut(server, "%")
+		servers[i] = server
+	}
+	return servers
+}
+
+// resolvedDNSOverTLS returns the link's DNS-over-TLS mode
+func resolvedDNSOverTLS(link string) string {
+	if mode := resolvedQuery("dnsovertls", link); len(mode) > 0 {
+		return mode[0]
+	}
+	return ""
+}
+
+// saveResolvedLink records the link's settings in light.conf, in the same
+// key=value format as on macOS plus the Linux-only settings
+func saveResolvedLink(link string) {
+	dns := strings.Join(resolvedQuery("dns", link), " ")
+	if dns == "" {
+		dns = "auto"
+	}
+
+	content := fmt.Sprintf("service=%s\ndns=%s\ndnsovertls=%s\ndomains=%s\n",
+		link, dns, resolvedDNSOverTLS(link), strings.Join(resolvedQuery("domain", link), " "))
+
+	_ = sys.writeFile(lightConfigPath, []byte(content), 0644)
+}
+
+// setResolvedDNS sends all lookups to dns over TLS through the link. The
+// "~." routing domain makes the link win over other links' resolvers.
+func setResolvedDNS(link string, dns ...string) {
+	servers := make([]string, len(dns))
+	for i, server := range dns {
+		servers[i] = server + "#" + dnsTLSName
+	}
+
+	cmds := [][]string{
+		append([]string{"sudo", resolvectl, "dns", link}, servers...),
+		{"sudo", resolvectl, "dnsovertls", link, "yes"},
+		{"sudo", resolvectl, "domain", link, "~."},
+		{"sudo", resolvectl, "flush-caches"},
+	}
+	for _, args := range cmds {
+		if err := sys.quiet(args...); err != nil {
+			fmt.Printf("Error setting DNS: %v\n", err)
+			return
+		}
+	}
+
+	fmt.Printf("✓ DNS set to %s over TLS on %s\n", strings.Join(dns, ", "), link)
+}
+
+// resetResolvedDNS restores the settings saved in light.conf, or hands the
+// link back to its network manager if there are none
+func resetResolvedDNS(link string) {
+	saved := map[string]string{}
+	content, _ := os.ReadFile(lightConfigPath)
+	for _, line := range strings.Split(string(content), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			saved[key] = value
+		}
+	}
+
+	if saved["dns"] == "" || (saved["dns"] == "auto" && saved["domains"] == "") {
+		_ = sys.quiet("sudo", resolvectl, "revert", link)
+		_ = sys.quiet("sudo", resolvectl, "flush-caches")
+		fmt.Printf("✓ DNS reset to automatic on %s\n", link)
+		return
+	}
+
+	dns := strings.Fields(saved["dns"])
+	if saved["dns"] == "auto" {
+		dns = []string{""}
+	}
+	domains := strings.Fields(saved["domains"])
+	if len(domains) == 0 {
+		domains = []string{""}
+	}
+	overTLS := saved["dnsovertls"]
+	if overTLS == "" {
+		overTLS = "no"
+	}
+
+	cmds := [][]string{
+		append([]string{"sudo", resolvectl, "dns", link}, dns...),
+		{"sudo", resolvectl, "dnsovertls", link, overTLS},
+		append([]string{"sudo", resolvectl, "domain", link}, domains...),
+		{"sudo", resolvectl, "flush-caches"},
+	}
+	for _, args := range cmds {
+		_ = sys.quiet(args...)
+	}
+	fmt.Printf("✓ DNS restored to %s on %s\n", saved["dns"], link)
+}
@@ -0,0 +1,204 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// fakeResolvectl keeps each link setting in <dir>/<link>/<setting> and
+// logs its arguments to <dir>/calls. A setting without arguments is a
+// query, printed the way resolvectl prints it.
+const fakeResolvectl = `#!/bin/sh
+state=%s
+echo "$*" >> "$state/calls"
+cmd=$1 link=$2
+case $cmd in
+flush-caches) exit 0 ;;
+revert) rm -rf "$state/$link"; exit 0 ;;
+esac
+shift 2
+if [ $# -eq 0 ]; then
+	value=$(cat "$state/$link/$cmd" 2>/dev/null)
+	if [ -z "$value" ] && [ "$cmd" = dnsovertls ]; then value=no; fi
+	echo "Link 3 ($link): $value"
+else
+	mkdir -p "$state/$link"
+	echo "$*" > "$state/$link/$cmd"
+fi
+`
+
+// fakeSudo runs the command without privileges, and takes the audit
+// entries unprivileged runs hand to 'sudo saferay audit append'
+const fakeSudo = `#!/bin/sh
+if [ "$2" = audit ]; then cat >> %s/audit.log; exit 0; fi
+exec "$@"
+`
+
+// resolvedStandIn puts a fake resolvectl and sudo in place and returns
+// the directory holding their state
+func resolvedStandIn(t *testing.T) string {
+	t.Helper()
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	state := filepath.Join(dir, "state")
+	for _, d := range []string{bin, state} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write := func(name, content string) {
+		if err := os.WriteFile(filepath.Join(bin, name), []byte(content), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("resolvectl", strings.Replace(fakeResolvectl, "%s", state, 1))
+	write("sudo", strings.Replace(fakeSudo, "%s", dir, 1))
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	savedResolvectl, savedLight, savedAudit := resolvectl, lightConfigPath, auditDir
+	resolvectl = filepath.Join(bin, "resolvectl")
+	lightConfigPath = filepath.Join(dir, "light.conf")
+	auditDir = func() string { return dir }
+	t.Cleanup(func() { resolvectl, lightConfigPath, auditDir = savedResolvectl, savedLight, savedAudit })
+	return state
+}
+
+// linkSetting reads a setting the fake resolvectl holds
+func linkSetting(t *testing.T, state, link, setting string) string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(state, link, setting))
+	if os.IsNotExist(err) {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.TrimSpace(string(data))
+}
+
+func setLinkSetting(t *testing.T, state, link, setting, value string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Join(state, link), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(state, link, setting), []byte(value+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// calls lists the resolvectl invocations that changed something
+func calls(t *testing.T, state string) []string {
+	t.Helper()
+	data, err := os.ReadFile(filepath.Join(state, "calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var changes []string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		if len(strings.Fields(line)) != 2 || strings.HasPrefix(line, "revert") {
+			changes = append(changes, line)
+		}
+	}
+	return changes
+}
+
+func TestResolvedSaveSetReset(t *testing.T) {
+	state := resolvedStandIn(t)
+	setLinkSetting(t, state, "eth0", "dns", "192.168.1.1 fe80::1%3")
+	setLinkSetting(t, state, "eth0", "dnsovertls", "opportunistic")
+	setLinkSetting(t, state, "eth0", "domain", "lan")
+
+	saveResolvedLink("eth0")
+	saved, err := os.ReadFile(lightConfigPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "service=eth0\ndns=192.168.1.1 fe80::1%3\ndnsovertls=opportunistic\ndomains=lan\n"
+	if string(saved) != want {
+		t.Errorf("light.conf:\n%s\nwant:\n%s", saved, want)
+	}
+
+	setResolvedDNS("eth0", defaultDNS, defaultDNS2)
+	for setting, want := range map[string]string{
+		"dns":        "8.8.8.8#dns.google 8.8.4.4#dns.google",
+		"dnsovertls": "yes",
+		"domain":     "~.",
+	} {
+		if got := linkSetting(t, state, "eth0", setting); got != want {
+			t.Errorf("%s set to %q, want %q", setting, got, want)
+		}
+	}
+	if got := resolvedServers("eth0"); !reflect.DeepEqual(got, []string{defaultDNS, defaultDNS2}) {
+		t.Errorf("resolvedServers = %v", got)
+	}
+	if got := resolvedDNSOverTLS("eth0"); got != "yes" {
+		t.Errorf("resolvedDNSOverTLS = %q", got)
+	}
+
+	resetResolvedDNS("eth0")
+	for setting, want := range map[string]string{
+		"dns":        "192.168.1.1 fe80::1%3",
+		"dnsovertls": "opportunistic",
+		"domain":     "lan",
+	} {
+		if got := linkSetting(t, state, "eth0", setting); got != want {
+			t.Errorf("%s restored to %q, want %q", setting, got, want)
+		}
+	}
+
+	wantCalls := []string{
+		"dns eth0 8.8.8.8#dns.google 8.8.4.4#dns.google",
+		"dnsovertls eth0 yes",
+		"domain eth0 ~.",
+		"flush-caches",
+		"dns eth0 192.168.1.1 fe80::1%3",
+		"dnsovertls eth0 opportunistic",
+		"domain eth0 lan",
+		"flush-caches",
+	}
+	if got := calls(t, state); !reflect.DeepEqual(got, wantCalls) {
+		t.Errorf("resolvectl calls:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(wantCalls, "\n"))
+	}
+}
+
+func TestResolvedRevert(t *testing.T) {
+	tests := []struct {
+		name string
+		save bool
+	}{
+		// The link had no settings of its own: its network manager's apply
+		{name: "no prior link config", save: true},
+		// light.conf is gone, so there is nothing to restore
+		{name: "nothing saved", save: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state := resolvedStandIn(t)
+			if tt.save {
+				saveResolvedLink("eth0")
+				saved, _ := os.ReadFile(lightConfigPath)
+				if want := "service=eth0\ndns=auto\ndnsovertls=no\ndomains=\n"; string(saved) != want {
+					t.Errorf("light.conf:\n%s\nwant:\n%s", saved, want)
+				}
+			}
+
+			setResolvedDNS("eth0", defaultDNS)
+			resetResolvedDNS("eth0")
+
+			for _, setting := range []string{"dns", "dnsovertls", "domain"} {
+				if got := linkSetting(t, state, "eth0", setting); got != "" {
+					t.Errorf("%s left at %q after revert", setting, got)
+				}
+			}
+			got := calls(t, state)
+			if want := []string{"revert eth0", "flush-caches"}; !reflect.DeepEqual(got[len(got)-2:], want) {
+				t.Errorf("reset ended with %v, want %v", got, want)
+			}
+		})
+	}
+}
@@ -6,112 +6,256 @@ import (
 	"os/exec"
 	"runtime"
 	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/cobra/doc"
 )
 
+const rootLong = `saferay - DNS leak protection for macOS with Xray/Hiddify
+
+Modes:
+  Light mode - Uses Google DNS (8.8.8.8) + DNS flush. No VPN needed.
+  Xray mode  - Forces all DNS through VPN tunnel. Requires Xray/Hiddify.
+
+Switching from light to xray: Run 'saferay xray install' - it will
+automatically reset light mode DNS and keep the flush daemon.
+
+Exit codes (status and check commands):
+  0  OK
+  1  Error, or a required check failed
+  2  Protection is configured but not in effect`
+
 func Execute() {
-	// Check macOS
-	if runtime.GOOS != "darwin" {
-		fmt.Println("Error: saferay only works on macOS")
+	if err := newRootCmd().Execute(); err != nil {
 		os.Exit(1)
 	}
+}
 
-	if len(os.Args) < 2 {
-		printUsage()
-		os.Exit(1)
+func newRootCmd() *cobra.Command {
+	var showVersion bool
+
+	root := &cobra.Command{
+		Use:   "saferay",
+		Short: "DNS leak protection for macOS with Xray/Hiddify",
+		Long:  rootLong,
+		Args:  cobra.NoArgs,
+		PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
+			if !supportsPlatform(cmd) {
+				return fmt.Errorf("'%s' is not supported on %s", cmd.CommandPath(), runtime.GOOS)
+			}
+
+			if sys.dryRun && !jsonOutput {
+				fmt.Println("Dry run: showing changes without applying them")
+				fmt.Println()
+			}
+			return nil
+		},
+		Run: func(cmd *cobra.Command, args []string) {
+			if showVersion {
+				cmdVersion()
+				return
+			}
+			_ = cmd.Help()
+		},
+		SilenceUsage: true,
 	}
 
-	switch os.Args[1] {
-	case "install":
-		// Check for --light flag
-		lightMode := false
-		for _, arg := range os.Args[2:] {
-			if arg == "--light" || arg == "-l" {
-				lightMode = true
-				break
+	flags := root.PersistentFlags()
+	flags.BoolVar(&jsonOutput, "json", false, "machine-readable output for status and check commands")
+	flags.BoolVar(&sys.dryRun, "dry-run", false, "print file diffs and commands instead of changing anything")
+	flags.BoolVar(&sys.verbose, "verbose", false, "print every system command as it runs")
+	flags.StringVar(&configPath, "config", configPath, "path to the saferay config file")
+	root.Flags().BoolVarP(&showVersion, "version", "v", false, "show version")
+
+	root.AddCommand(
+		onPlatforms(newInstallCmd(), "darwin", "linux"),
+		onPlatforms(actionCmd("uninstall", "Remove saferay and all configurations", cmdUninstall), "darwin", "linux"),
+		onPlatforms(actionCmd("check", "Check system requirements", cmdCheck), "darwin", "linux"),
+		onPlatforms(actionCmd("version", "Show version", cmdVersion), anyPlatform),
+		newLightCmd(),
+		newDNSCmd(),
+		newXrayCmd(),
+		newProfileCmd(),
+		newLogsCmd(),
+		newLeaksCmd(),
+		newAnalyzeCmd(),
+		newAuditCmd(),
+		newDoctorCmd(),
+		newBundleCmd(),
+		onPlatforms(newManCmd(), anyPlatform),
+	)
+
+	return root
+}
+
+// groupCmd creates a command that only holds subcommands. Unlike cobra's
+// default it fails on a missing or unknown action instead of exiting 0.
+func groupCmd(use, short string) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.ArbitraryArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if len(args) == 0 {
+				_ = cmd.Usage()
+				return fmt.Errorf("missing %s action", cmd.Name())
 			}
+
+			msg := fmt.Sprintf("unknown %s action: %s", cmd.Name(), args[0])
+			if suggestions := cmd.SuggestionsFor(args[0]); len(suggestions) > 0 {
+				msg += fmt.Sprintf(" (did you mean %q?)", suggestions[0])
+			}
+			return fmt.Errorf("%s\nRun '%s --help' for usage", msg, cmd.CommandPath())
+		},
+	}
+}
+
+// actionCmd creates a leaf command without arguments
+func actionCmd(use, short string, fn func()) *cobra.Command {
+	return &cobra.Command{
+		Use:   use,
+		Short: short,
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			fn()
+		},
+	}
+}
+
+// platformsAnnotation lists the GOOS values a command supports.
+// Commands without it inherit their parent's; the default is macOS only.
+const (
+	platformsAnnotation = "platforms"
+	anyPlatform         = "any"
+)
+
+// onPlatforms marks cmd and its subcommands as supported on goos
+func onPlatforms(cmd *cobra.Command, goos ...string) *cobra.Command {
+	if cmd.Annotations == nil {
+		cmd.Annotations = map[string]string{}
+	}
+	cmd.Annotations[platformsAnnotation] = strings.Join(goos, ",")
+	return cmd
+}
+
+// supportsPlatform reports whether cmd runs on this OS
+func supportsPlatform(cmd *cobra.Command) bool {
+	// Completion, help and the version flag work anywhere, e.g. in a
+	// packaging step on a build host
+	for c := cmd; c != nil; c = c.Parent() {
+		switch c.Name() {
+		case "completion", "help", cobra.ShellCompRequestCmd, cobra.ShellCompNoDescRequestCmd:
+			return true
 		}
-		cmdInstallWithOptions(lightMode)
-	case "uninstall":
-		cmdUninstall()
-	case "dns":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: saferay dns [setup|remove|status|flush]")
-			os.Exit(1)
-		}
-		cmdDNS(os.Args[2])
-	case "light":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: saferay light [setup|reset|status]")
-			os.Exit(1)
-		}
-		cmdLight(os.Args[2])
-	case "xray":
-		if len(os.Args) < 3 {
-			fmt.Println("Usage: saferay xray [install|enable|disable|reset|status|auto]")
-			os.Exit(1)
-		}
-		// Pass remaining args for subcommands like 'auto start'
-		var extraArgs []string
-		if len(os.Args) > 3 {
-			extraArgs = os.Args[3:]
+	}
+	if !cmd.HasParent() && cmd.Flags().Changed("version") {
+		return true
+	}
+
+	for c := cmd; c != nil; c = c.Parent() {
+		if platforms, ok := c.Annotations[platformsAnnotation]; ok {
+			for _, goos := range strings.Split(platforms, ",") {
+				if goos == runtime.GOOS || goos == anyPlatform {
+					return true
+				}
+			}
+			return false
 		}
-		cmdXray(os.Args[2], extraArgs)
-	case "check":
-		cmdCheck()
-	case "help", "-h", "--help":
-		printUsage()
-	case "version", "-v", "--version":
-		cmdVersion()
-	default:
-		fmt.Printf("Unknown command: %s\n", os.Args[1])
-		printUsage()
-		os.Exit(1)
+	}
+	return runtime.GOOS == "darwin"
+}
+
+func newManCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:    "man <dir>",
+		Short:  "Generate man pages",
+		Hidden: true,
+		Args:   cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := os.MkdirAll(args[0], 0755); err != nil {
+				return err
+			}
+			header := &doc.GenManHeader{Title: "SAFERAY", Section: "8", Source: "saferay " + version}
+			root := cmd.Root()
+			root.DisableAutoGenTag = true
+			if err := doc.GenManTree(root, header, args[0]); err != nil {
+				return err
+			}
+			fmt.Printf("✓ Man pages written to %s\n", args[0])
+			return nil
+		},
 	}
 }
 
+// checkResult is one line of 'saferay check'
+type checkResult struct {
+	Name     string `json:"name"`
+	OK       bool   `json:"ok"`
+	Required bool   `json:"required"`
+	Detail   string `json:"detail"`
+}
+
 func cmdCheck() {
-	fmt.Println("=== System Check ===")
-	fmt.Println()
-	allOk := true
+	result := struct {
+		report
+		Checks []checkResult `json:"checks"`
+	}{report: newReport("check")}
 
-	// Check macOS
-	fmt.Printf("macOS:           ")
-	if runtime.GOOS == "darwin" {
-		fmt.Println("✓ Yes")
-	} else {
-		fmt.Println("✗ No (required)")
-		allOk = false
+	add := func(name string, ok, required bool, detail string) {
+		result.Checks = append(result.Checks, checkResult{name, ok, required, detail})
+		if !ok && required {
+			result.fail(exitFailure, "%s: %s", name, detail)
+		}
 	}
 
-	// Check pfctl
-	fmt.Printf("pfctl:           ")
-	if _, err := exec.LookPath("pfctl"); err == nil {
-		fmt.Println("✓ Available")
+	if runtime.GOOS == "linux" {
+		checkLinux(add)
 	} else {
-		fmt.Println("✗ Not found")
-		allOk = false
+		checkDarwin(add)
 	}
 
-	// Check launchctl
-	fmt.Printf("launchctl:       ")
-	if _, err := exec.LookPath("launchctl"); err == nil {
-		fmt.Println("✓ Available")
+	finish(&result.report, result, func() {
+		fmt.Println("=== System Check ===")
+		fmt.Println()
+
+		for _, c := range result.Checks {
+			symbol := "✓"
+			if !c.OK && c.Required {
+				symbol = "✗"
+			} else if !c.OK {
+				symbol = "⚠"
+			}
+			fmt.Printf("%-17s%s %s\n", c.Name+":", symbol, c.Detail)
+		}
+
+		fmt.Println()
+		if result.OK {
+			fmt.Println("All checks passed. Ready to use.")
+		} else {
+			fmt.Println("Some checks failed. saferay may not work correctly.")
+		}
+	})
+}
+
+// checkDarwin checks for pf, launchd and a utun VPN interface
+func checkDarwin(add func(name string, ok, required bool, detail string)) {
+	// Check macOS
+	if runtime.GOOS == "darwin" {
+		add("macOS", true, true, "Yes")
 	} else {
-		fmt.Println("✗ Not found")
-		allOk = false
+		add("macOS", false, true, "No (required)")
 	}
 
-	// Check sudo access
-	fmt.Printf("sudo:            ")
-	if _, err := exec.LookPath("sudo"); err == nil {
-		fmt.Println("✓ Available")
-	} else {
-		fmt.Println("✗ Not found")
-		allOk = false
+	// Check pfctl, launchctl and sudo
+	for _, tool := range []string{"pfctl", "launchctl", "sudo"} {
+		if _, err := exec.LookPath(tool); err == nil {
+			add(tool, true, true, "Available")
+		} else {
+			add(tool, false, true, "Not found")
+		}
 	}
 
 	// Check for VPN tunnel interface
-	fmt.Printf("VPN tunnel:      ")
 	out, _ := exec.Command("ifconfig").CombinedOutput()
 	if strings.Contains(string(out), "utun") {
 		// Count utun interfaces
@@ -122,63 +266,43 @@ func cmdCheck() {
 				count++
 			}
 		}
-		fmt.Printf("✓ Found %d utun interface(s)\n", count)
+		add("VPN tunnel", true, false, fmt.Sprintf("Found %d utun interface(s)", count))
 	} else {
-		fmt.Println("⚠ No utun interfaces (start VPN first)")
+		add("VPN tunnel", false, false, "No utun interfaces (start VPN first)")
 	}
 
 	// Check pf.conf exists
-	fmt.Printf("pf.conf:         ")
 	if _, err := os.Stat("/etc/pf.conf"); err == nil {
-		fmt.Println("✓ Exists")
-	} else {
-		fmt.Println("✗ Not found")
-		allOk = false
-	}
-
-	fmt.Println()
-	if allOk {
-		fmt.Println("All checks passed. Ready to use.")
+		add("pf.conf", true, true, "Exists")
 	} else {
-		fmt.Println("Some checks failed. saferay may not work correctly.")
+		add("pf.conf", false, true, "Not found")
 	}
 }
 
-func printUsage() {
-	fmt.Println(`saferay - DNS leak protection for macOS with Xray/Hiddify
-
-Usage:
-  saferay install              Install saferay to /usr/local/bin
-  saferay install --light      Install + setup light mode (DNS flush + 8.8.8.8)
-  saferay uninstall            Remove saferay and all configurations
-  saferay check                Check system requirements
-  saferay version              Show version
-
-Light mode (no VPN required):
-  saferay light setup          Setup light mode: DNS flush on reboot + set DNS 8.8.8.8
-  saferay light reset          Remove light mode settings
-  saferay light status         Show light mode status
-
-DNS cache:
-  saferay dns setup            Setup DNS cache flush on reboot
-  saferay dns remove           Remove DNS flush daemon
-  saferay dns status           Check DNS flush daemon status
-  saferay dns flush            Flush DNS cache now
-
-Xray mode (requires VPN):
-  saferay xray install         Install pf rules for Xray DNS protection
-  saferay xray enable          Enable pf firewall with Xray rules
-  saferay xray disable         Disable pf firewall
-  saferay xray reset           Remove all Xray pf rules
-  saferay xray status          Show current pf/Xray status
-  saferay xray auto start      Auto-enable pf when VPN connects (recommended)
-  saferay xray auto stop       Disable auto mode
-  saferay xray auto status     Show auto mode status
+// checkLinux checks for the firewall backend and a tun VPN interface
+func checkLinux(add func(name string, ok, required bool, detail string)) {
+	add("Linux", true, true, "Yes")
 
-Modes:
-  Light mode - Uses Google DNS (8.8.8.8) + DNS flush. No VPN needed.
-  Xray mode  - Forces all DNS through VPN tunnel. Requires Xray/Hiddify.
+	// The backend's tools are required, ip6tables only if IPv6 is on
+	tools := []string{"nft"}
+	if newFirewall().name() == backendIptables {
+		tools = []string{"iptables", "ip6tables"}
+	}
+	for _, tool := range append(tools, "sudo") {
+		_, err := exec.LookPath(tool)
+		switch {
+		case err == nil:
+			add(tool, true, true, "Available")
+		case tool == "ip6tables":
+			add(tool, false, false, "Not found (IPv6 DNS not protected)")
+		default:
+			add(tool, false, true, "Not found")
+		}
+	}
 
-Switching from light to xray: Run 'saferay xray install' - it will
-automatically reset light mode DNS and keep the flush daemon.`)
+	if devices := tunnelDevices(); len(devices) > 0 {
+		add("VPN tunnel", true, false, fmt.Sprintf("Found %s", strings.Join(devices, ", ")))
+	} else {
+		add("VPN tunnel", false, false, "No tun interfaces (start VPN first)")
+	}
 }
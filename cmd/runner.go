@@ -0,0 +1,216 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// runner is the single path for commands and file writes that modify the
+// system. Each change is recorded in the audit log. In dry-run mode it
+// prints what would happen instead of doing it. Read-only queries (pfctl
+// -s, launchctl list, networksetup -get...) don't go through the runner.
+type runner struct {
+	dryRun  bool
+	verbose bool
+}
+
+var sys = &runner{}
+
+// run executes a command attached to the terminal
+func (r *runner) run(args ...string) error {
+	args = r.asRoot(args)
+	if r.dryRun {
+		r.show("[dry-run]", args)
+		return nil
+	}
+	if r.verbose {
+		r.show("+", args)
+	}
+
+	state := auditState(unsudo(args))
+	before := auditValue(state)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Stdin = os.Stdin
+	err := cmd.Run()
+
+	r.audit(auditExec, unsudo(args), before, auditValue(state), err)
+	return err
+}
+
+// quiet executes a command without printing its output. On failure the
+// output is returned in the error. Stdin stays attached so sudo can prompt
+// for a password.
+func (r *runner) quiet(args ...string) error {
+	args = r.asRoot(args)
+	if r.dryRun {
+		r.show("[dry-run]", args)
+		return nil
+	}
+
+	state := auditState(unsudo(args))
+	before := auditValue(state)
+	err := r.exec(args)
+	r.audit(auditExec, unsudo(args), before, auditValue(state), err)
+	return err
+}
+
+// exec runs a command like quiet, without recording it; the file
+// operations below record the change itself instead
+func (r *runner) exec(args []string) error {
+	if r.verbose {
+		r.show("+", args)
+	}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(strings.TrimSpace(string(out))) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+// writeFile installs content at path as root with the given permissions.
+// In dry-run mode it prints a diff against the current file instead.
+func (r *runner) writeFile(path string, content []byte, perm os.FileMode) error {
+	return r.install(path, content, perm, nil)
+}
+
+// writeFileLike installs content at path like writeFile, but with the
+// permissions, owner and group of like, so a user's file stays theirs
+func (r *runner) writeFileLike(path string, content []byte, like string) error {
+	info, err := os.Stat(like)
+	if err != nil {
+		return err
+	}
+	var owner []string
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		owner = []string{"-o", strconv.Itoa(int(stat.Uid)), "-g", strconv.Itoa(int(stat.Gid))}
+	}
+	return r.install(path, content, info.Mode().Perm(), owner)
+}
+
+// install writes content to path with install(1); owner are its -o and
+// -g flags, if any
+func (r *runner) install(path string, content []byte, perm os.FileMode, owner []string) error {
+	if r.dryRun {
+		old, err := os.ReadFile(path)
+		state := "modify"
+		if os.IsNotExist(err) {
+			state = "create"
+		}
+		fmt.Printf("[dry-run] %s %s (mode %04o)\n", state, path, perm)
+		fmt.Print(unifiedDiff(path, string(old), string(content)))
+		return nil
+	}
+
+	tmp, err := os.CreateTemp("", "saferay-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	before := fileHash(path)
+	if _, err := os.Stat(filepath.Dir(path)); os.IsNotExist(err) {
+		if err := r.exec(r.asRoot([]string{"sudo", "mkdir", "-p", filepath.Dir(path)})); err != nil {
+			return err
+		}
+	}
+
+	// install(1) copies as root, so without owner the file ends up
+	// root-owned
+	args := append([]string{"sudo", "install", "-m", fmt.Sprintf("%04o", perm)}, owner...)
+	err = r.exec(r.asRoot(append(args, tmp.Name(), path)))
+	after := contentHash(content)
+	if err != nil {
+		after = fileHash(path)
+	}
+	r.audit(auditWrite, []string{path}, before, after, err)
+	return err
+}
+
+// removeFile deletes path as root if it exists
+func (r *runner) removeFile(path string) error {
+	if _, err := os.Lstat(path); os.IsNotExist(err) {
+		return nil
+	}
+	if r.dryRun {
+		r.show("[dry-run]", []string{"sudo", "rm", "-rf", path})
+		return nil
+	}
+
+	before := fileHash(path)
+	err := r.exec(r.asRoot([]string{"sudo", "rm", "-rf", path}))
+	r.audit(auditRemove, []string{path}, before, fileHash(path), err)
+	return err
+}
+
+// audit records a change the runner made
+func (r *runner) audit(action string, target []string, before, after string, err error) {
+	e := newAuditEntry(action, strings.Join(target, " "))
+	e.Before, e.After = before, after
+	if err != nil {
+		e.Error = err.Error()
+	}
+	appendAudit(e)
+}
+
+// auditValue runs a state query from auditState, if there is one
+func auditValue(state func() string) string {
+	if state == nil {
+		return ""
+	}
+	return state()
+}
+
+// asRoot drops a leading sudo when already running as root, as the daemons
+// do. Their units set NoNewPrivileges, which sudo refuses to run under.
+func (r *runner) asRoot(args []string) []string {
+	if len(args) > 1 && args[0] == "sudo" && os.Geteuid() == 0 {
+		return args[1:]
+	}
+	return args
+}
+
+// unsudo drops a leading sudo, for recording the command itself
+func unsudo(args []string) []string {
+	if len(args) > 1 && args[0] == "sudo" {
+		return args[1:]
+	}
+	return args
+}
+
+// sudoQuery builds a read-only query that needs root, for callers that
+// may themselves run as root
+func sudoQuery(args ...string) *exec.Cmd {
+	args = sys.asRoot(append([]string{"sudo"}, args...))
+	return exec.Command(args[0], args[1:]...)
+}
+
+// show prints a command line with a prefix, quoting arguments as needed
+func (r *runner) show(prefix string, args []string) {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\"'") {
+			arg = fmt.Sprintf("%q", arg)
+		}
+		quoted[i] = arg
+	}
+	fmt.Printf("%s %s\n", prefix, strings.Join(quoted, " "))
+}
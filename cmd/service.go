@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// xrayLogPath is written and rotated by the watch daemon itself
+	xrayLogPath = "/var/log/saferay-xray.log"
+	// xrayOutputPath catches the daemon's stdout and stderr
+	xrayOutputPath = "/var/log/saferay-xray.out"
+	// serviceBinary is what daemons run; 'saferay install' puts it there
+	serviceBinary = installPath
+)
+
+// service describes a daemon saferay runs as root. Each service manager
+// renders it in its own format.
+type service struct {
+	// Name is the short name, e.g. "dnsflush" becomes com.saferay.dnsflush
+	// for launchd and saferay-dnsflush.service for systemd
+	Name        string
+	Description string
+	// Args is the program and its arguments
+	Args []string
+	// Env is extra environment for the program
+	Env map[string]string
+	// KeepAlive restarts the daemon when it exits. Without it the daemon
+	// runs once at boot.
+	KeepAlive bool
+	// Throttle is the minimum seconds between restarts
+	Throttle int
+	// LogPath receives stdout and stderr; empty discards them
+	LogPath string
+	// Writable are extra paths a hardened systemd unit may write
+	Writable []string
+	// Create are files a systemd unit creates before its sandbox applies,
+	// so they are there for Writable to open up
+	Create []string
+	// ReadHome lets a hardened systemd unit read home directories, where
+	// Hiddify keeps the client config, including ones closed to others
+	ReadHome bool
+	// Setup is the saferay command that installs the service
+	Setup string
+	// Capabilities bound what root may do under systemd
+	Capabilities []string
+	// After orders the systemd unit after other units
+	After []string
+}
+
+// serviceManager installs and queries daemons: launchd on macOS,
+// systemd on Linux
+type serviceManager interface {
+	name() string
+	// path is where the service definition is installed
+	path(s service) string
+	render(s service) string
+
+	// install writes the definition, replacing an old one, and loads it
+	install(s service) error
+	// remove stops the service and deletes its definition
+	remove(s service) error
+	status(s service) serviceStatus
+}
+
+// serviceStatus is the state of a daemon
+type serviceStatus struct {
+	Installed bool `json:"installed"`
+	Loaded    bool `json:"loaded"`
+	Running   bool `json:"running"`
+	PID       int  `json:"pid,omitempty"`
+	// Runs counts starts since the service was loaded
+	Runs     int    `json:"runs,omitempty"`
+	LastExit string `json:"last_exit,omitempty"`
+	// Drift lists how the installed definition differs from what this
+	// version would install, e.g. a binary path from an old install
+	Drift []string `json:"drift,omitempty"`
+	// Issues are health problems such as crash loops, each saying what
+	// to do about it
+	Issues []string `json:"issues,omitempty"`
+}
+
+// problem returns the first drift or health issue, if any
+func (st serviceStatus) problem() string {
+	if len(st.Issues) > 0 {
+		return st.Issues[0]
+	}
+	if len(st.Drift) > 0 {
+		return "out of date: " + st.Drift[0]
+	}
+	return ""
+}
+
+// printIssues lists drift and health issues under a status line
+func (st serviceStatus) printIssues(s service) {
+	for _, d := range st.Drift {
+		fmt.Printf("  ⚠ %s\n", d)
+	}
+	if len(st.Drift) > 0 {
+		fmt.Printf("  Run '%s' to reinstall it\n", s.Setup)
+	}
+	for _, issue := range st.Issues {
+		fmt.Printf("  ⚠ %s\n", issue)
+	}
+}
+
+// crashLoopIssue describes a daemon that keeps exiting
+func crashLoopIssue(s service, runs int, lastExit string) string {
+	where := "the system log"
+	if s.LogPath != "" {
+		where = s.LogPath
+	}
+	return fmt.Sprintf("daemon keeps exiting (%d runs, last exit %s); check %s", runs, lastExit, where)
+}
+
+// staleBinary reports whether the process was started from an older copy
+// of program, i.e. saferay was upgraded without restarting the daemon
+func staleBinary(pid int, program string) bool {
+	if runtime.GOOS == "linux" {
+		// The kernel marks the executable once the file is replaced
+		exe, err := os.Readlink(fmt.Sprintf("/proc/%d/exe", pid))
+		return err == nil && strings.HasSuffix(exe, " (deleted)")
+	}
+
+	info, err := os.Stat(program)
+	if err != nil {
+		return false
+	}
+	out, err := exec.Command("ps", "-o", "lstart=", "-p", strconv.Itoa(pid)).Output()
+	if err != nil {
+		return false
+	}
+	started, err := time.ParseInLocation("Mon Jan _2 15:04:05 2006", strings.TrimSpace(string(out)), time.Local)
+	return err == nil && info.ModTime().After(started)
+}
+
+// staleBinaryIssue describes a daemon still running a replaced binary
+func staleBinaryIssue(s service) string {
+	return fmt.Sprintf("daemon is running an older saferay binary; run '%s' to restart it", s.Setup)
+}
+
+func newServiceManager() serviceManager {
+	if runtime.GOOS == "linux" {
+		return systemdManager{}
+	}
+	return launchdManager{}
+}
+
+// dnsFlushService flushes the DNS cache at boot
+func dnsFlushService() service {
+	return dnsFlushServiceFor(runtime.GOOS)
+}
+
+// dnsFlushServiceFor is dnsFlushService as built for goos
+func dnsFlushServiceFor(goos string) service {
+	s := service{
+		Name:        "dnsflush",
+		Description: "saferay DNS cache flush",
+		Args:        []string{"/bin/bash", "-c", "dscacheutil -flushcache; killall -HUP mDNSResponder"},
+		Setup:       "saferay dns setup",
+	}
+	if goos == "linux" {
+		s.Args = []string{"/usr/bin/resolvectl", "flush-caches"}
+		s.After = []string{"systemd-resolved.service"}
+	}
+	return s
+}
+
+// autoService runs the VPN watch loop for auto mode
+func autoService() service {
+	return service{
+		Name:        "xray-auto",
+		Description: "saferay VPN watch (auto mode)",
+		Args:        []string{serviceBinary, "xray", "watch"},
+		KeepAlive:   true,
+		Throttle:    int(watchInterval.Seconds()),
+		LogPath:     xrayOutputPath,
+		// For the log file and its rotated copies, and the lock legacy
+		// iptables-restore takes, which /run loses at boot
+		Writable: []string{"/var/log", "/run/xtables.lock"},
+		Create:   []string{"/run/xtables.lock"},
+		// The daemon reads the client config, which may be Hiddify's
+		ReadHome: true,
+		Setup:    "saferay xray auto start",
+		// nft and iptables need CAP_NET_ADMIN; legacy iptables also opens
+		// a raw socket
+		Capabilities: []string{"CAP_NET_ADMIN", "CAP_NET_RAW"},
+		After:        []string{"network-online.target"},
+	}
+}
@@ -0,0 +1,207 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// launchDaemonsDir is a variable so tests can install elsewhere
+var launchDaemonsDir = "/Library/LaunchDaemons"
+
+// launchdManager installs services as launch daemons
+type launchdManager struct{}
+
+func (launchdManager) name() string { return "launchd" }
+
+func (launchdManager) label(s service) string { return "com.saferay." + s.Name }
+
+func (m launchdManager) path(s service) string {
+	return launchDaemonsDir + "/" + m.label(s) + ".plist"
+}
+
+// plist builds the launchd definition of a service
+func (m launchdManager) plist(s service) launchdPlist {
+	p := launchdPlist{
+		Label:            m.label(s),
+		ProgramArguments: s.Args,
+		Environment:      s.Env,
+		RunAtLoad:        true,
+		KeepAlive:        s.KeepAlive,
+		ThrottleInterval: s.Throttle,
+	}
+	if s.LogPath != "" {
+		p.StandardOutPath = s.LogPath
+		p.StandardErrorPath = s.LogPath
+	}
+	return p
+}
+
+func (m launchdManager) render(s service) string {
+	return m.plist(s).encode()
+}
+
+func (m launchdManager) install(s service) error {
+	path := m.path(s)
+
+	// Unload the old definition so launchd picks up changes
+	if _, err := os.Stat(path); err == nil {
+		_ = sys.quiet("sudo", "launchctl", "unload", "-w", path)
+	}
+
+	if err := sys.writeFile(path, []byte(m.render(s)), 0644); err != nil {
+		return fmt.Errorf("writing plist: %w", err)
+	}
+
+	cmds := [][]string{
+		{"sudo", "chown", "root:wheel", path},
+		{"sudo", "launchctl", "load", "-w", path},
+	}
+	for _, args := range cmds {
+		if err := sys.quiet(args...); err != nil {
+			return fmt.Errorf("running %v: %w", args, err)
+		}
+	}
+	return nil
+}
+
+func (m launchdManager) remove(s service) error {
+	_ = sys.quiet("sudo", "launchctl", "unload", "-w", m.path(s))
+	return sys.removeFile(m.path(s))
+}
+
+func (m launchdManager) status(s service) serviceStatus {
+	var st serviceStatus
+	if _, err := os.Stat(m.path(s)); os.IsNotExist(err) {
+		return st
+	}
+	st.Installed = true
+
+	out, err := sudoQuery("launchctl", "print", "system/"+m.label(s)).CombinedOutput()
+	if err == nil {
+		job := parseLaunchctlPrint(string(out))
+		st.Loaded = true
+		st.Running = job.PID > 0
+		st.PID, st.Runs, st.LastExit = job.PID, job.Runs, job.LastExit
+		st.Issues = job.issues(s)
+	}
+
+	if m.disabled(s) {
+		st.Issues = append(st.Issues, fmt.Sprintf("launchd has the service disabled; run 'sudo launchctl enable system/%s'", m.label(s)))
+	}
+
+	st.Drift = m.drift(s)
+	return st
+}
+
+// launchdJob is the part of 'launchctl print' output status uses
+type launchdJob struct {
+	// State is e.g. "running", "not running" or "spawn scheduled"
+	State    string
+	PID      int
+	Runs     int
+	LastExit string
+	Program  string
+}
+
+// parseLaunchctlPrint reads the top-level "key = value" lines of
+// 'launchctl print system/<label>', skipping nested blocks
+func parseLaunchctlPrint(out string) launchdJob {
+	var job launchdJob
+	depth := 0
+
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasSuffix(line, "{"):
+			depth++
+			continue
+		case line == "}":
+			depth--
+			continue
+		case depth != 1:
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, " = ")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "state":
+			job.State = value
+		case "pid":
+			job.PID, _ = strconv.Atoi(value)
+		case "runs":
+			job.Runs, _ = strconv.Atoi(value)
+		case "last exit code":
+			// "(never exited)" or "78: EX_CONFIG"
+			if !strings.HasPrefix(value, "(") {
+				job.LastExit = value
+			}
+		case "last terminating signal":
+			job.LastExit = value
+		case "program":
+			job.Program = value
+		}
+	}
+
+	return job
+}
+
+// issues turns the job state into actionable problems
+func (job launchdJob) issues(s service) []string {
+	var issues []string
+	failed := job.LastExit != "" && job.LastExit != "0"
+
+	switch {
+	case s.KeepAlive && job.PID == 0 && job.Runs > 1 && failed:
+		issue := crashLoopIssue(s, job.Runs, job.LastExit)
+		if job.State == "spawn scheduled" {
+			issue += " (launchd is throttling restarts)"
+		}
+		issues = append(issues, issue)
+	case !s.KeepAlive && failed:
+		issues = append(issues, fmt.Sprintf("last run exited with %s; run '%s' to retry", job.LastExit, s.Setup))
+	}
+
+	if job.PID > 0 && staleBinary(job.PID, job.Program) {
+		issues = append(issues, staleBinaryIssue(s))
+	}
+	return issues
+}
+
+// disabled checks launchd's override database, which 'launchctl disable'
+// writes and which stops the plist loading at boot
+func (m launchdManager) disabled(s service) bool {
+	out, _ := sudoQuery("launchctl", "print-disabled", "system").CombinedOutput()
+	for _, line := range strings.Split(string(out), "\n") {
+		// "com.saferay.xray-auto" => disabled (or => true before macOS 13)
+		key, value, ok := strings.Cut(strings.TrimSpace(line), " => ")
+		if ok && strings.Trim(key, `"`) == m.label(s) {
+			return value == "disabled" || value == "true"
+		}
+	}
+	return false
+}
+
+// drift compares the installed plist with the one install would write
+func (m launchdManager) drift(s service) []string {
+	data, err := os.ReadFile(m.path(s))
+	if err != nil {
+		return []string{err.Error()}
+	}
+	installed, err := parseLaunchdPlist(data)
+	if err != nil {
+		return []string{fmt.Sprintf("%s: %v", m.path(s), err)}
+	}
+
+	drift := installed.diff(m.plist(s))
+	if len(installed.ProgramArguments) > 0 {
+		if _, err := os.Stat(installed.ProgramArguments[0]); err != nil {
+			drift = append(drift, fmt.Sprintf("program %s not found", installed.ProgramArguments[0]))
+		}
+	}
+	return drift
+}
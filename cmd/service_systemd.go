@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+const systemdUnitDir = "/etc/systemd/system"
+
+// systemdManager installs services as hardened system units
+type systemdManager struct{}
+
+func (systemdManager) name() string { return "systemd" }
+
+func (systemdManager) unit(s service) string { return "saferay-" + s.Name + ".service" }
+
+func (m systemdManager) path(s service) string {
+	return systemdUnitDir + "/" + m.unit(s)
+}
+
+func (systemdManager) render(s service) string {
+	var b strings.Builder
+
+	b.WriteString("[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s\n", s.Description)
+	if len(s.After) > 0 {
+		fmt.Fprintf(&b, "Wants=%s\n", strings.Join(s.After, " "))
+		fmt.Fprintf(&b, "After=%s\n", strings.Join(s.After, " "))
+	}
+
+	b.WriteString("\n[Service]\n")
+	if s.KeepAlive {
+		b.WriteString("Type=simple\nRestart=always\n")
+		if s.Throttle > 0 {
+			fmt.Fprintf(&b, "RestartSec=%d\n", s.Throttle)
+		}
+	} else {
+		// Stays active after running, so status reports it like launchd
+		b.WriteString("Type=oneshot\nRemainAfterExit=yes\n")
+	}
+	quoted := make([]string, len(s.Args))
+	for i, arg := range s.Args {
+		quoted[i] = systemdQuote(arg)
+	}
+	for _, path := range s.Create {
+		// + runs it outside the sandbox, where /run is writable
+		fmt.Fprintf(&b, "ExecStartPre=+/bin/touch %s\n", systemdQuote(path))
+	}
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(quoted, " "))
+	for _, kv := range envPairs(s.Env) {
+		fmt.Fprintf(&b, "Environment=%s\n", systemdQuote(kv))
+	}
+	if s.LogPath != "" {
+		fmt.Fprintf(&b, "StandardOutput=append:%s\n", s.LogPath)
+		fmt.Fprintf(&b, "StandardError=append:%s\n", s.LogPath)
+	}
+
+	// Runs as root, but only with the listed capabilities and with the
+	// file system read-only apart from saferay's own state
+	b.WriteString("\n")
+	caps := s.Capabilities
+	if s.ReadHome {
+		// Homes are often 0700 or 0750, which root can only enter by
+		// bypassing permission checks
+		caps = append(caps[:len(caps):len(caps)], "CAP_DAC_READ_SEARCH")
+	}
+	fmt.Fprintf(&b, "CapabilityBoundingSet=%s\n", strings.Join(caps, " "))
+	// StateDirectory creates and opens up /var/lib/saferay, for the audit log
+	fmt.Fprintf(&b, "NoNewPrivileges=yes\nProtectSystem=strict\nStateDirectory=saferay\nReadWritePaths=-%s", configDir)
+	for _, path := range s.Writable {
+		fmt.Fprintf(&b, " -%s", path)
+	}
+	protectHome := "yes"
+	if s.ReadHome {
+		protectHome = "read-only"
+	}
+	fmt.Fprintf(&b, "\nProtectHome=%s", protectHome)
+	b.WriteString(`
+PrivateTmp=yes
+PrivateDevices=yes
+ProtectKernelModules=yes
+ProtectKernelTunables=yes
+ProtectControlGroups=yes
+RestrictAddressFamilies=AF_UNIX AF_NETLINK AF_INET AF_INET6
+RestrictNamespaces=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+`)
+
+	b.WriteString("\n[Install]\nWantedBy=multi-user.target\n")
+	return b.String()
+}
+
+func (m systemdManager) install(s service) error {
+	if err := sys.writeFile(m.path(s), []byte(m.render(s)), 0644); err != nil {
+		return fmt.Errorf("writing unit: %w", err)
+	}
+
+	cmds := [][]string{
+		{"sudo", "systemctl", "daemon-reload"},
+		{"sudo", "systemctl", "enable", m.unit(s)},
+		// restart rather than start, so a changed unit takes effect
+		{"sudo", "systemctl", "restart", m.unit(s)},
+	}
+	for _, args := range cmds {
+		if err := sys.quiet(args...); err != nil {
+			return fmt.Errorf("running %v: %w", args, err)
+		}
+	}
+	return nil
+}
+
+func (m systemdManager) remove(s service) error {
+	if _, err := os.Stat(m.path(s)); os.IsNotExist(err) {
+		return nil
+	}
+	_ = sys.quiet("sudo", "systemctl", "disable", "--now", m.unit(s))
+	if err := sys.removeFile(m.path(s)); err != nil {
+		return err
+	}
+	return sys.quiet("sudo", "systemctl", "daemon-reload")
+}
+
+func (m systemdManager) status(s service) serviceStatus {
+	var st serviceStatus
+	if _, err := os.Stat(m.path(s)); os.IsNotExist(err) {
+		return st
+	}
+	st.Installed = true
+
+	out, _ := exec.Command("systemctl", "show", m.unit(s),
+		"-p", "UnitFileState,ActiveState,SubState,MainPID,NRestarts,ExecMainStatus,ExecMainCode").Output()
+	props := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			props[key] = value
+		}
+	}
+
+	st.Loaded = props["UnitFileState"] == "enabled"
+	st.Running = props["ActiveState"] == "active"
+	st.PID, _ = strconv.Atoi(props["MainPID"])
+	restarts, _ := strconv.Atoi(props["NRestarts"])
+	st.Runs = restarts + 1
+	// ExecMainCode 0 means it never exited
+	if props["ExecMainCode"] != "" && props["ExecMainCode"] != "0" {
+		st.LastExit = props["ExecMainStatus"]
+	}
+
+	failed := st.LastExit != "" && st.LastExit != "0"
+	switch {
+	case props["UnitFileState"] == "masked":
+		st.Issues = append(st.Issues, fmt.Sprintf("unit is masked; run 'sudo systemctl unmask %s' then '%s'", m.unit(s), s.Setup))
+	case props["UnitFileState"] == "disabled":
+		st.Issues = append(st.Issues, fmt.Sprintf("unit is disabled; run 'sudo systemctl enable --now %s'", m.unit(s)))
+	}
+	switch {
+	case s.KeepAlive && (props["SubState"] == "auto-restart" || props["ActiveState"] == "failed") && failed:
+		st.Issues = append(st.Issues, crashLoopIssue(s, st.Runs, st.LastExit))
+	case !s.KeepAlive && failed:
+		st.Issues = append(st.Issues, fmt.Sprintf("last run exited with %s; run '%s' to retry", st.LastExit, s.Setup))
+	}
+	if st.PID > 0 && staleBinary(st.PID, s.Args[0]) {
+		st.Issues = append(st.Issues, staleBinaryIssue(s))
+	}
+
+	// Units are only ever written by saferay, so any difference is drift
+	if installed, err := os.ReadFile(m.path(s)); err == nil && string(installed) != m.render(s) {
+		st.Drift = append(st.Drift, fmt.Sprintf("%s differs from this version's unit", m.path(s)))
+	}
+	if len(s.Args) > 0 {
+		if _, err := os.Stat(s.Args[0]); err != nil {
+			st.Drift = append(st.Drift, fmt.Sprintf("program %s not found", s.Args[0]))
+		}
+	}
+	return st
+}
+
+// systemdQuote quotes an ExecStart argument if it has spaces or quotes
+func systemdQuote(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, " \t\"'\\;") {
+		return arg
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(arg) + `"`
+}
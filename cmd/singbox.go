@@ -0,0 +1,303 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/fs"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// singboxConfigPaths are where sing-box's config.json is installed by its
+// packages and Homebrew
+var singboxConfigPaths = []string{
+	"/etc/sing-box/config.json",
+	"/usr/local/etc/sing-box/config.json",
+	"/opt/homebrew/etc/sing-box/config.json",
+}
+
+// hiddifyDirs returns Hiddify's app data directories, relative to a home.
+// Hiddify runs sing-box and keeps the config it generated for the active
+// profile there.
+func hiddifyDirs() []string {
+	if runtime.GOOS == "linux" {
+		return []string{".local/share/app.hiddify.com"}
+	}
+	return []string{
+		"Library/Application Support/app.hiddify.com",
+		"Library/Containers/app.hiddify.com/Data/Library/Application Support/app.hiddify.com",
+	}
+}
+
+// hiddifyDepth is how deep below its app data directory Hiddify's configs
+// are looked for
+const hiddifyDepth = 3
+
+// singboxConfig is the part of a sing-box config saferay reads. Both the
+// legacy DNS server format and the one of sing-box 1.12 are understood.
+type singboxConfig struct {
+	Inbounds  []singboxBound `json:"inbounds"`
+	Outbounds []singboxBound `json:"outbounds"`
+	// Endpoints hold WireGuard since sing-box 1.11
+	Endpoints []singboxBound `json:"endpoints"`
+	DNS       struct {
+		Servers []singboxDNSServer `json:"servers"`
+	} `json:"dns"`
+	Route struct {
+		// Final is the default outbound
+		Final string `json:"final"`
+	} `json:"route"`
+}
+
+// singboxBound is an inbound, outbound or endpoint
+type singboxBound struct {
+	Type string `json:"type"`
+	Tag  string `json:"tag"`
+
+	// tun inbounds
+	InterfaceName string      `json:"interface_name"`
+	Address       singboxList `json:"address"`
+	Inet4Address  singboxList `json:"inet4_address"`
+	Inet6Address  singboxList `json:"inet6_address"`
+	StrictRoute   bool        `json:"strict_route"`
+
+	// other inbounds
+	Listen     string `json:"listen"`
+	ListenPort int    `json:"listen_port"`
+
+	// outbounds and endpoints
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Peers      []struct {
+		Server     string `json:"server"`
+		ServerPort int    `json:"server_port"`
+		Address    string `json:"address"`
+		Port       int    `json:"port"`
+	} `json:"peers"`
+}
+
+// singboxDNSServer is a server in sing-box's dns block
+type singboxDNSServer struct {
+	Tag string `json:"tag"`
+	// Address is the legacy form, such as tls://1.1.1.1 or local
+	Address string `json:"address"`
+	// Type, Server and ServerPort replace it in sing-box 1.12
+	Type       string `json:"type"`
+	Server     string `json:"server"`
+	ServerPort int    `json:"server_port"`
+	Detour     string `json:"detour"`
+}
+
+// singboxList is a field sing-box accepts as a string or a list
+type singboxList []string
+
+func (l *singboxList) UnmarshalJSON(data []byte) error {
+	var s string
+	if json.Unmarshal(data, &s) == nil {
+		*l = singboxList{s}
+		return nil
+	}
+	return json.Unmarshal(data, (*[]string)(l))
+}
+
+// isSingboxConfig tells a sing-box config from an Xray one: sing-box
+// names an inbound or outbound's kind "type", Xray "protocol"
+func isSingboxConfig(data []byte) bool {
+	var c struct {
+		Inbounds  []map[string]json.RawMessage `json:"inbounds"`
+		Outbounds []map[string]json.RawMessage `json:"outbounds"`
+	}
+	if json.Unmarshal(data, &c) != nil {
+		return false
+	}
+	for _, b := range append(c.Inbounds, c.Outbounds...) {
+		if _, ok := b["type"]; ok {
+			return true
+		}
+		if _, ok := b["protocol"]; ok {
+			return false
+		}
+	}
+	return false
+}
+
+// readSingboxConfig derives the same facts from a sing-box config as
+// readXrayConfig does from an Xray one
+func readSingboxConfig(path string, data []byte) (*xrayInfo, error) {
+	var c singboxConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+
+	info := &xrayInfo{Path: path, Client: clientSingbox, DNSInbounds: []xrayEndpoint{}, Servers: []xrayEndpoint{}, DNSServers: []xrayDNSServer{}}
+	for _, in := range c.Inbounds {
+		switch {
+		case in.Type == "tun":
+			if info.Tunnel == "" {
+				info.Tunnel = in.InterfaceName
+			}
+			info.StrictRoute = info.StrictRoute || in.StrictRoute
+			for _, address := range append(append(in.Address, in.Inet4Address...), in.Inet6Address...) {
+				_, network, err := net.ParseCIDR(address)
+				switch {
+				case err != nil:
+				case tunNetworkTooWide(network):
+					info.WideNetworks = append(info.WideNetworks, network.String())
+				default:
+					info.TunnelNetworks = append(info.TunnelNetworks, network.String())
+				}
+			}
+		case in.Type == "direct" && in.ListenPort == 53:
+			listen := in.Listen
+			if listen == "" || listen == "::" {
+				listen = "0.0.0.0"
+			}
+			info.DNSInbounds = append(info.DNSInbounds, xrayEndpoint{in.Tag, in.Type, listen, in.ListenPort})
+		}
+	}
+
+	for _, out := range append(c.Outbounds, c.Endpoints...) {
+		switch out.Type {
+		case "direct", "block", "dns", "selector", "urltest":
+			continue
+		}
+		if out.Server != "" {
+			info.Servers = append(info.Servers, xrayEndpoint{out.Tag, out.Type, out.Server, out.ServerPort})
+		}
+		for _, peer := range out.Peers {
+			if peer.Server != "" {
+				info.Servers = append(info.Servers, xrayEndpoint{out.Tag, out.Type, peer.Server, peer.ServerPort})
+			}
+			if peer.Address != "" {
+				info.Servers = append(info.Servers, xrayEndpoint{out.Tag, out.Type, peer.Address, peer.Port})
+			}
+		}
+	}
+
+	for _, s := range c.DNS.Servers {
+		info.DNSServers = append(info.DNSServers, c.dnsServer(s))
+	}
+	return info, nil
+}
+
+// dnsServer works out where the queries to a DNS server go
+func (c *singboxConfig) dnsServer(s singboxDNSServer) xrayDNSServer {
+	scheme, host, address := s.Type, s.Server, s.Address
+	switch {
+	case address == "local" || address == "fakeip":
+		scheme = address
+	case address != "":
+		var found bool
+		scheme, host, found = strings.Cut(address, "://")
+		if !found {
+			scheme, host = "udp", address
+		}
+	case host != "":
+		address = scheme + "://" + host
+	default:
+		address = scheme
+	}
+
+	out := xrayDNSServer{Address: address}
+	switch scheme {
+	case "local", "resolved":
+		// The system resolver is subject to the firewall like any app
+		out.Plaintext, out.Via = true, "system"
+		return out
+	case "udp", "tcp", "dhcp":
+		out.Plaintext = true
+	case "tls", "https", "quic", "h3":
+	default:
+		// fakeip, rcode, hosts and the like send nothing
+		return out
+	}
+
+	port := s.ServerPort
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+	if out.Plaintext && port == 0 {
+		port = 53
+	}
+	out.Port = port
+
+	via := c.outbound(s.Detour)
+	out.Via = via.Tag
+	if out.Via == "" {
+		out.Via = via.Type
+	}
+	out.Blocked = out.Plaintext && port == 53 && via.Type == "direct"
+	return out
+}
+
+// outbound returns the outbound tagged tag, or the default one
+func (c *singboxConfig) outbound(tag string) singboxBound {
+	if tag == "" {
+		tag = c.Route.Final
+	}
+	for _, out := range c.Outbounds {
+		if tag == "" || out.Tag == tag {
+			return out
+		}
+	}
+	// The default of a config without outbounds is direct
+	return singboxBound{Tag: tag, Type: "direct"}
+}
+
+// clientConfigs lists the client configs found in the usual places:
+// Xray's and sing-box's system configs and Hiddify's in the user's home
+func clientConfigs() []string {
+	var paths []string
+	for _, path := range append(xrayConfigPaths, singboxConfigPaths...) {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+
+	for _, home := range userHomes() {
+		for _, dir := range hiddifyDirs() {
+			base := filepath.Join(home, dir)
+			_ = filepath.WalkDir(base, func(path string, d fs.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				if d.IsDir() {
+					if strings.Count(strings.TrimPrefix(path, base), string(filepath.Separator)) >= hiddifyDepth {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				if filepath.Ext(path) != ".json" {
+					return nil
+				}
+				// Hiddify keeps preferences and subscriptions in JSON too
+				if data, err := os.ReadFile(path); err == nil && isSingboxConfig(stripJSONComments(data)) {
+					paths = append(paths, path)
+				}
+				return nil
+			})
+		}
+	}
+	return paths
+}
+
+// userHomes lists the home directories client app data may be in: the
+// invoking user's under sudo and this user's. Other users' homes are left
+// alone, as a config there would decide the firewall passes for everyone.
+func userHomes() []string {
+	var homes []string
+	if name := os.Getenv("SUDO_USER"); name != "" {
+		if u, err := user.Lookup(name); err == nil {
+			homes = append(homes, u.HomeDir)
+		}
+	}
+	if home, err := os.UserHomeDir(); err == nil && !contains(homes, home) {
+		homes = append(homes, home)
+	}
+	return homes
+}
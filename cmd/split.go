@@ -0,0 +1,206 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	resolverDir    = "/etc/resolver"
+	resolverMarker = "# Managed by saferay"
+)
+
+// SplitRoute sends queries for Domain to Resolvers instead of the tunnel
+type SplitRoute struct {
+	Domain    string
+	Resolvers []string
+}
+
+func newXraySplitCmd() *cobra.Command {
+	cmd := groupCmd("split", "Resolve domains via LAN resolvers (split DNS)")
+	cmd.AddCommand(
+		&cobra.Command{
+			Use:   "add <domain> <resolver-ip> [resolver-ip...]",
+			Short: "Route a domain to LAN resolvers",
+			Args:  cobra.MinimumNArgs(2),
+			Run: func(cmd *cobra.Command, args []string) {
+				addSplitRoute(args[0], args[1:])
+			},
+		},
+		&cobra.Command{
+			Use:   "remove <domain>",
+			Short: "Remove a split DNS route",
+			Args:  cobra.ExactArgs(1),
+			Run: func(cmd *cobra.Command, args []string) {
+				removeSplitRoute(args[0])
+			},
+		},
+		actionCmd("list", "List split DNS routes", func() {
+			printSplitDNSStatus(getSplitDNSStatus())
+		}),
+	)
+	return cmd
+}
+
+func addSplitRoute(domain string, resolvers []string) {
+	domain = strings.ToLower(strings.Trim(domain, ". "))
+	if domain == "" || strings.ContainsAny(domain, "/= \t") {
+		fmt.Printf("Invalid domain: %q\n", domain)
+		os.Exit(1)
+	}
+	for _, ip := range resolvers {
+		if net.ParseIP(ip) == nil {
+			fmt.Printf("Invalid resolver address: %s\n", ip)
+			os.Exit(1)
+		}
+	}
+
+	cfg := loadConfig()
+	route := SplitRoute{Domain: domain, Resolvers: resolvers}
+	if existing := cfg.splitRoute(domain); existing != nil {
+		*existing = route
+	} else {
+		cfg.SplitDNS = append(cfg.SplitDNS, route)
+	}
+
+	if err := saveConfig(cfg); err != nil {
+		fmt.Printf("Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := writeResolverFile(route); err != nil {
+		fmt.Printf("Error writing resolver: %v\n", err)
+		os.Exit(1)
+	}
+	if err := newFirewall().reload(cfg); err != nil {
+		fmt.Printf("Error updating firewall rules: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Split DNS: *.%s → %s\n", domain, strings.Join(resolvers, ", "))
+}
+
+func removeSplitRoute(domain string) {
+	domain = strings.ToLower(strings.Trim(domain, ". "))
+
+	cfg := loadConfig()
+	var kept []SplitRoute
+	for _, route := range cfg.SplitDNS {
+		if route.Domain != domain {
+			kept = append(kept, route)
+		}
+	}
+	if len(kept) == len(cfg.SplitDNS) {
+		fmt.Printf("No split DNS route for %s\n", domain)
+		os.Exit(1)
+	}
+	cfg.SplitDNS = kept
+
+	if err := saveConfig(cfg); err != nil {
+		fmt.Printf("Error saving config: %v\n", err)
+		os.Exit(1)
+	}
+	removeResolverFile(domain)
+	if err := newFirewall().reload(cfg); err != nil {
+		fmt.Printf("Error updating firewall rules: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("✓ Split DNS route for %s removed\n", domain)
+}
+
+// splitRouteStatus is a configured split DNS route and whether it's in effect
+type splitRouteStatus struct {
+	Domain            string   `json:"domain"`
+	Resolvers         []string `json:"resolvers"`
+	ResolverInstalled bool     `json:"resolver_installed"`
+	PfRuleInstalled   bool     `json:"pf_rule_installed"`
+}
+
+// getSplitDNSStatus checks each configured route against the resolver
+// files and the anchor
+func getSplitDNSStatus() []splitRouteStatus {
+	fw := newFirewall()
+	rules, _ := os.ReadFile(fw.rulesPath())
+
+	routes := []splitRouteStatus{}
+	for _, route := range loadConfig().SplitDNS {
+		st := splitRouteStatus{
+			Domain:            route.Domain,
+			Resolvers:         route.Resolvers,
+			ResolverInstalled: resolverFileMatches(route),
+			PfRuleInstalled:   true,
+		}
+		for _, rule := range fw.splitRules(route) {
+			if !strings.Contains(string(rules), rule) {
+				st.PfRuleInstalled = false
+			}
+		}
+		routes = append(routes, st)
+	}
+	return routes
+}
+
+// printSplitDNSStatus lists configured routes and whether each is in effect
+func printSplitDNSStatus(routes []splitRouteStatus) {
+	if len(routes) == 0 {
+		fmt.Println("\nSplit DNS:       none")
+		return
+	}
+
+	fmt.Println("\nSplit DNS:")
+	for _, route := range routes {
+		state := "✓ active"
+		switch {
+		case !route.ResolverInstalled && !route.PfRuleInstalled:
+			state = "✗ not installed"
+		case !route.ResolverInstalled:
+			state = "⚠ /etc/resolver file missing or changed"
+		case !route.PfRuleInstalled:
+			state = "⚠ pf pass rule missing (run 'saferay xray install')"
+		}
+		fmt.Printf("  %-24s → %-30s %s\n", route.Domain, strings.Join(route.Resolvers, ", "), state)
+	}
+}
+
+// splitRoute returns the route for domain, or nil
+func (c *Config) splitRoute(domain string) *SplitRoute {
+	for i := range c.SplitDNS {
+		if c.SplitDNS[i].Domain == domain {
+			return &c.SplitDNS[i]
+		}
+	}
+	return nil
+}
+
+func resolverFileContent(route SplitRoute) string {
+	var b strings.Builder
+	b.WriteString(resolverMarker + "\n")
+	for _, ip := range route.Resolvers {
+		fmt.Fprintf(&b, "nameserver %s\n", ip)
+	}
+	return b.String()
+}
+
+func resolverFileMatches(route SplitRoute) bool {
+	content, err := os.ReadFile(resolverDir + "/" + route.Domain)
+	return err == nil && string(content) == resolverFileContent(route)
+}
+
+// writeResolverFile installs /etc/resolver/<domain> with sudo
+func writeResolverFile(route SplitRoute) error {
+	return sys.writeFile(resolverDir+"/"+route.Domain, []byte(resolverFileContent(route)), 0644)
+}
+
+// removeResolverFile deletes /etc/resolver/<domain> if saferay created it
+func removeResolverFile(domain string) {
+	path := resolverDir + "/" + domain
+	content, err := os.ReadFile(path)
+	if err != nil || !strings.HasPrefix(string(content), resolverMarker) {
+		return
+	}
+	_ = sys.removeFile(path)
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/syslog"
+	"net"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Where the daemon log goes, for the log_sink config key
+const (
+	sinkFile   = "file"
+	sinkSystem = "system"
+	sinkBoth   = "both"
+)
+
+// logSubsystem identifies saferay in the system log: the os_log subsystem
+// on macOS, SYSLOG_IDENTIFIER in journald
+const (
+	logSubsystem  = "com.saferay"
+	logIdentifier = "saferay"
+)
+
+// logSink is a system log that receives daemon log entries
+type logSink interface {
+	write(e logEntry) error
+	close() error
+}
+
+// newSystemLogSink opens the platform's system log: journald on Linux,
+// the unified log on macOS
+func newSystemLogSink() (logSink, error) {
+	if runtime.GOOS == "linux" {
+		return newJournaldSink()
+	}
+	if sink, err := newOSLogSink(); err == nil {
+		return sink, nil
+	}
+	// Built without cgo: syslog messages still reach the unified log,
+	// under the saferay process instead of the subsystem
+	return newSyslogSink()
+}
+
+// systemLogHint says how to read the system log
+func systemLogHint() string {
+	if runtime.GOOS == "linux" {
+		return "journalctl -t " + logIdentifier
+	}
+	return fmt.Sprintf("log show --predicate 'subsystem == \"%s\" OR process == \"saferay\"' --last 1h", logSubsystem)
+}
+
+// syslogSink writes entries through syslog(3)
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+func newSyslogSink() (logSink, error) {
+	w, err := syslog.New(syslog.LOG_DAEMON|syslog.LOG_INFO, logIdentifier)
+	if err != nil {
+		return nil, err
+	}
+	return syslogSink{w}, nil
+}
+
+func (s syslogSink) write(e logEntry) error {
+	line := e.logfmt()
+	switch e.Level {
+	case levelError:
+		return s.w.Err(line)
+	case levelWarn:
+		return s.w.Warning(line)
+	}
+	return s.w.Info(line)
+}
+
+func (s syslogSink) close() error { return s.w.Close() }
+
+// journaldSocket is journald's native protocol socket
+const journaldSocket = "/run/systemd/journal/socket"
+
+// journaldSink sends entries to journald with each field as a journal
+// field, e.g. SAFERAY_EVENT=vpn_up, so they can be filtered with journalctl
+type journaldSink struct {
+	conn *net.UnixConn
+}
+
+func newJournaldSink() (logSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return journaldSink{conn}, nil
+}
+
+func (s journaldSink) write(e logEntry) error {
+	// syslog priorities: err, warning, info
+	priority := "6"
+	switch e.Level {
+	case levelError:
+		priority = "3"
+	case levelWarn:
+		priority = "4"
+	}
+
+	fields := map[string]string{
+		"MESSAGE":           e.Msg,
+		"PRIORITY":          priority,
+		"SYSLOG_IDENTIFIER": logIdentifier,
+		"SAFERAY_EVENT":     e.Event,
+	}
+	for k, v := range e.Fields {
+		fields["SAFERAY_"+journaldFieldName(k)] = v
+	}
+
+	_, err := s.conn.Write(journaldMessage(fields))
+	return err
+}
+
+func (s journaldSink) close() error { return s.conn.Close() }
+
+// journaldFieldName makes a key valid as a journal field name, which
+// allows only uppercase letters, digits and underscores
+func journaldFieldName(key string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+}
+
+// journaldMessage encodes fields in journald's native format: KEY=value
+// lines, or KEY, newline, little-endian length and value for values that
+// contain newlines
+func journaldMessage(fields map[string]string) []byte {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		v := fields[k]
+		if !strings.Contains(v, "\n") {
+			fmt.Fprintf(&b, "%s=%s\n", k, v)
+			continue
+		}
+		b.WriteString(k + "\n")
+		_ = binary.Write(&b, binary.LittleEndian, uint64(len(v)))
+		b.WriteString(v + "\n")
+	}
+	return b.Bytes()
+}
@@ -0,0 +1,380 @@
+package cmd
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// vpnClientProcesses maps the process names of known VPN clients, in
+// lower case, to the client they belong to. GUI clients such as Hiddify
+// and v2rayN run one of the cores too.
+var vpnClientProcesses = map[string]string{
+	"xray":                      "Xray",
+	"v2ray":                     "V2Ray",
+	"sing-box":                  "sing-box",
+	"hiddify":                   "Hiddify",
+	"hiddifycli":                "Hiddify",
+	"hiddify-core":              "Hiddify",
+	"hiddifyservice":            "Hiddify",
+	"v2rayn":                    "v2rayN",
+	"wireguard":                 "WireGuard",
+	"wireguard-go":              "WireGuard",
+	"wireguardnetworkextension": "WireGuard",
+	"openvpn":                   "OpenVPN",
+}
+
+// vpnClient is a running VPN client process
+type vpnClient struct {
+	Name          string `json:"name"`
+	Process       string `json:"process"`
+	PID           int    `json:"pid"`
+	UptimeSeconds int64  `json:"uptime_seconds"`
+	// Tunnel is the interface the process holds, when that can be seen
+	Tunnel string `json:"tunnel,omitempty"`
+}
+
+func (c vpnClient) String() string {
+	s := fmt.Sprintf("%s (%s, pid %d, up %s)", c.Name, c.Process, c.PID, formatUptime(c.UptimeSeconds))
+	if c.Tunnel != "" {
+		s += " on " + c.Tunnel
+	}
+	return s
+}
+
+// vpnState is what VPN detection found
+type vpnState struct {
+	// TunnelUp is the interface check alone
+	TunnelUp bool
+	// Connected also requires a process serving the tunnel
+	Connected bool
+	// Tunnels are the interfaces the VPN is on
+	Tunnels []string
+	Clients []vpnClient
+}
+
+// detectVPN checks for an up tunnel and the client serving it. A client
+// that crashed can leave its tunnel or its DNS settings behind; with
+// nothing serving them, the VPN counts as disconnected.
+func detectVPN() vpnState {
+	cfg := loadConfig()
+	var st vpnState
+	if st.TunnelUp = tunnelUp(cfg); !st.TunnelUp {
+		return st
+	}
+	st.Tunnels = vpnTunnels(cfg)
+	st.Clients = runningVPNClients()
+	st.Connected = st.own()
+	return st
+}
+
+// owner returns the client holding the VPN tunnel, or else the first
+// client running
+func (s vpnState) owner() *vpnClient {
+	for i, c := range s.Clients {
+		if c.Tunnel != "" && contains(s.Tunnels, c.Tunnel) {
+			return &s.Clients[i]
+		}
+	}
+	if len(s.Clients) > 0 {
+		return &s.Clients[0]
+	}
+	return nil
+}
+
+// ownerCache keeps what lsof found on macOS, where scanning every process
+// takes too long to repeat on each watch tick. It holds while the tunnels
+// and the client pids stay the same.
+var ownerCache struct {
+	key    string
+	owners map[int]string
+	served bool
+}
+
+// own finds the tunnel each client holds and checks that a process
+// serves one of the VPN tunnels
+func (s *vpnState) own() bool {
+	pids := make([]int, len(s.Clients))
+	key := strings.Join(s.Tunnels, ",")
+	for i, c := range s.Clients {
+		pids[i] = c.PID
+		key += " " + strconv.Itoa(c.PID)
+	}
+
+	if runtime.GOOS == "linux" {
+		// The auto daemon can't see owners; carrier still tells whether
+		// a process serves the tunnel
+		if procFdsReadable() {
+			owners, _ := tunnelOwners(pids)
+			s.setTunnels(owners)
+		}
+		return s.clientServes() || tunServed(s.Tunnels)
+	}
+
+	if os.Geteuid() != 0 {
+		// Other users' sockets can't be seen; trust the interface
+		if len(pids) > 0 {
+			owners, _ := tunnelOwners(pids)
+			s.setTunnels(owners)
+		}
+		return len(s.Tunnels) > 0
+	}
+	if len(s.Tunnels) == 0 {
+		// Only scutil's DNS settings are left of the VPN
+		return false
+	}
+	if ownerCache.owners != nil && ownerCache.key == key {
+		s.setTunnels(ownerCache.owners)
+		return ownerCache.served
+	}
+
+	// Scanning every process also finds clients saferay doesn't know
+	owners, err := tunnelOwners(nil)
+	if err != nil {
+		// Without lsof keep to the interface check rather than drop
+		// protection
+		return true
+	}
+	s.setTunnels(owners)
+	served := false
+	for _, tunnel := range owners {
+		served = served || contains(s.Tunnels, tunnel)
+	}
+	ownerCache.key, ownerCache.owners, ownerCache.served = key, owners, served
+	return served
+}
+
+// setTunnels sets the tunnel of each client from owners
+func (s *vpnState) setTunnels(owners map[int]string) {
+	for i := range s.Clients {
+		s.Clients[i].Tunnel = owners[s.Clients[i].PID]
+	}
+}
+
+// clientServes checks that a client holds one of the VPN tunnels
+func (s vpnState) clientServes() bool {
+	for _, c := range s.Clients {
+		if c.Tunnel != "" && contains(s.Tunnels, c.Tunnel) {
+			return true
+		}
+	}
+	return false
+}
+
+// tunServed checks that a process has one of the Linux tunnels open: a
+// tun device has carrier only while one does
+func tunServed(tunnels []string) bool {
+	for _, name := range tunnels {
+		if _, err := os.Stat("/sys/class/net/" + name + "/tun_flags"); err != nil {
+			// Kernel WireGuard and the like have no process
+			return true
+		}
+		carrier, err := os.ReadFile("/sys/class/net/" + name + "/carrier")
+		if err == nil && strings.TrimSpace(string(carrier)) == "1" {
+			return true
+		}
+	}
+	return false
+}
+
+// vpnTunnels lists the interfaces the VPN is on: the client config's
+// tun, or else the configured or any active tun device
+func vpnTunnels(cfg *Config) []string {
+	if cfg.XrayConfig != "" {
+		if info, err := readXrayConfig(cfg.XrayConfig); err == nil {
+			switch {
+			case info.Tunnel != "":
+				return []string{info.Tunnel}
+			case len(info.TunnelNetworks) > 0:
+				if iface := interfaceWithin(info.TunnelNetworks); iface != "" {
+					return []string{iface}
+				}
+				return nil
+			}
+		}
+	}
+	if cfg.Tunnel != "" {
+		return []string{cfg.Tunnel}
+	}
+	if runtime.GOOS == "linux" {
+		return tunnelDevices()
+	}
+	return activeTunnels()
+}
+
+// runningVPNClients lists the known VPN client processes from the
+// process table
+func runningVPNClients() []vpnClient {
+	clients := []vpnClient{}
+	out, err := exec.Command("ps", "-A", "-o", "pid=,etime=,comm=").Output()
+	if err != nil {
+		return clients
+	}
+
+	for _, line := range strings.Split(string(out), "\n") {
+		pid, rest, _ := strings.Cut(strings.TrimSpace(line), " ")
+		etime, comm, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		// macOS gives the executable's path, which may hold spaces
+		process := filepath.Base(strings.TrimSpace(comm))
+		name, ok := vpnClientProcesses[strings.ToLower(process)]
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(pid)
+		if err != nil {
+			continue
+		}
+		clients = append(clients, vpnClient{Name: name, Process: process, PID: n, UptimeSeconds: parseElapsed(etime)})
+	}
+
+	return clients
+}
+
+// parseElapsed parses ps's elapsed time, [[dd-]hh:]mm:ss, into seconds
+func parseElapsed(etime string) int64 {
+	var days int64
+	if d, rest, found := strings.Cut(etime, "-"); found {
+		days, _ = strconv.ParseInt(d, 10, 64)
+		etime = rest
+	}
+	var seconds int64
+	for _, part := range strings.Split(etime, ":") {
+		n, _ := strconv.ParseInt(part, 10, 64)
+		seconds = seconds*60 + n
+	}
+	return days*86400 + seconds
+}
+
+// formatUptime formats seconds to their two largest units, e.g. 2h5m
+func formatUptime(seconds int64) string {
+	d, h, m, s := seconds/86400, seconds/3600%24, seconds/60%60, seconds%60
+	switch {
+	case d > 0:
+		return fmt.Sprintf("%dd%dh", d, h)
+	case h > 0:
+		return fmt.Sprintf("%dh%dm", h, m)
+	case m > 0:
+		return fmt.Sprintf("%dm%ds", m, s)
+	}
+	return fmt.Sprintf("%ds", s)
+}
+
+// utunControlPattern matches a utun control socket in lsof's output; unit
+// N is utun N-1
+var utunControlPattern = regexp.MustCompile(`utun_control id \d+ unit (\d+)`)
+
+// tunnelOwners maps the processes holding a tun device to its name, for
+// pids or, if nil, every process. Without root only this user's processes
+// can be seen. On macOS it fails when lsof can't run or prints nothing.
+func tunnelOwners(pids []int) (map[int]string, error) {
+	owners := map[int]string{}
+	if runtime.GOOS == "linux" {
+		if pids == nil {
+			entries, _ := os.ReadDir("/proc")
+			for _, entry := range entries {
+				if pid, err := strconv.Atoi(entry.Name()); err == nil {
+					pids = append(pids, pid)
+				}
+			}
+		}
+		for _, pid := range pids {
+			if tunnel := procTunnel(pid); tunnel != "" {
+				owners[pid] = tunnel
+			}
+		}
+		return owners, nil
+	}
+
+	args := []string{"-nP", "-w"}
+	if pids != nil {
+		list := make([]string, len(pids))
+		for i, pid := range pids {
+			list[i] = strconv.Itoa(pid)
+		}
+		args = append(args, "-a", "-p", strings.Join(list, ","))
+	}
+	// lsof exits 1 when some pid has nothing open; the output still counts
+	out, err := exec.Command("lsof", args...).Output()
+	if len(bytes.TrimSpace(out)) == 0 {
+		if err == nil {
+			err = errors.New("lsof printed nothing")
+		}
+		return owners, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		m := utunControlPattern.FindStringSubmatch(line)
+		fields := strings.Fields(line)
+		if m == nil || len(fields) < 2 {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[1])
+		unit, _ := strconv.Atoi(m[1])
+		if err == nil && unit > 0 {
+			owners[pid] = fmt.Sprintf("utun%d", unit-1)
+		}
+	}
+	return owners, nil
+}
+
+// capSysPtrace is CAP_SYS_PTRACE's bit in /proc/<pid>/status
+const capSysPtrace = 19
+
+// procFdsReadable reports whether other processes' /proc/<pid>/fd can be
+// read: root needs CAP_SYS_PTRACE, which the auto daemon's hardened unit
+// doesn't grant. Other users see their own processes either way.
+func procFdsReadable() bool {
+	if os.Geteuid() != 0 {
+		return true
+	}
+	status, _ := os.ReadFile("/proc/self/status")
+	for _, line := range strings.Split(string(status), "\n") {
+		if caps, found := strings.CutPrefix(line, "CapEff:"); found {
+			effective, err := strconv.ParseUint(strings.TrimSpace(caps), 16, 64)
+			return err == nil && effective&(1<<capSysPtrace) != 0
+		}
+	}
+	return false
+}
+
+// procTunnel returns the tun device a Linux process has open: its fdinfo
+// names the interface of a /dev/net/tun descriptor
+func procTunnel(pid int) string {
+	dir := fmt.Sprintf("/proc/%d", pid)
+	fds, _ := os.ReadDir(dir + "/fd")
+	for _, fd := range fds {
+		if target, err := os.Readlink(dir + "/fd/" + fd.Name()); err != nil || target != "/dev/net/tun" {
+			continue
+		}
+		info, err := os.ReadFile(dir + "/fdinfo/" + fd.Name())
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(info), "\n") {
+			if name, found := strings.CutPrefix(line, "iff:"); found {
+				return strings.TrimSpace(name)
+			}
+		}
+	}
+	return ""
+}
+
+// printVPNClients prints the VPN clients under a status' VPN line
+func printVPNClients(vpn vpnState) {
+	for _, c := range vpn.Clients {
+		fmt.Println("VPN client:      " + c.String())
+	}
+	if vpn.TunnelUp && !vpn.Connected {
+		tunnel := "the tunnel"
+		if len(vpn.Tunnels) > 0 {
+			tunnel = strings.Join(vpn.Tunnels, ", ")
+		}
+		fmt.Printf("                 ⚠ %s is up but no VPN client serves it\n", tunnel)
+	}
+}
@@ -8,106 +8,218 @@ import (
 	"strings"
 	"syscall"
 	"time"
+
+	"github.com/spf13/cobra"
 )
 
 const (
-	autoDaemonLabel = "com.saferay.xray-auto"
-	autoDaemonPath  = "/Library/LaunchDaemons/com.saferay.xray-auto.plist"
-	autoDaemonPlist = `<?xml version="1.0" encoding="UTF-8"?>
-<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
-<plist version="1.0">
-<dict>
-    <key>Label</key>
-    <string>com.saferay.xray-auto</string>
-    <key>ProgramArguments</key>
-    <array>
-        <string>/usr/local/bin/saferay</string>
-        <string>xray</string>
-        <string>watch</string>
-    </array>
-    <key>RunAtLoad</key>
-    <true/>
-    <key>KeepAlive</key>
-    <true/>
-    <key>StandardOutPath</key>
-    <string>/var/log/saferay-xray.log</string>
-    <key>StandardErrorPath</key>
-    <string>/var/log/saferay-xray.log</string>
-</dict>
-</plist>`
 	watchInterval = 5 * time.Second
 )
 
-// cmdXrayAuto handles the auto subcommand
-func cmdXrayAuto(action string) {
-	switch action {
-	case "start":
-		startAutoDaemon()
-	case "stop":
-		stopAutoDaemon()
-	case "status":
-		statusAutoDaemon()
-	default:
-		fmt.Printf("Unknown auto action: %s\n", action)
-		fmt.Println("Usage: saferay xray auto [start|stop|status]")
-		os.Exit(1)
-	}
+func newXrayAutoCmd() *cobra.Command {
+	cmd := groupCmd("auto", "Enable protection automatically when the VPN connects")
+	cmd.AddCommand(
+		actionCmd("start", "Auto-enable the firewall when VPN connects (recommended)", startAutoDaemon),
+		actionCmd("stop", "Disable auto mode", stopAutoDaemon),
+		actionCmd("status", "Show auto mode status", statusAutoDaemon),
+	)
+	return cmd
+}
+
+// newXrayWatchCmd is the internal command run by the auto daemon
+func newXrayWatchCmd() *cobra.Command {
+	cmd := actionCmd("watch", "Run the VPN watch loop (used by the auto daemon)", cmdXrayWatch)
+	cmd.Hidden = true
+	return cmd
 }
 
 // cmdXrayWatch runs the VPN monitoring loop (called by daemon)
 func cmdXrayWatch() {
-	fmt.Println("saferay: Starting VPN watch daemon...")
+	openDaemonLog(loadConfig().LogSink)
+
+	fw := newFirewall()
+	daemonLog.info("daemon_start", "Starting VPN watch daemon", "backend", fw.name(), "pid", os.Getpid())
 
 	// Setup signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	vpnConnected := false
-	pfEnabled := isPfEnabled()
+	w := &watcher{fw: fw, pfEnabled: fw.enabled(), metrics: newDaemonMetrics()}
+	w.tick(true)
+	// Catch what changed while the daemon wasn't running, e.g. an OS
+	// update rewriting pf.conf
+	w.heal()
 
-	// Initial state: if VPN is connected, enable pf
-	if isVPNConnected() {
-		if !pfEnabled {
-			fmt.Println("saferay: VPN detected at startup, enabling pf...")
-			enablePfQuiet()
+	if cfg := loadConfig(); cfg.MetricsAddr != "" {
+		addr, err := metricsListenAddr(cfg.MetricsAddr)
+		if err == nil {
+			err = serveMetrics(addr, w.metrics, fw)
 		}
-		vpnConnected = true
-	} else {
-		// VPN not connected - make sure pf is disabled
-		if pfEnabled {
-			fmt.Println("saferay: No VPN at startup, disabling pf...")
-			disablePfQuiet()
+		if err != nil {
+			daemonLog.warn("metrics_error", "Metrics endpoint not started", "error", err)
+		} else {
+			daemonLog.info("metrics_start", "Serving metrics", "url", "http://"+addr+"/metrics")
+		}
+	}
+
+	if loadConfig().LogBlocked {
+		if fw.name() == "pf" {
+			go watchLeaks()
+		} else {
+			daemonLog.warn("leak_log_failed", "log_blocked is only supported with pf", "backend", fw.name())
 		}
 	}
 
 	ticker := time.NewTicker(watchInterval)
 	defer ticker.Stop()
+	driftTicker := time.NewTicker(driftInterval)
+	defer driftTicker.Stop()
 
 	for {
 		select {
 		case <-sigChan:
-			fmt.Println("saferay: Shutting down watch daemon...")
+			daemonLog.info("daemon_stop", "Shutting down watch daemon")
 			return
 		case <-ticker.C:
-			currentlyConnected := isVPNConnected()
-
-			if currentlyConnected && !vpnConnected {
-				// VPN just connected
-				fmt.Println("saferay: VPN connected, enabling DNS protection...")
-				enablePfQuiet()
-				vpnConnected = true
-			} else if !currentlyConnected && vpnConnected {
-				// VPN just disconnected
-				fmt.Println("saferay: VPN disconnected, disabling DNS protection...")
-				disablePfQuiet()
-				vpnConnected = false
+			w.tick(false)
+		case <-driftTicker.C:
+			w.heal()
+		}
+	}
+}
+
+// openDaemonLog sends the daemon log to the configured sinks. If the log
+// file can't be opened, e.g. when run by hand without root, it logs to
+// stdout; if the system log can't be, to the file.
+func openDaemonLog(sink string) {
+	if sink == sinkSystem || sink == sinkBoth {
+		system, err := newSystemLogSink()
+		if err == nil {
+			daemonLog.system = system
+		} else {
+			daemonLog.warn("log_open_failed", "System log unavailable, logging to file", "error", err)
+			sink = sinkFile
+		}
+	}
+
+	if sink == sinkSystem {
+		daemonLog.out = nil
+		return
+	}
+	if logFile, err := openRotatingFile(xrayLogPath); err == nil {
+		daemonLog.out = logFile
+	} else {
+		daemonLog.warn("log_open_failed", "Logging to stdout", "error", err)
+	}
+}
+
+// watcher holds the state the watch loop reconciles against
+type watcher struct {
+	fw           firewall
+	vpnConnected bool
+	pfEnabled    bool
+	profile      string
+	mode         string
+	metrics      *daemonMetrics
+	// drifted is the drift last logged, by what drifted
+	drifted map[string]string
+	// orphaned is whether a tunnel is up with no client serving it
+	orphaned bool
+	// configUnreadable is whether the client config couldn't be read
+	configUnreadable bool
+}
+
+// tick checks the network profile and VPN state and updates pf to match
+func (w *watcher) tick(startup bool) {
+	var probe time.Duration
+	defer func() { w.metrics.update(w, probe) }()
+
+	cfg := loadConfig()
+
+	// Switch profile when the network changes
+	name, mode, info := currentMode(cfg)
+
+	if name != w.profile || mode != w.mode {
+		if name != "" {
+			daemonLog.info("profile_switch", "Network matched profile, switching mode",
+				"network", info, "profile", name, "mode", mode)
+			if !startup {
+				w.metrics.transition("profile_switch")
 			}
 		}
+		// A new network needs the mode's DNS too, even in the same mode
+		if name != "" || mode != w.mode {
+			// Without profiles the network isn't looked up until needed
+			if info.Service == "" {
+				info = currentNetwork()
+			}
+			applyModeDNS(mode, info.Service)
+		}
+		w.profile, w.mode = name, mode
+	}
+
+	configErr := clientConfigError(cfg)
+	if configErr != nil && !w.configUnreadable {
+		daemonLog.warn("client_config_unreadable", "Can't read the client config, guessing the tunnel from tun devices",
+			"path", cfg.XrayConfig, "error", configErr)
+	}
+	w.configUnreadable = configErr != nil
+
+	probeStart := time.Now()
+	vpn := detectVPN()
+	connected := vpn.Connected
+	probe = time.Since(probeStart)
+	var client []any
+	if c := vpn.owner(); c != nil {
+		client = []any{"client", c.Name, "process", c.Process, "client_pid", c.PID}
+	}
+	if connected && startup {
+		daemonLog.info("vpn_up", "VPN detected at startup", append([]any{"startup", true}, client...)...)
+	} else if connected && !w.vpnConnected {
+		daemonLog.info("vpn_up", "VPN connected", client...)
+		w.metrics.transition("vpn_up")
+	} else if !connected && w.vpnConnected {
+		daemonLog.info("vpn_down", "VPN disconnected")
+		w.metrics.transition("vpn_down")
+	}
+	w.vpnConnected = connected
+
+	if orphaned := vpn.TunnelUp && !connected; orphaned && !w.orphaned {
+		daemonLog.warn("tunnel_orphaned", "Tunnel is up but no VPN client serves it, treating the VPN as disconnected",
+			"tunnel", strings.Join(vpn.Tunnels, ","))
+	}
+	w.orphaned = vpn.TunnelUp && !connected
+
+	want := wantPf(w.mode, connected)
+	if want == w.pfEnabled {
+		return
+	}
+
+	var err error
+	if want {
+		err = w.fw.enable()
+	} else {
+		err = w.fw.disable()
+	}
+	if err != nil {
+		// Leave state unchanged so the next tick retries
+		daemonLog.log(levelError, "firewall_error", "Error updating firewall",
+			"backend", w.fw.name(), "enable", want, "error", err)
+		w.metrics.firewallError()
+		return
+	}
+	if want {
+		daemonLog.info("protection_on", "DNS protection enabled", "backend", w.fw.name(), "mode", w.mode)
+		w.metrics.transition("protection_on")
+	} else {
+		daemonLog.info("protection_off", "DNS protection disabled", "backend", w.fw.name(), "mode", w.mode)
+		w.metrics.transition("protection_off")
 	}
+	w.pfEnabled = want
 }
 
-// isVPNConnected checks if a VPN tunnel interface exists
-func isVPNConnected() bool {
+// isVPNConnectedDarwin checks if a VPN tunnel interface exists
+func isVPNConnectedDarwin() bool {
 	// Check scutil --dns for utun interface with DNS
 	out, err := exec.Command("scutil", "--dns").CombinedOutput()
 	if err != nil {
@@ -156,24 +268,6 @@ func isVPNConnected() bool {
 	return false
 }
 
-// isPfEnabled checks if pf firewall is currently enabled
-func isPfEnabled() bool {
-	out, _ := exec.Command("pfctl", "-s", "info").CombinedOutput()
-	return strings.Contains(string(out), "Status: Enabled")
-}
-
-// enablePfQuiet enables pf without printing to stdout
-func enablePfQuiet() {
-	cmd := exec.Command("pfctl", "-ef", pfConf)
-	_ = cmd.Run()
-}
-
-// disablePfQuiet disables pf without printing to stdout
-func disablePfQuiet() {
-	cmd := exec.Command("pfctl", "-d")
-	_ = cmd.Run()
-}
-
 func startAutoDaemon() {
 	// Check if saferay is installed
 	if _, err := os.Stat(installPath); os.IsNotExist(err) {
@@ -182,90 +276,120 @@ func startAutoDaemon() {
 	}
 
 	// Check if xray rules are installed
-	if _, err := os.Stat(anchorPath); os.IsNotExist(err) {
+	if _, err := os.Stat(newFirewall().rulesPath()); os.IsNotExist(err) {
 		fmt.Println("Error: Xray rules not installed. Run 'saferay xray install' first.")
 		os.Exit(1)
 	}
 
-	// Write daemon plist
-	tmpPath := "/tmp/saferay_xray_auto.plist"
-	if err := os.WriteFile(tmpPath, []byte(autoDaemonPlist), 0644); err != nil {
-		fmt.Printf("Error writing daemon plist: %v\n", err)
+	// Write the daemon definition and (re)start it
+	sm := newServiceManager()
+	if err := sm.install(autoService()); err != nil {
+		fmt.Printf("Error installing %s service: %v\n", sm.name(), err)
 		os.Exit(1)
 	}
 
-	// Stop existing daemon if running
-	_ = exec.Command("sudo", "launchctl", "unload", "-w", autoDaemonPath).Run()
-
-	cmds := [][]string{
-		{"sudo", "mv", tmpPath, autoDaemonPath},
-		{"sudo", "chown", "root:wheel", autoDaemonPath},
-		{"sudo", "chmod", "644", autoDaemonPath},
-		{"sudo", "launchctl", "load", "-w", autoDaemonPath},
-	}
-
-	for _, args := range cmds {
-		cmd := exec.Command(args[0], args[1:]...)
-		cmd.Stdin = os.Stdin
-		if err := cmd.Run(); err != nil {
-			fmt.Printf("Error running %v: %v\n", args, err)
-			os.Exit(1)
-		}
-	}
-
 	fmt.Println("✓ Auto mode enabled")
 	fmt.Println("  - DNS protection will auto-enable when VPN connects")
 	fmt.Println("  - DNS protection will auto-disable when VPN disconnects")
-	fmt.Println("  - Log: /var/log/saferay-xray.log")
+	fmt.Println("  - Log: " + xrayLogPath + " (view with 'saferay logs')")
 }
 
 func stopAutoDaemon() {
-	_ = exec.Command("sudo", "launchctl", "unload", "-w", autoDaemonPath).Run()
-	_ = exec.Command("sudo", "rm", "-f", autoDaemonPath).Run()
+	_ = newServiceManager().remove(autoService())
 
 	// Also disable pf if it was enabled by daemon
-	_ = exec.Command("pfctl", "-d").Run()
+	_ = newFirewall().disable()
 
 	fmt.Println("✓ Auto mode disabled")
 }
 
-func statusAutoDaemon() {
-	fmt.Println("=== Xray Auto Mode Status ===")
-	fmt.Println()
+// autoStatus is the state of the auto mode daemon
+type autoStatus struct {
+	report
+	Installed bool     `json:"installed"`
+	Running   bool     `json:"running"`
+	Drift     []string `json:"drift,omitempty"`
+	Issues    []string `json:"issues,omitempty"`
+	// ClientConfigError is why the client config can't be read
+	ClientConfigError string      `json:"client_config_error,omitempty"`
+	Profile           string      `json:"profile"`
+	Mode              string      `json:"mode"`
+	VPNConnected      bool        `json:"vpn_connected"`
+	VPNClients        []vpnClient `json:"vpn_clients"`
+	Backend           string      `json:"backend"`
+	PfEnabled         bool        `json:"pf_enabled"`
+	RecentLog         []string    `json:"recent_log"`
+}
 
-	// Check daemon installed
-	if _, err := os.Stat(autoDaemonPath); os.IsNotExist(err) {
-		fmt.Println("Auto daemon:     ✗ Not installed")
-	} else {
-		// Check if running
-		out, _ := exec.Command("sudo", "launchctl", "list", autoDaemonLabel).CombinedOutput()
-		if strings.Contains(string(out), autoDaemonLabel) {
-			fmt.Println("Auto daemon:     ✓ Running")
-		} else {
-			fmt.Println("Auto daemon:     ⚠ Installed but not running")
+func statusAutoDaemon() {
+	st := autoStatus{report: newReport("xray auto status"), RecentLog: []string{}}
+
+	// Check daemon installed and running
+	daemon := newServiceManager().status(autoService())
+	st.Installed, st.Running = daemon.Installed, daemon.Running
+	st.Drift, st.Issues = daemon.Drift, daemon.Issues
+
+	fw := newFirewall()
+	st.Backend = fw.name()
+	cfg := loadConfig()
+	st.Profile, st.Mode, _ = currentMode(cfg)
+	if err := clientConfigError(cfg); err != nil {
+		st.ClientConfigError = err.Error()
+	}
+	vpn := detectVPN()
+	st.VPNConnected, st.VPNClients = vpn.Connected, vpn.Clients
+	if st.VPNClients == nil {
+		st.VPNClients = []vpnClient{}
+	}
+	st.PfEnabled = fw.status().Enabled
+
+	// Recent log lines if the log exists
+	if _, err := os.Stat(xrayLogPath); err == nil {
+		out, _ := exec.Command("tail", "-5", xrayLogPath).CombinedOutput()
+		for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+			if line != "" {
+				st.RecentLog = append(st.RecentLog, parseLogLine(line).format())
+			}
 		}
 	}
 
-	// Check VPN status
-	if isVPNConnected() {
-		fmt.Println("VPN connected:   ✓ Yes")
-	} else {
-		fmt.Println("VPN connected:   ✗ No")
+	if st.Installed {
+		switch {
+		case daemon.problem() != "":
+			st.notActive("auto daemon: %s", daemon.problem())
+		case !st.Running:
+			st.notActive("auto daemon is installed but not running")
+		case wantPf(st.Mode, st.VPNConnected) && !st.PfEnabled:
+			st.notActive("protection should be enabled but %s is disabled", st.Backend)
+		}
 	}
 
-	// Check pf status
-	if isPfEnabled() {
-		fmt.Println("pf firewall:     ✓ Enabled")
-	} else {
-		fmt.Println("pf firewall:     ✗ Disabled")
-	}
+	finish(&st.report, st, func() {
+		fmt.Println("=== Xray Auto Mode Status ===")
+		fmt.Println()
 
-	// Show log tail if exists
-	if _, err := os.Stat("/var/log/saferay-xray.log"); err == nil {
-		fmt.Println("\nRecent log:")
-		out, _ := exec.Command("tail", "-5", "/var/log/saferay-xray.log").CombinedOutput()
-		if len(out) > 0 {
-			fmt.Println(string(out))
+		switch {
+		case !st.Installed:
+			fmt.Println("Auto daemon:     ✗ Not installed")
+		case st.Running:
+			fmt.Printf("Auto daemon:     ✓ Running (pid %d)\n", daemon.PID)
+		default:
+			fmt.Println("Auto daemon:     ⚠ Installed but not running")
 		}
-	}
+		daemon.printIssues(autoService())
+		if st.Profile != "" {
+			fmt.Printf("Profile:         %s (mode=%s)\n", st.Profile, st.Mode)
+		}
+		fmt.Println("VPN connected:   " + mark(st.VPNConnected, "Yes", "No"))
+		printVPNClients(vpn)
+		if st.ClientConfigError != "" {
+			fmt.Printf("                 ⚠ %s; the tunnel is guessed from tun devices\n", st.ClientConfigError)
+		}
+		fmt.Printf("Firewall:        %s (%s)\n", mark(st.PfEnabled, "Enabled", "Disabled"), st.Backend)
+
+		if len(st.RecentLog) > 0 {
+			fmt.Println("\nRecent log:")
+			fmt.Println(strings.Join(st.RecentLog, "\n"))
+		}
+	})
 }
@@ -3,45 +3,26 @@ package cmd
 import (
 	"fmt"
 	"os"
-	"os/exec"
-	"strings"
-)
 
-const (
-	pfConf      = "/etc/pf.conf"
-	anchorPath  = "/etc/pf.anchors/xray-dns"
-	anchorName  = "xray-dns"
-	anchorRules = `pass out quick on utun4 proto { udp tcp } to any port 53
-pass out quick on lo0 proto { udp tcp } to 127.0.0.0/8 port 53
-block out quick proto { udp tcp } to any port 53
-`
+	"github.com/spf13/cobra"
 )
 
-func cmdXray(action string, args []string) {
-	switch action {
-	case "install":
-		installXrayRules()
-	case "enable":
-		enableXray()
-	case "disable":
-		disableXray()
-	case "reset":
-		resetXrayRules()
-	case "status":
-		statusXray()
-	case "auto":
-		if len(args) < 1 {
-			fmt.Println("Usage: saferay xray auto [start|stop|status]")
-			os.Exit(1)
-		}
-		cmdXrayAuto(args[0])
-	case "watch":
-		// Internal command used by daemon
-		cmdXrayWatch()
-	default:
-		fmt.Printf("Unknown xray action: %s\n", action)
-		os.Exit(1)
-	}
+func newXrayCmd() *cobra.Command {
+	cmd := groupCmd("xray", "Xray mode: force all DNS through the VPN tunnel with pf/nftables")
+	cmd.AddCommand(
+		actionCmd("install", "Install pf rules for Xray DNS protection", installXrayRules),
+		actionCmd("enable", "Enable pf firewall with Xray rules", enableXray),
+		actionCmd("disable", "Disable pf firewall", disableXray),
+		actionCmd("reset", "Remove all Xray pf rules", resetXrayRules),
+		actionCmd("status", "Show current pf/Xray status", statusXray),
+		onPlatforms(newXraySplitCmd(), "darwin"),
+		newXrayExemptCmd(),
+		newXrayConfigCmd(),
+		newXrayAutoCmd(),
+		newXrayWatchCmd(),
+	)
+	onPlatforms(cmd, "darwin", "linux")
+	return cmd
 }
 
 func installXrayRules() {
@@ -52,62 +33,28 @@ func installXrayRules() {
 		if service != "" {
 			resetDNS(service)
 		}
-		_ = exec.Command("sudo", "rm", "-f", lightConfigPath).Run()
+		_ = sys.removeFile(lightConfigPath)
 		fmt.Println("Note: DNS flush daemon kept (useful for both modes)")
 		fmt.Println()
 	}
 
-	// Write anchor file
-	tmpAnchor := "/tmp/xray-dns-anchor"
-	if err := os.WriteFile(tmpAnchor, []byte(anchorRules), 0644); err != nil {
-		fmt.Printf("Error writing anchor: %v\n", err)
-		os.Exit(1)
-	}
-
-	cmd := exec.Command("sudo", "mv", tmpAnchor, anchorPath)
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Error moving anchor: %v\n", err)
-		os.Exit(1)
-	}
+	// Tunnel and passes for Xray's own DNS traffic from its config
+	cfg := loadConfig()
+	applyXrayConfig(cfg)
 
-	// Read current pf.conf
-	pfContent, err := os.ReadFile(pfConf)
-	if err != nil {
-		fmt.Printf("Error reading pf.conf: %v\n", err)
+	// Write and hook up the firewall rules
+	fw := newFirewall()
+	if err := fw.install(cfg); err != nil {
+		fmt.Printf("Error installing %s rules: %v\n", fw.name(), err)
 		os.Exit(1)
 	}
 
-	// Check if anchor already exists
-	if strings.Contains(string(pfContent), anchorName) {
-		// Remove existing xray-dns lines first
-		lines := strings.Split(string(pfContent), "\n")
-		var filtered []string
-		for _, line := range lines {
-			if !strings.Contains(line, "xray-dns") {
-				filtered = append(filtered, line)
-			}
+	// Split DNS resolvers for configured domains
+	for _, route := range cfg.SplitDNS {
+		if err := writeResolverFile(route); err != nil {
+			fmt.Printf("Error writing resolver for %s: %v\n", route.Domain, err)
+			os.Exit(1)
 		}
-		pfContent = []byte(strings.Join(filtered, "\n"))
-	}
-
-	// Add anchor lines
-	newContent := string(pfContent)
-	// Remove trailing whitespace
-	newContent = strings.TrimRight(newContent, "\n\t ")
-	newContent += fmt.Sprintf("\nanchor \"%s\"\nload anchor \"%s\" from \"%s\"\n", anchorName, anchorName, anchorPath)
-
-	tmpPf := "/tmp/pf.conf.new"
-	if err := os.WriteFile(tmpPf, []byte(newContent), 0644); err != nil {
-		fmt.Printf("Error writing pf.conf: %v\n", err)
-		os.Exit(1)
-	}
-
-	cmd = exec.Command("sudo", "mv", tmpPf, pfConf)
-	cmd.Stdin = os.Stdin
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Error updating pf.conf: %v\n", err)
-		os.Exit(1)
 	}
 
 	fmt.Println("✓ Xray DNS protection rules installed")
@@ -115,19 +62,16 @@ func installXrayRules() {
 }
 
 func enableXray() {
+	fw := newFirewall()
+
 	// Check if rules installed
-	if _, err := os.Stat(anchorPath); os.IsNotExist(err) {
+	if _, err := os.Stat(fw.rulesPath()); os.IsNotExist(err) {
 		fmt.Println("Xray rules not installed. Run 'saferay xray install' first")
 		os.Exit(1)
 	}
 
-	cmd := exec.Command("sudo", "pfctl", "-ef", pfConf)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-
-	if err := cmd.Run(); err != nil {
-		fmt.Printf("Error enabling pf: %v\n", err)
+	if err := fw.enable(); err != nil {
+		fmt.Printf("Error enabling %s: %v\n", fw.name(), err)
 		os.Exit(1)
 	}
 
@@ -135,85 +79,94 @@ func enableXray() {
 }
 
 func disableXray() {
-	cmd := exec.Command("sudo", "pfctl", "-d")
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	cmd.Stdin = os.Stdin
-	_ = cmd.Run()
+	fw := newFirewall()
+	if err := fw.disable(); err != nil {
+		fmt.Printf("Error disabling %s: %v\n", fw.name(), err)
+	}
 
-	fmt.Println("✓ pf firewall disabled")
+	fmt.Printf("✓ %s firewall disabled\n", fw.name())
 }
 
 func resetXrayRules() {
-	// Disable pf first
-	_ = exec.Command("sudo", "pfctl", "-d").Run()
-
-	// Read and clean pf.conf
-	pfContent, err := os.ReadFile(pfConf)
-	if err == nil {
-		lines := strings.Split(string(pfContent), "\n")
-		var filtered []string
-		for _, line := range lines {
-			if !strings.Contains(line, "xray-dns") {
-				filtered = append(filtered, line)
-			}
-		}
-		newContent := strings.Join(filtered, "\n")
-
-		tmpPf := "/tmp/pf.conf.clean"
-		if os.WriteFile(tmpPf, []byte(newContent), 0644) == nil {
-			_ = exec.Command("sudo", "mv", tmpPf, pfConf).Run()
-		}
+	fw := newFirewall()
+	if err := fw.reset(); err != nil {
+		fmt.Printf("Error removing %s rules: %v\n", fw.name(), err)
 	}
 
-	// Remove anchor file
-	_ = exec.Command("sudo", "rm", "-f", anchorPath).Run()
+	// Remove split DNS resolvers (routes stay in config for the next install)
+	for _, route := range loadConfig().SplitDNS {
+		removeResolverFile(route.Domain)
+	}
 
 	fmt.Println("✓ Xray DNS rules removed")
 }
 
-func statusXray() {
-	fmt.Println("=== Xray DNS Protection Status ===")
-	fmt.Println()
-
-	// Check anchor file
-	if _, err := os.Stat(anchorPath); os.IsNotExist(err) {
-		fmt.Println("Rules installed: ✗ No")
-	} else {
-		fmt.Println("Rules installed: ✓ Yes")
-	}
+// xrayStatus is the state of Xray DNS protection
+type xrayStatus struct {
+	report
+	Backend        string `json:"backend"`
+	RulesInstalled bool   `json:"rules_installed"`
+	// PfEnabled and AnchorLoaded keep their names on every backend
+	PfEnabled    bool               `json:"pf_enabled"`
+	AnchorLoaded bool               `json:"anchor_loaded"`
+	VPNConnected bool               `json:"vpn_connected"`
+	VPNClients   []vpnClient        `json:"vpn_clients"`
+	SplitDNS     []splitRouteStatus `json:"split_dns"`
+	Exemptions   []exemptionStatus  `json:"exemptions"`
+	ActiveRules  []string           `json:"active_rules"`
+}
 
-	// Check pf status
-	out, _ := exec.Command("sudo", "pfctl", "-s", "info").CombinedOutput()
-	if strings.Contains(string(out), "Status: Enabled") {
-		fmt.Println("pf firewall:     ✓ Enabled")
-	} else {
-		fmt.Println("pf firewall:     ✗ Disabled")
+func statusXray() {
+	st := xrayStatus{report: newReport("xray status")}
+
+	fw := newFirewall()
+	fwStatus := fw.status()
+	st.Backend = fw.name()
+	st.RulesInstalled = fwStatus.Installed
+	st.PfEnabled = fwStatus.Enabled
+	st.AnchorLoaded = fwStatus.Loaded
+	st.ActiveRules = append([]string{}, fwStatus.Rules...)
+
+	vpn := detectVPN()
+	st.VPNConnected, st.VPNClients = vpn.Connected, vpn.Clients
+	if st.VPNClients == nil {
+		st.VPNClients = []vpnClient{}
+	}
+	st.SplitDNS = getSplitDNSStatus()
+	st.Exemptions = getExemptionStatus()
+
+	if st.RulesInstalled {
+		switch {
+		case st.PfEnabled && !st.AnchorLoaded:
+			st.notActive("%s is enabled but the saferay rules are not loaded", fw.name())
+		case st.VPNConnected && !st.PfEnabled:
+			st.notActive("VPN is connected but %s is disabled", fw.name())
+		}
 	}
 
-	// Check anchor loaded
-	out, _ = exec.Command("sudo", "pfctl", "-s", "Anchors").CombinedOutput()
-	if strings.Contains(string(out), anchorName) {
-		fmt.Println("Anchor loaded:   ✓ Yes")
-	} else {
-		fmt.Println("Anchor loaded:   ✗ No")
-	}
+	finish(&st.report, st, func() {
+		fmt.Println("=== Xray DNS Protection Status ===")
+		fmt.Println()
 
-	// Show rules if loaded
-	out, _ = exec.Command("sudo", "pfctl", "-a", anchorName, "-s", "rules").CombinedOutput()
-	outStr := string(out)
-	// Filter out ALTQ warnings
-	lines := strings.Split(outStr, "\n")
-	var rules []string
-	for _, line := range lines {
-		if !strings.Contains(line, "ALTQ") && strings.TrimSpace(line) != "" {
-			rules = append(rules, line)
+		fmt.Println("Rules installed: " + mark(st.RulesInstalled, "Yes", "No"))
+		fmt.Printf("Firewall:        %s (%s)\n", mark(st.PfEnabled, "Enabled", "Disabled"), st.Backend)
+		switch st.Backend {
+		case "pf":
+			fmt.Println("Anchor loaded:   " + mark(st.AnchorLoaded, "Yes", "No"))
+		case backendIptables:
+			fmt.Println("Chain loaded:    " + mark(st.AnchorLoaded, "Yes", "No"))
 		}
-	}
-	if len(rules) > 0 {
-		fmt.Println("\nActive rules:")
-		for _, rule := range rules {
-			fmt.Println("  " + rule)
+		fmt.Println("VPN connected:   " + mark(st.VPNConnected, "Yes", "No"))
+		printVPNClients(vpn)
+
+		printSplitDNSStatus(st.SplitDNS)
+		printExemptions(st.Exemptions)
+
+		if len(st.ActiveRules) > 0 {
+			fmt.Println("\nActive rules:")
+			for _, rule := range st.ActiveRules {
+				fmt.Println("  " + rule)
+			}
 		}
-	}
+	})
 }
@@ -0,0 +1,680 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// xrayConfigPaths are where Xray's config.json is usually installed: by
+// its install script, distro packages and Homebrew
+var xrayConfigPaths = []string{
+	"/usr/local/etc/xray/config.json",
+	"/etc/xray/config.json",
+	"/opt/homebrew/etc/xray/config.json",
+}
+
+// Clients whose configs saferay reads
+const (
+	clientXray = "xray"
+	// clientSingbox also covers Hiddify, which runs sing-box
+	clientSingbox = "sing-box"
+)
+
+// XrayPass lets DNS through to addresses the client itself uses on port
+// 53: a proxy server listening there, a DNS inbound outside loopback, or
+// the network of a tun interface saferay can't name in advance
+type XrayPass struct {
+	Tag       string
+	Addresses []string
+}
+
+// xrayConfig is the part of an Xray or V2Ray config.json saferay reads
+type xrayConfig struct {
+	Inbounds  []xrayBound `json:"inbounds"`
+	Outbounds []xrayBound `json:"outbounds"`
+	DNS       struct {
+		Servers []json.RawMessage `json:"servers"`
+		// Tag is the inbound tag routing rules see on Xray's own queries
+		Tag string `json:"tag"`
+	} `json:"dns"`
+	Routing struct {
+		Rules []map[string]json.RawMessage `json:"rules"`
+	} `json:"routing"`
+}
+
+// xrayBound is an inbound or an outbound
+type xrayBound struct {
+	Tag      string          `json:"tag"`
+	Protocol string          `json:"protocol"`
+	Listen   string          `json:"listen"`
+	Port     json.RawMessage `json:"port"`
+	Settings json.RawMessage `json:"settings"`
+}
+
+// xrayAddress is a server in an outbound's settings
+type xrayAddress struct {
+	Address string          `json:"address"`
+	Port    json.RawMessage `json:"port"`
+}
+
+// xrayInfo is what saferay derives from an Xray or sing-box config
+type xrayInfo struct {
+	Path   string `json:"path"`
+	Client string `json:"client"`
+	// Tunnel is the interface a tun inbound creates
+	Tunnel string `json:"tunnel,omitempty"`
+	// TunnelNetworks are the tun inbound's address ranges, which find the
+	// interface when sing-box picks its name
+	TunnelNetworks []string `json:"tunnel_networks,omitempty"`
+	// WideNetworks are tun address ranges too wide to pass DNS to
+	WideNetworks []string `json:"wide_networks,omitempty"`
+	// StrictRoute means sing-box itself drops traffic that bypasses the
+	// tun
+	StrictRoute bool `json:"strict_route"`
+	// DNSInbounds take DNS queries on port 53
+	DNSInbounds []xrayEndpoint `json:"dns_inbounds"`
+	// Servers are the proxy servers the outbounds connect to
+	Servers    []xrayEndpoint  `json:"servers"`
+	DNSServers []xrayDNSServer `json:"dns_servers"`
+}
+
+// tunNetworkTooWide reports whether a tun address range is wider than a
+// /16, or a /64 for IPv6. A pass for it would let DNS to most of the
+// internet through the block rule.
+func tunNetworkTooWide(network *net.IPNet) bool {
+	ones, bits := network.Mask.Size()
+	if bits == 32 {
+		return ones < 16
+	}
+	return ones < 64
+}
+
+// xrayEndpoint is an address and port an inbound listens on or an
+// outbound connects to
+type xrayEndpoint struct {
+	Tag      string `json:"tag"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+}
+
+// xrayDNSServer is a server in Xray's dns block and how its queries leave
+type xrayDNSServer struct {
+	Address string `json:"address"`
+	// Plaintext queries are unencrypted UDP or TCP
+	Plaintext bool `json:"plaintext"`
+	Port      int  `json:"port,omitempty"`
+	// Via is the outbound the queries take; "local" for the +local
+	// variants, which Xray sends itself, and "system" for localhost
+	Via string `json:"via,omitempty"`
+	// Blocked means the queries go to port 53 outside the tunnel, where
+	// the firewall drops them
+	Blocked bool `json:"blocked"`
+}
+
+// findXrayConfig returns the configured client config path, or the most
+// recently changed of those found: Hiddify rewrites its config for the
+// active profile on every connect
+func findXrayConfig(cfg *Config) string {
+	if cfg.XrayConfig != "" {
+		return cfg.XrayConfig
+	}
+
+	var newest string
+	var newestTime time.Time
+	for _, path := range clientConfigs() {
+		if info, err := os.Stat(path); err == nil && info.ModTime().After(newestTime) {
+			newest, newestTime = path, info.ModTime()
+		}
+	}
+	return newest
+}
+
+// clientConfigError is why the configured client config can't be read,
+// or nil. Tunnel detection then falls back to the tun devices.
+func clientConfigError(cfg *Config) error {
+	if cfg.XrayConfig == "" {
+		return nil
+	}
+	_, err := readXrayConfig(cfg.XrayConfig)
+	return err
+}
+
+// readXrayConfig parses an Xray or sing-box config. Comments are allowed,
+// as Xray allows them.
+func readXrayConfig(path string) (*xrayInfo, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	data = stripJSONComments(data)
+	if isSingboxConfig(data) {
+		info, err := readSingboxConfig(path, data)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", path, err)
+		}
+		return info, nil
+	}
+
+	var c xrayConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	info := &xrayInfo{Path: path, Client: clientXray, DNSInbounds: []xrayEndpoint{}, Servers: []xrayEndpoint{}, DNSServers: []xrayDNSServer{}}
+	for _, in := range c.Inbounds {
+		switch in.Protocol {
+		case "tun":
+			var s struct {
+				Name string `json:"name"`
+			}
+			_ = json.Unmarshal(in.Settings, &s)
+			if info.Tunnel == "" {
+				info.Tunnel = s.Name
+			}
+		case "dokodemo-door", "tunnel":
+			if port := xrayPort(in.Port); port == 53 {
+				listen := in.Listen
+				if listen == "" {
+					listen = "0.0.0.0"
+				}
+				info.DNSInbounds = append(info.DNSInbounds, xrayEndpoint{in.Tag, in.Protocol, listen, port})
+			}
+		}
+	}
+	for _, out := range c.Outbounds {
+		info.Servers = append(info.Servers, xrayServers(out)...)
+	}
+	for _, raw := range c.DNS.Servers {
+		info.DNSServers = append(info.DNSServers, c.dnsServer(raw))
+	}
+	return info, nil
+}
+
+// xrayServers returns the servers a proxy outbound connects to
+func xrayServers(out xrayBound) []xrayEndpoint {
+	switch out.Protocol {
+	case "freedom", "blackhole", "dns", "loopback":
+		return nil
+	}
+
+	var s struct {
+		Vnext   []xrayAddress `json:"vnext"`
+		Servers []xrayAddress `json:"servers"`
+		Peers   []struct {
+			Endpoint string `json:"endpoint"`
+		} `json:"peers"`
+		// Newer outbounds put the server in settings directly
+		xrayAddress
+	}
+	_ = json.Unmarshal(out.Settings, &s)
+
+	addresses := append(s.Vnext, s.Servers...)
+	if s.Address != "" {
+		addresses = append(addresses, s.xrayAddress)
+	}
+	var servers []xrayEndpoint
+	for _, a := range addresses {
+		servers = append(servers, xrayEndpoint{out.Tag, out.Protocol, a.Address, xrayPort(a.Port)})
+	}
+	for _, peer := range s.Peers {
+		host, port, err := net.SplitHostPort(peer.Endpoint)
+		if err == nil {
+			p, _ := strconv.Atoi(port)
+			servers = append(servers, xrayEndpoint{out.Tag, out.Protocol, host, p})
+		}
+	}
+	return servers
+}
+
+// dnsServer works out where the queries to a dns block server go. A
+// server is an address string or an object with address and port.
+func (c *xrayConfig) dnsServer(raw json.RawMessage) xrayDNSServer {
+	var address string
+	port := 0
+	if json.Unmarshal(raw, &address) != nil {
+		var obj xrayAddress
+		_ = json.Unmarshal(raw, &obj)
+		address, port = obj.Address, xrayPort(obj.Port)
+	}
+	s := xrayDNSServer{Address: address}
+
+	switch {
+	case address == "fakedns":
+		return s
+	case address == "localhost":
+		// The system resolver is subject to the firewall like any app
+		s.Plaintext, s.Via = true, "system"
+		return s
+	}
+
+	scheme, host, found := strings.Cut(address, "://")
+	if !found {
+		scheme, host = "udp", address
+	}
+	local := strings.HasSuffix(scheme, "+local")
+	scheme = strings.TrimSuffix(scheme, "+local")
+	s.Plaintext = scheme == "udp" || scheme == "tcp"
+
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host = h
+		port, _ = strconv.Atoi(p)
+	}
+	if s.Plaintext && port == 0 {
+		port = 53
+	}
+	s.Port = port
+
+	if local {
+		s.Via = "local"
+		s.Blocked = s.Plaintext && port == 53
+		return s
+	}
+	out := c.route(host, port, scheme)
+	s.Via = out.Tag
+	if s.Via == "" {
+		s.Via = out.Protocol
+	}
+	s.Blocked = s.Plaintext && port == 53 && out.Protocol == "freedom"
+	return s
+}
+
+// route returns the outbound Xray's queries to host take: the first
+// routing rule that matches, otherwise the first outbound. Only rules on
+// the DNS inbound tag, IP, port and network are evaluated; rules that
+// need anything else can't match a query to an address anyway.
+func (c *xrayConfig) route(host string, port int, network string) xrayBound {
+	for _, rule := range c.Routing.Rules {
+		if !c.ruleMatches(rule, host, port, network) {
+			continue
+		}
+		var tag string
+		if json.Unmarshal(rule["outboundTag"], &tag) != nil {
+			var balancer string
+			_ = json.Unmarshal(rule["balancerTag"], &balancer)
+			return xrayBound{Tag: balancer, Protocol: "balancer"}
+		}
+		for _, out := range c.Outbounds {
+			if out.Tag == tag {
+				return out
+			}
+		}
+		return xrayBound{Tag: tag}
+	}
+
+	if len(c.Outbounds) > 0 {
+		return c.Outbounds[0]
+	}
+	return xrayBound{}
+}
+
+func (c *xrayConfig) ruleMatches(rule map[string]json.RawMessage, host string, port int, network string) bool {
+	for key, value := range rule {
+		switch key {
+		case "type", "outboundTag", "balancerTag", "ruleTag":
+		case "inboundTag":
+			var tags []string
+			_ = json.Unmarshal(value, &tags)
+			if c.DNS.Tag == "" || !contains(tags, c.DNS.Tag) {
+				return false
+			}
+		case "ip":
+			var patterns []string
+			_ = json.Unmarshal(value, &patterns)
+			if !xrayIPMatches(patterns, host) {
+				return false
+			}
+		case "port":
+			if !xrayPortMatches(value, port) {
+				return false
+			}
+		case "network":
+			var networks string
+			_ = json.Unmarshal(value, &networks)
+			if !strings.Contains(networks, network) {
+				return false
+			}
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// xrayIPMatches checks an address against a rule's ip list. Of the geoip
+// lists only "private" is known without the geoip database.
+func xrayIPMatches(patterns []string, host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "geoip:private":
+			if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				return true
+			}
+		case strings.Contains(pattern, "/"):
+			if _, network, err := net.ParseCIDR(pattern); err == nil && network.Contains(ip) {
+				return true
+			}
+		case ip.Equal(net.ParseIP(pattern)):
+			return true
+		}
+	}
+	return false
+}
+
+// xrayPortMatches checks a port against a rule's port: a number, or a
+// string of ports and ranges such as "53,443,1000-2000"
+func xrayPortMatches(value json.RawMessage, port int) bool {
+	var n int
+	if json.Unmarshal(value, &n) == nil {
+		return n == port
+	}
+	var list string
+	_ = json.Unmarshal(value, &list)
+	for _, part := range strings.Split(list, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		if !isRange {
+			to = from
+		}
+		low, err1 := strconv.Atoi(from)
+		high, err2 := strconv.Atoi(to)
+		if err1 == nil && err2 == nil && port >= low && port <= high {
+			return true
+		}
+	}
+	return false
+}
+
+// xrayPort reads a port given as a number or a string. Ranges and
+// environment references give 0.
+func xrayPort(value json.RawMessage) int {
+	var n int
+	if json.Unmarshal(value, &n) == nil {
+		return n
+	}
+	var s string
+	_ = json.Unmarshal(value, &s)
+	n, _ = strconv.Atoi(s)
+	return n
+}
+
+// stripJSONComments blanks out // and /* */ comments outside strings
+func stripJSONComments(data []byte) []byte {
+	out := make([]byte, 0, len(data))
+	inString := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			out = append(out, c)
+			if c == '\\' && i+1 < len(data) {
+				i++
+				out = append(out, data[i])
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+			out = append(out, c)
+		case c == '/' && i+1 < len(data) && data[i+1] == '/':
+			for i < len(data) && data[i] != '\n' {
+				i++
+			}
+			if i < len(data) {
+				out = append(out, '\n')
+			}
+		case c == '/' && i+1 < len(data) && data[i+1] == '*':
+			end := strings.Index(string(data[i+2:]), "*/")
+			if end < 0 {
+				return out
+			}
+			i += end + 3
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// xrayTagPattern is what a tag may contain as a config key
+var xrayTagPattern = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// passes returns the firewall passes for the addresses the client uses on
+// port 53: proxy servers listening there, with names resolved now, DNS
+// inbounds on addresses outside loopback, and the tun's networks when it
+// has no fixed name. Names that don't resolve are returned as errors.
+func (x *xrayInfo) passes() ([]XrayPass, []error) {
+	var passes []XrayPass
+	var errs []error
+	add := func(tag, protocol string, ips []string) {
+		if tag == "" {
+			tag = protocol
+		}
+		tag = xrayTagPattern.ReplaceAllString(tag, "-")
+		for i := range passes {
+			if passes[i].Tag == tag {
+				for _, ip := range ips {
+					if !contains(passes[i].Addresses, ip) {
+						passes[i].Addresses = append(passes[i].Addresses, ip)
+					}
+				}
+				return
+			}
+		}
+		passes = append(passes, XrayPass{Tag: tag, Addresses: ips})
+	}
+
+	for _, s := range x.Servers {
+		if s.Port != 53 {
+			continue
+		}
+		if net.ParseIP(s.Address) != nil {
+			add(s.Tag, s.Protocol, []string{s.Address})
+			continue
+		}
+		ips, err := net.LookupHost(s.Address)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("resolving server %s: %w", s.Address, err))
+			continue
+		}
+		add(s.Tag, s.Protocol, ips)
+	}
+
+	for _, in := range x.DNSInbounds {
+		ip := net.ParseIP(in.Address)
+		if ip != nil && !ip.IsLoopback() && !ip.IsUnspecified() {
+			add(in.Tag, "dns-in", []string{in.Address})
+		}
+	}
+
+	// DNS to the tun's own addresses passes whatever utun it ends up on
+	if x.Tunnel == "" && len(x.TunnelNetworks) > 0 {
+		add("tun", "tun", x.TunnelNetworks)
+	}
+	return passes, errs
+}
+
+// applyXrayConfig reads the client config, if there is one, and updates
+// cfg with what the firewall needs from it: the config's path, so the
+// watch daemon reads the same one, the tunnel, unless one is configured,
+// and passes for the client's own port 53 traffic. It warns about DNS
+// servers the firewall will block.
+func applyXrayConfig(cfg *Config) {
+	path := findXrayConfig(cfg)
+	if path == "" {
+		return
+	}
+	info, err := readXrayConfig(path)
+	if err != nil {
+		fmt.Printf("Error reading client config: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Reading %s config %s\n", info.Client, path)
+
+	before := cfg.String()
+	cfg.XrayConfig = path
+	switch {
+	case info.Tunnel == "":
+	case cfg.Tunnel == "":
+		cfg.Tunnel = info.Tunnel
+		fmt.Printf("  Tunnel: %s (from the tun inbound)\n", info.Tunnel)
+	case cfg.Tunnel != info.Tunnel:
+		fmt.Printf("  ⚠ The tun inbound creates %s, but tunnel=%s is configured\n", info.Tunnel, cfg.Tunnel)
+	}
+	for _, network := range info.WideNetworks {
+		fmt.Printf("  ⚠ Ignoring tun address range %s: wider than a /16 (/64 for IPv6)\n", network)
+	}
+	if info.StrictRoute {
+		fmt.Println("  sing-box strict_route is on: it drops traffic that bypasses the tun too")
+	}
+
+	passes, errs := info.passes()
+	for _, err := range errs {
+		fmt.Printf("  ⚠ %v\n", err)
+	}
+	cfg.XrayPasses = passes
+	for _, p := range passes {
+		fmt.Printf("  Allowing %s on port 53 (%s)\n", strings.Join(p.Addresses, ", "), p.Tag)
+	}
+
+	for _, s := range info.DNSServers {
+		if s.Blocked {
+			fmt.Printf("  ⚠ %s DNS server %s sends plaintext DNS outside the tunnel (%s); it will be blocked\n", info.Client, s.Address, s.Via)
+			fmt.Println("    Use a DoH server such as https://dns.google/dns-query, or route it through the proxy")
+		}
+	}
+
+	if cfg.String() != before {
+		if err := saveConfig(cfg); err != nil {
+			fmt.Printf("Error saving config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	fmt.Println()
+}
+
+func newXrayConfigCmd() *cobra.Command {
+	cmd := groupCmd("config", "Read or patch the Xray, sing-box or Hiddify config saferay protects")
+	cmd.AddCommand(newXrayConfigPatchCmd(), &cobra.Command{
+		Use:   "show [config.json]",
+		Short: "Show the tunnel, DNS and servers saferay derives from the client's config",
+		Long: `Read an Xray, V2Ray or sing-box config, by default the one set as
+xray_config in saferay.conf, or else the most recently changed of Xray's
+and sing-box's system configs and Hiddify's profiles, and show what 'xray
+install' takes from it: the tun inbound's interface or address range, DNS
+inbounds on port 53, the proxy servers of the outbounds, and where each
+DNS server sends its queries. Plaintext servers whose queries leave
+outside the tunnel, through a freedom or direct outbound or a +local
+address, are blocked by the firewall.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path := ""
+			if len(args) > 0 {
+				path = args[0]
+			}
+			showXrayConfig(path)
+		},
+	})
+	return cmd
+}
+
+// xrayConfigReport is the result of 'saferay xray config show'
+type xrayConfigReport struct {
+	report
+	*xrayInfo
+}
+
+func showXrayConfig(path string) {
+	st := xrayConfigReport{report: newReport("xray config show")}
+	cfg := loadConfig()
+	if path == "" {
+		path = findXrayConfig(cfg)
+	}
+
+	if path == "" {
+		st.fail(exitFailure, "no Xray config found; set xray_config in %s", configPath)
+	} else if info, err := readXrayConfig(path); err != nil {
+		st.fail(exitFailure, "%v", err)
+	} else {
+		st.xrayInfo = info
+	}
+
+	finish(&st.report, st, func() {
+		if st.xrayInfo == nil {
+			fmt.Println(st.Problems[0])
+			return
+		}
+		fmt.Printf("=== %s config: %s ===\n", st.Client, st.Path)
+		fmt.Println()
+
+		tunnel := st.Tunnel
+		switch {
+		case tunnel != "":
+		case len(st.TunnelNetworks) > 0:
+			tunnel = strings.Join(st.TunnelNetworks, ", ")
+			if name := interfaceWithin(st.TunnelNetworks); name != "" {
+				tunnel += " on " + name
+			}
+		default:
+			tunnel = "no tun inbound"
+		}
+		fmt.Printf("Tunnel:       %s (saferay uses %s)\n", tunnel, tunnelInterface(cfg))
+		for _, network := range st.WideNetworks {
+			fmt.Printf("              ⚠ %s ignored: wider than a /16 (/64 for IPv6)\n", network)
+		}
+		if st.Client == clientSingbox {
+			fmt.Println("Strict route: " + mark(st.StrictRoute, "on", "off"))
+		}
+
+		fmt.Println("\nDNS inbounds:")
+		if len(st.DNSInbounds) == 0 {
+			fmt.Println("  (none on port 53)")
+		}
+		for _, in := range st.DNSInbounds {
+			fmt.Printf("  %-16s %s:%d\n", in.Tag, in.Address, in.Port)
+		}
+
+		fmt.Println("\nServers:")
+		if len(st.Servers) == 0 {
+			fmt.Println("  (none)")
+		}
+		for _, s := range st.Servers {
+			fmt.Printf("  %-16s %-12s %s\n", s.Tag, s.Protocol, net.JoinHostPort(s.Address, strconv.Itoa(s.Port)))
+		}
+
+		fmt.Println("\nDNS servers:")
+		if len(st.DNSServers) == 0 {
+			fmt.Println("  (none, Xray uses the system resolver)")
+		}
+		for _, s := range st.DNSServers {
+			// Servers going nowhere answer inside the client: fake IPs,
+			// fixed rcodes
+			kind := "internal"
+			switch {
+			case s.Plaintext:
+				kind = "plaintext"
+			case s.Via != "":
+				kind = "encrypted"
+			}
+			line := fmt.Sprintf("  %-36s %-10s", s.Address, kind)
+			if s.Via != "" {
+				line += " via " + s.Via
+			}
+			if s.Blocked {
+				line = "⚠" + line[1:] + " — blocked by the firewall"
+			}
+			fmt.Println(strings.TrimRight(line, " "))
+		}
+	})
+}
@@ -0,0 +1,625 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// xrayDoH is the DNS server patched configs use, pinned to light
+	// mode's resolvers through the dns block's hosts
+	xrayDoH     = "https://dns.google/dns-query"
+	xrayDoHHost = "dns.google"
+	// xrayDNSTag is the dns block tag patched configs route by, unless
+	// the block already has one
+	xrayDNSTag = "dns-internal"
+	// xrayRuleTagPrefix marks the routing rules patch adds, so patching
+	// again replaces them
+	xrayRuleTagPrefix = "saferay-"
+)
+
+func newXrayConfigPatchCmd() *cobra.Command {
+	var outbound string
+	var ipv6 bool
+
+	cmd := &cobra.Command{
+		Use:   "patch [config.json]",
+		Short: "Rewrite Xray's dns and routing sections to match saferay's policy",
+		Long: `Rewrite the dns section of an Xray config to resolve through DoH to
+dns.google, pinned to 8.8.8.8 and 8.8.4.4 in hosts, and add routing rules
+that send Xray's own queries through the proxy and port 53 traffic to the
+dns outbound, or the proxy when there is none. Other servers are kept,
+except plaintext +local ones, which the firewall blocks.
+
+The config is validated before and after patching, and by 'xray run -test'
+when xray is installed. The diff is shown and the original is kept next to
+it as <config>.<time>.bak. Comments and hand formatting are not kept.
+With --dry-run only the diff is shown.`,
+		Example: "  saferay --dry-run xray config patch /usr/local/etc/xray/config.json\n  saferay xray config patch --outbound proxy-de",
+		Args:    cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			path := ""
+			if len(args) > 0 {
+				path = args[0]
+			}
+			patchXrayConfig(path, outbound, ipv6)
+		},
+	}
+	cmd.Flags().StringVar(&outbound, "outbound", "", "tag of the outbound DNS goes through (default the first proxy outbound)")
+	cmd.Flags().BoolVar(&ipv6, "ipv6", false, "resolve IPv6 addresses too (queryStrategy UseIP)")
+
+	return cmd
+}
+
+func patchXrayConfig(path, outbound string, ipv6 bool) {
+	if path == "" {
+		path = findXrayConfig(loadConfig())
+	}
+	if path == "" {
+		fmt.Printf("No Xray config found; pass its path or set xray_config in %s\n", configPath)
+		os.Exit(1)
+	}
+	original, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Printf("Error reading Xray config: %v\n", err)
+		os.Exit(1)
+	}
+
+	data := stripJSONComments(original)
+	if isSingboxConfig(data) {
+		fmt.Printf("%s is a sing-box config; only Xray configs can be patched\n", path)
+		os.Exit(1)
+	}
+	if problems := validateXrayConfig(data); len(problems) > 0 {
+		fmt.Printf("%s is not a valid Xray config:\n", path)
+		for _, p := range problems {
+			fmt.Println("  " + p)
+		}
+		os.Exit(1)
+	}
+
+	patched, notes, err := patchXrayJSON(data, outbound, ipv6, jsonIndent(original))
+	if err != nil {
+		fmt.Printf("Error patching %s: %v\n", path, err)
+		os.Exit(1)
+	}
+	if problems := validateXrayConfig(patched); len(problems) > 0 {
+		fmt.Println("The patched config doesn't validate:")
+		for _, p := range problems {
+			fmt.Println("  " + p)
+		}
+		os.Exit(1)
+	}
+
+	var before, after bytes.Buffer
+	if json.Compact(&before, data) == nil && json.Compact(&after, patched) == nil && before.String() == after.String() {
+		fmt.Printf("✓ %s already matches saferay's DNS policy\n", path)
+		return
+	}
+	if err := testXrayConfig(patched); err != nil {
+		fmt.Printf("Xray rejected the patched config: %v\n", err)
+		os.Exit(1)
+	}
+
+	// Dry runs show the diff as part of writing
+	if !sys.dryRun {
+		fmt.Print(unifiedDiff(path, string(original), string(patched)))
+		fmt.Println()
+	}
+
+	// Never overwrite an earlier backup, it may be the only original
+	backup := fmt.Sprintf("%s.%s.bak", path, time.Now().Format("20060102-150405"))
+	for i := 2; ; i++ {
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			break
+		}
+		backup = fmt.Sprintf("%s.%s-%d.bak", path, time.Now().Format("20060102-150405"), i)
+	}
+	if sys.dryRun {
+		fmt.Printf("[dry-run] back up %s to %s\n", path, backup)
+	} else if err := sys.writeFileLike(backup, original, path); err != nil {
+		fmt.Printf("Error writing backup: %v\n", err)
+		os.Exit(1)
+	}
+	// A user's config, such as Homebrew's, stays the user's
+	if err := sys.writeFileLike(path, patched, path); err != nil {
+		fmt.Printf("Error writing %s: %v\n", path, err)
+		os.Exit(1)
+	}
+
+	for _, note := range notes {
+		fmt.Println("  " + note)
+	}
+	fmt.Printf("✓ Patched %s (backup: %s)\n", path, backup)
+	fmt.Println("  Restart Xray to use it, then run 'saferay xray install' to update the firewall")
+}
+
+// patchXrayJSON applies saferay's DNS policy to a config, keeping the
+// order of everything it doesn't change. notes say what was dropped.
+func patchXrayJSON(data []byte, outbound string, ipv6 bool, indent string) ([]byte, []string, error) {
+	var c xrayConfig
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, nil, err
+	}
+	root, err := parseJSONObject(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	proxy, err := c.proxyOutbound(outbound)
+	if err != nil {
+		return nil, nil, err
+	}
+	port53 := proxy
+	for _, out := range c.Outbounds {
+		if out.Protocol == "dns" && out.Tag != "" {
+			port53 = out.Tag
+			break
+		}
+	}
+
+	// dns: DoH first, pinned in hosts, then the servers that can stay
+	dns, err := parseJSONObject(root.get("dns"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("dns: %w", err)
+	}
+	if c.DNS.Tag == "" {
+		c.DNS.Tag = xrayDNSTag
+	}
+	hosts, err := parseJSONObject(dns.get("hosts"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("dns.hosts: %w", err)
+	}
+	hosts.set(xrayDoHHost, []string{defaultDNS, defaultDNS2})
+
+	var notes []string
+	servers := []json.RawMessage{json.RawMessage(`"` + xrayDoH + `"`)}
+	for _, raw := range c.DNS.Servers {
+		s := c.dnsServer(raw)
+		switch {
+		case s.Address == xrayDoH:
+		case s.Plaintext && s.Via == "local":
+			notes = append(notes, fmt.Sprintf("Dropped DNS server %s: plaintext DNS sent outside the tunnel", s.Address))
+		default:
+			servers = append(servers, raw)
+		}
+	}
+
+	strategy := "UseIPv4"
+	if ipv6 {
+		strategy = "UseIP"
+	}
+	dns.set("hosts", hosts)
+	dns.set("servers", servers)
+	dns.set("queryStrategy", strategy)
+	dns.set("tag", c.DNS.Tag)
+	root.set("dns", dns)
+
+	// routing: saferay's rules first, replacing those of an earlier patch
+	routing, err := parseJSONObject(root.get("routing"))
+	if err != nil {
+		return nil, nil, fmt.Errorf("routing: %w", err)
+	}
+	rules := []json.RawMessage{
+		jsonObject{
+			{"type", json.RawMessage(`"field"`)},
+			jsonMember{Key: "ruleTag"}.with(xrayRuleTagPrefix + "dns"),
+			jsonMember{Key: "inboundTag"}.with([]string{c.DNS.Tag}),
+			jsonMember{Key: "outboundTag"}.with(proxy),
+		}.raw(),
+		jsonObject{
+			{"type", json.RawMessage(`"field"`)},
+			jsonMember{Key: "ruleTag"}.with(xrayRuleTagPrefix + "port53"),
+			{"port", json.RawMessage(`"53"`)},
+			jsonMember{Key: "outboundTag"}.with(port53),
+		}.raw(),
+	}
+	var existing []json.RawMessage
+	_ = json.Unmarshal(routing.get("rules"), &existing)
+	for _, raw := range existing {
+		var rule struct {
+			RuleTag string `json:"ruleTag"`
+		}
+		if json.Unmarshal(raw, &rule) == nil && strings.HasPrefix(rule.RuleTag, xrayRuleTagPrefix) {
+			continue
+		}
+		rules = append(rules, raw)
+	}
+	routing.set("rules", rules)
+	root.set("routing", routing)
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", indent)
+	if err := enc.Encode(root); err != nil {
+		return nil, nil, err
+	}
+	return out.Bytes(), notes, nil
+}
+
+// proxyOutbound returns the tag of the outbound DNS should go through:
+// the named one, or the first that connects to a proxy server
+func (c *xrayConfig) proxyOutbound(tag string) (string, error) {
+	for _, out := range c.Outbounds {
+		switch {
+		case tag != "" && out.Tag == tag:
+			return tag, nil
+		case tag == "" && len(xrayServers(out)) > 0:
+			if out.Tag == "" {
+				return "", fmt.Errorf("the %s outbound has no tag for routing rules to name; add one", out.Protocol)
+			}
+			return out.Tag, nil
+		}
+	}
+	if tag != "" {
+		return "", fmt.Errorf("no outbound tagged %q", tag)
+	}
+	return "", fmt.Errorf("no proxy outbound found; name one with --outbound")
+}
+
+// testXrayConfig has Xray check the config, when it's installed
+func testXrayConfig(data []byte) error {
+	xray, err := exec.LookPath("xray")
+	if err != nil {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp("", "saferay-xray-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	out, err := exec.Command(xray, "run", "-test", "-c", tmp.Name()).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s", strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// jsonIndent returns the indentation a JSON file uses, two spaces if it
+// can't tell
+func jsonIndent(data []byte) string {
+	for _, line := range strings.Split(string(data), "\n")[1:] {
+		trimmed := strings.TrimLeft(line, " \t")
+		if trimmed != "" && len(trimmed) < len(line) {
+			return line[:len(line)-len(trimmed)]
+		}
+	}
+	return "  "
+}
+
+// jsonObject is a JSON object that keeps its keys in order, so a patched
+// file only changes where it was patched
+type jsonObject []jsonMember
+
+type jsonMember struct {
+	Key   string
+	Value json.RawMessage
+}
+
+// with returns the member with value marshalled, leaving <, > and &
+// as they are
+func (m jsonMember) with(value any) jsonMember {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(value)
+	m.Value = bytes.TrimSpace(b.Bytes())
+	return m
+}
+
+// parseJSONObject reads the top level of an object; an absent value is
+// an empty object
+func parseJSONObject(data []byte) (jsonObject, error) {
+	if len(bytes.TrimSpace(data)) == 0 || string(data) == "null" {
+		return jsonObject{}, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("not a JSON object")
+	}
+	o := jsonObject{}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		o = append(o, jsonMember{tok.(string), value})
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func (o jsonObject) get(key string) json.RawMessage {
+	for _, m := range o {
+		if m.Key == key {
+			return m.Value
+		}
+	}
+	return nil
+}
+
+// set replaces a member's value in place, or appends it
+func (o *jsonObject) set(key string, value any) {
+	m := jsonMember{Key: key}.with(value)
+	for i := range *o {
+		if (*o)[i].Key == key {
+			(*o)[i] = m
+			return
+		}
+	}
+	*o = append(*o, m)
+}
+
+func (o jsonObject) raw() json.RawMessage {
+	data, _ := o.MarshalJSON()
+	return data
+}
+
+func (o jsonObject) MarshalJSON() ([]byte, error) {
+	var b bytes.Buffer
+	b.WriteByte('{')
+	for i, m := range o {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		key, _ := json.Marshal(m.Key)
+		b.Write(key)
+		b.WriteByte(':')
+		b.Write(m.Value)
+	}
+	b.WriteByte('}')
+	return b.Bytes(), nil
+}
+
+// validateXrayConfig checks a config against the parts of Xray's schema
+// saferay reads and writes. Problems are given as "path: message", with
+// JSON pointer paths such as /dns/servers/2.
+func validateXrayConfig(data []byte) []string {
+	var root any
+	if err := json.Unmarshal(data, &root); err != nil {
+		return []string{err.Error()}
+	}
+	v := &xrayValidator{}
+	v.config(root)
+	return v.problems
+}
+
+type xrayValidator struct {
+	problems []string
+}
+
+func (v *xrayValidator) fail(path, format string, args ...any) {
+	if path == "" {
+		path = "/"
+	}
+	v.problems = append(v.problems, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *xrayValidator) object(path string, value any) map[string]any {
+	o, ok := value.(map[string]any)
+	if !ok {
+		v.fail(path, "must be an object")
+	}
+	return o
+}
+
+func (v *xrayValidator) array(path string, value any) []any {
+	a, ok := value.([]any)
+	if !ok {
+		v.fail(path, "must be an array")
+	}
+	return a
+}
+
+func (v *xrayValidator) str(path string, value any) string {
+	s, ok := value.(string)
+	if !ok {
+		v.fail(path, "must be a string")
+	}
+	return s
+}
+
+func (v *xrayValidator) stringList(path string, value any) []string {
+	var list []string
+	for i, item := range v.array(path, value) {
+		list = append(list, v.str(fmt.Sprintf("%s/%d", path, i), item))
+	}
+	return list
+}
+
+func (v *xrayValidator) oneOf(path string, value any, allowed ...string) {
+	if s := v.str(path, value); s != "" && !contains(allowed, s) {
+		v.fail(path, "must be one of %s", strings.Join(allowed, ", "))
+	}
+}
+
+// port accepts a number, or a string of ports and ranges
+func (v *xrayValidator) port(path string, value any) {
+	switch p := value.(type) {
+	case float64:
+		if p < 1 || p > 65535 || p != float64(int(p)) {
+			v.fail(path, "must be a port between 1 and 65535")
+		}
+	case string:
+		if p == "" {
+			v.fail(path, "must not be empty")
+		}
+	default:
+		v.fail(path, "must be a number or a string")
+	}
+}
+
+func (v *xrayValidator) config(root any) {
+	c := v.object("", root)
+	if c == nil {
+		return
+	}
+
+	inbounds, outbounds := map[string]bool{}, map[string]bool{}
+	if raw, ok := c["inbounds"]; ok {
+		for i, in := range v.array("/inbounds", raw) {
+			v.bound(fmt.Sprintf("/inbounds/%d", i), in, inbounds)
+		}
+	}
+	if raw, ok := c["outbounds"]; ok {
+		for i, out := range v.array("/outbounds", raw) {
+			v.bound(fmt.Sprintf("/outbounds/%d", i), out, outbounds)
+		}
+	}
+	if raw, ok := c["dns"]; ok {
+		v.dns("/dns", raw, inbounds)
+	}
+	if raw, ok := c["routing"]; ok {
+		v.routing("/routing", raw, outbounds)
+	}
+}
+
+// bound checks an inbound or outbound, collecting its tag
+func (v *xrayValidator) bound(path string, value any, tags map[string]bool) {
+	b := v.object(path, value)
+	if b == nil {
+		return
+	}
+	if protocol, ok := b["protocol"]; !ok {
+		v.fail(path, "protocol is required")
+	} else if v.str(path+"/protocol", protocol) == "" {
+		v.fail(path+"/protocol", "must not be empty")
+	}
+	if raw, ok := b["tag"]; ok {
+		tag := v.str(path+"/tag", raw)
+		if tags[tag] {
+			v.fail(path+"/tag", "duplicate tag %q", tag)
+		}
+		tags[tag] = true
+	}
+	if raw, ok := b["listen"]; ok {
+		v.str(path+"/listen", raw)
+	}
+	if raw, ok := b["port"]; ok {
+		v.port(path+"/port", raw)
+	}
+	if raw, ok := b["settings"]; ok {
+		v.object(path+"/settings", raw)
+	}
+}
+
+func (v *xrayValidator) dns(path string, value any, inbounds map[string]bool) {
+	d := v.object(path, value)
+	if d == nil {
+		return
+	}
+	if raw, ok := d["servers"]; ok {
+		for i, server := range v.array(path+"/servers", raw) {
+			v.dnsServer(fmt.Sprintf("%s/servers/%d", path, i), server)
+		}
+	}
+	if raw, ok := d["hosts"]; ok {
+		for host, target := range v.object(path+"/hosts", raw) {
+			if _, ok := target.(string); !ok {
+				v.stringList(path+"/hosts/"+host, target)
+			}
+		}
+	}
+	if raw, ok := d["queryStrategy"]; ok {
+		v.oneOf(path+"/queryStrategy", raw, "UseIP", "UseIPv4", "UseIPv6")
+	}
+	if raw, ok := d["tag"]; ok {
+		inbounds[v.str(path+"/tag", raw)] = true
+	}
+}
+
+// dnsServer accepts an address, or an object with one
+func (v *xrayValidator) dnsServer(path string, value any) {
+	if s, ok := value.(string); ok {
+		if s == "" {
+			v.fail(path, "must not be empty")
+		}
+		return
+	}
+	s, ok := value.(map[string]any)
+	if !ok {
+		v.fail(path, "must be an address or an object")
+		return
+	}
+	if raw, ok := s["address"]; !ok {
+		v.fail(path, "address is required")
+	} else if v.str(path+"/address", raw) == "" {
+		v.fail(path+"/address", "must not be empty")
+	}
+	if raw, ok := s["port"]; ok {
+		v.port(path+"/port", raw)
+	}
+	for _, key := range []string{"domains", "expectIPs"} {
+		if raw, ok := s[key]; ok {
+			v.stringList(path+"/"+key, raw)
+		}
+	}
+}
+
+func (v *xrayValidator) routing(path string, value any, outbounds map[string]bool) {
+	r := v.object(path, value)
+	if r == nil {
+		return
+	}
+	if raw, ok := r["domainStrategy"]; ok {
+		v.oneOf(path+"/domainStrategy", raw, "AsIs", "IPIfNonMatch", "IPOnDemand")
+	}
+	raw, ok := r["rules"]
+	if !ok {
+		return
+	}
+
+	for i, value := range v.array(path+"/rules", raw) {
+		rulePath := fmt.Sprintf("%s/rules/%d", path, i)
+		rule := v.object(rulePath, value)
+		if rule == nil {
+			continue
+		}
+
+		tag, hasTag := rule["outboundTag"]
+		_, hasBalancer := rule["balancerTag"]
+		switch {
+		case hasTag:
+			if t := v.str(rulePath+"/outboundTag", tag); len(outbounds) > 0 && !outbounds[t] {
+				v.fail(rulePath+"/outboundTag", "no outbound tagged %q", t)
+			}
+		case !hasBalancer:
+			v.fail(rulePath, "outboundTag or balancerTag is required")
+		}
+		for _, key := range []string{"inboundTag", "ip", "domain", "source"} {
+			if raw, ok := rule[key]; ok {
+				v.stringList(rulePath+"/"+key, raw)
+			}
+		}
+		if raw, ok := rule["port"]; ok {
+			v.port(rulePath+"/port", raw)
+		}
+		if raw, ok := rule["network"]; ok {
+			v.str(rulePath+"/network", raw)
+		}
+	}
+}
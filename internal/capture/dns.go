@@ -0,0 +1,237 @@
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// DNSMessage is a decoded DNS message. Answer records are counted but not
+// decoded; leak analysis only needs the question and EDNS0.
+type DNSMessage struct {
+	ID        uint16
+	Response  bool
+	Opcode    int
+	RCode     int
+	Questions []DNSQuestion
+	Answers   int
+	// EDNS is set when the message has an OPT record
+	EDNS *EDNS
+}
+
+// DNSQuestion is an entry of the question section
+type DNSQuestion struct {
+	Name  string
+	Type  uint16
+	Class uint16
+}
+
+// TypeName names the query type, e.g. "AAAA" or "TYPE65534"
+func (q DNSQuestion) TypeName() string {
+	if name, ok := dnsTypes[q.Type]; ok {
+		return name
+	}
+	return "TYPE" + strconv.Itoa(int(q.Type))
+}
+
+var dnsTypes = map[uint16]string{
+	1: "A", 2: "NS", 5: "CNAME", 6: "SOA", 12: "PTR", 15: "MX", 16: "TXT",
+	28: "AAAA", 33: "SRV", 35: "NAPTR", 41: "OPT", 43: "DS", 46: "RRSIG",
+	48: "DNSKEY", 64: "SVCB", 65: "HTTPS", 255: "ANY",
+}
+
+// EDNS is the OPT pseudo-record of RFC 6891
+type EDNS struct {
+	UDPSize  uint16
+	Version  uint8
+	DNSSECOK bool
+	Options  []EDNSOption
+}
+
+// EDNSOption is an EDNS0 option
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+// EDNS0 option codes
+const (
+	EDNSClientSubnet = 8
+	EDNSCookie       = 10
+	EDNSPadding      = 12
+)
+
+// ClientSubnet returns the EDNS Client Subnet (RFC 7871) the query
+// discloses to upstream resolvers, e.g. "203.0.113.0/24", or ""
+func (e *EDNS) ClientSubnet() string {
+	if e == nil {
+		return ""
+	}
+	for _, opt := range e.Options {
+		// family, source prefix length, scope prefix length, address
+		if opt.Code != EDNSClientSubnet || len(opt.Data) < 4 {
+			continue
+		}
+		family, bits := binary.BigEndian.Uint16(opt.Data[0:2]), int(opt.Data[2])
+		size := 0
+		switch family {
+		case 1:
+			size = net.IPv4len
+		case 2:
+			size = net.IPv6len
+		}
+		if size == 0 || len(opt.Data)-4 > size {
+			continue
+		}
+		ip := make(net.IP, size)
+		copy(ip, opt.Data[4:])
+		return fmt.Sprintf("%s/%d", ip, bits)
+	}
+	return ""
+}
+
+// ParseDNS decodes a DNS message as carried over UDP
+func ParseDNS(msg []byte) (DNSMessage, error) {
+	var m DNSMessage
+	if len(msg) < 12 {
+		return m, fmt.Errorf("dns: short header")
+	}
+
+	m.ID = binary.BigEndian.Uint16(msg[0:2])
+	flags := binary.BigEndian.Uint16(msg[2:4])
+	m.Response = flags&0x8000 != 0
+	m.Opcode = int(flags>>11) & 0xf
+	m.RCode = int(flags & 0xf)
+	qdcount := int(binary.BigEndian.Uint16(msg[4:6]))
+	m.Answers = int(binary.BigEndian.Uint16(msg[6:8]))
+	nscount := int(binary.BigEndian.Uint16(msg[8:10]))
+	arcount := int(binary.BigEndian.Uint16(msg[10:12]))
+
+	offset := 12
+	for i := 0; i < qdcount; i++ {
+		name, end, err := dnsName(msg, offset)
+		if err != nil {
+			return m, err
+		}
+		if len(msg) < end+4 {
+			return m, fmt.Errorf("dns: short question")
+		}
+		m.Questions = append(m.Questions, DNSQuestion{
+			Name:  name,
+			Type:  binary.BigEndian.Uint16(msg[end : end+2]),
+			Class: binary.BigEndian.Uint16(msg[end+2 : end+4]),
+		})
+		offset = end + 4
+	}
+
+	// Skip answers and authority, then look for OPT among the additionals
+	for i := 0; i < m.Answers+nscount+arcount; i++ {
+		_, end, err := dnsName(msg, offset)
+		if err != nil {
+			return m, err
+		}
+		// type, class, ttl, rdlength
+		if len(msg) < end+10 {
+			return m, fmt.Errorf("dns: short record")
+		}
+		rrType := binary.BigEndian.Uint16(msg[end : end+2])
+		class := binary.BigEndian.Uint16(msg[end+2 : end+4])
+		ttl := binary.BigEndian.Uint32(msg[end+4 : end+8])
+		length := int(binary.BigEndian.Uint16(msg[end+8 : end+10]))
+		rdata := end + 10
+		if len(msg) < rdata+length {
+			return m, fmt.Errorf("dns: short record data")
+		}
+
+		if rrType == 41 && i >= m.Answers+nscount {
+			// OPT reuses class for the UDP size and the TTL for the
+			// extended rcode, version and flags
+			m.EDNS = &EDNS{
+				UDPSize:  class,
+				Version:  uint8(ttl >> 16),
+				DNSSECOK: ttl&0x8000 != 0,
+			}
+			m.RCode |= int(ttl>>24) << 4
+			m.EDNS.Options = ednsOptions(msg[rdata : rdata+length])
+		}
+		offset = rdata + length
+	}
+	return m, nil
+}
+
+func ednsOptions(data []byte) []EDNSOption {
+	var opts []EDNSOption
+	for len(data) >= 4 {
+		code, length := binary.BigEndian.Uint16(data[0:2]), int(binary.BigEndian.Uint16(data[2:4]))
+		if len(data) < 4+length {
+			break
+		}
+		opts = append(opts, EDNSOption{Code: code, Data: data[4 : 4+length]})
+		data = data[4+length:]
+	}
+	return opts
+}
+
+// SplitTCPDNS splits a TCP byte stream into DNS messages, each of which
+// is preceded by a two-byte length (RFC 1035 4.2.2). Bytes of an
+// incomplete last message are returned as rest.
+func SplitTCPDNS(stream []byte) (msgs [][]byte, rest []byte) {
+	for len(stream) >= 2 {
+		length := int(binary.BigEndian.Uint16(stream[0:2]))
+		if len(stream) < 2+length {
+			break
+		}
+		msgs = append(msgs, stream[2:2+length])
+		stream = stream[2+length:]
+	}
+	return msgs, stream
+}
+
+// dnsName reads a possibly compressed name at offset, returning it and
+// the offset just after it
+func dnsName(msg []byte, offset int) (string, int, error) {
+	var labels []string
+	end := -1
+	// Names have at most 127 labels and pointers must go backwards, so
+	// this bounds the loop
+	for steps := 0; steps < 256; steps++ {
+		if offset >= len(msg) {
+			return "", 0, fmt.Errorf("dns: name out of bounds")
+		}
+		length := int(msg[offset])
+
+		switch {
+		case length == 0:
+			if end < 0 {
+				end = offset + 1
+			}
+			if len(labels) == 0 {
+				return ".", end, nil
+			}
+			return strings.Join(labels, "."), end, nil
+		case length&0xc0 == 0xc0:
+			if offset+1 >= len(msg) {
+				return "", 0, fmt.Errorf("dns: name out of bounds")
+			}
+			if end < 0 {
+				end = offset + 2
+			}
+			target := int(binary.BigEndian.Uint16(msg[offset:offset+2]) & 0x3fff)
+			if target >= offset {
+				return "", 0, fmt.Errorf("dns: bad compression pointer")
+			}
+			offset = target
+		case length&0xc0 != 0:
+			return "", 0, fmt.Errorf("dns: bad label length")
+		default:
+			if offset+1+length > len(msg) {
+				return "", 0, fmt.Errorf("dns: name out of bounds")
+			}
+			labels = append(labels, string(msg[offset+1:offset+1+length]))
+			offset += 1 + length
+		}
+	}
+	return "", 0, fmt.Errorf("dns: too many labels")
+}
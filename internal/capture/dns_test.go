@@ -0,0 +1,166 @@
+package capture
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// describe summarises a DNS message in one line
+func describe(m DNSMessage, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	kind := "query"
+	if m.Response {
+		kind = fmt.Sprintf("response rcode %d answers %d", m.RCode, m.Answers)
+	}
+	s := fmt.Sprintf("%#04x %s", m.ID, kind)
+	for _, q := range m.Questions {
+		s += fmt.Sprintf(" %s %s", q.Name, q.TypeName())
+	}
+	if e := m.EDNS; e != nil {
+		s += fmt.Sprintf(" [edns %d do %t", e.UDPSize, e.DNSSECOK)
+		for _, opt := range e.Options {
+			s += fmt.Sprintf(" opt %d/%d", opt.Code, len(opt.Data))
+		}
+		if subnet := e.ClientSubnet(); subnet != "" {
+			s += " ecs " + subnet
+		}
+		s += "]"
+	}
+	return s
+}
+
+func TestParseDNS(t *testing.T) {
+	tests := map[string][]string{
+		"linux-eth0.pcap": {
+			"0x5cd3 query www.example.com A [edns 1200 do false]",
+			"0xfbeb query www.example.com AAAA [edns 1200 do false]",
+			"0xfbeb response rcode 3 answers 0 www.example.com AAAA [edns 8192 do false]",
+			"0x5cd3 response rcode 3 answers 0 www.example.com A [edns 8192 do false]",
+			// glibc writes both queries at once, so they share a segment
+			"tcp: 0xd6e3 query example.org A, 0x27e8 query example.org AAAA",
+			"tcp: 0xd6e3 query example.org A, 0x27e8 query example.org AAAA",
+		},
+		"linux-lo.pcap": {
+			"0x706b query example.net A [edns 1200 do false]",
+			"0x246f query example.net AAAA [edns 1200 do false]",
+			"0x706b query example.net A [edns 1200 do false]",
+			"0x246f query example.net AAAA [edns 1200 do false]",
+			"tcp: 0x1d2b query example.com A, 0x172f query example.com AAAA",
+		},
+		"synthetic-pflog.pcap": {
+			"0x1a2b query example.com A [edns 1232 do true opt 8/7 ecs 203.0.113.0/24]",
+			"0x2b3c query www.example.org AAAA",
+			"tcp: 0x3c4d query api.example.net HTTPS [edns 1232 do false]",
+		},
+		"synthetic-lo0.pcapng": {
+			"0x0007 query example.com A",
+			// The answers' names are compressed; the OPT record after them
+			// is only found by following the pointers
+			"0x0007 response rcode 0 answers 2 example.com A [edns 1232 do false]",
+			"0x0008 query example.com AAAA [edns 4096 do false]",
+		},
+		"synthetic-ethernet.pcap": {
+			"0x0101 query intranet.corp.example A",
+			"0x0202 query example.com AAAA [edns 1232 do false opt 12/20]",
+			"tcp: 0x0303 query a.example.com A, 0x0304 query b.example.com A (5 bytes left)",
+			"error: dns: name out of bounds",
+		},
+	}
+
+	for file, want := range tests {
+		t.Run(file, func(t *testing.T) {
+			var got []string
+			for _, pkt := range readFixture(t, file) {
+				f, err := Decode(pkt)
+				if err != nil || len(f.IP.Payload) == 0 {
+					continue
+				}
+				if f.IP.Proto == "udp" {
+					got = append(got, describe(ParseDNS(f.IP.Payload)))
+					continue
+				}
+				msgs, rest := SplitTCPDNS(f.IP.Payload)
+				var parsed []string
+				for _, msg := range msgs {
+					parsed = append(parsed, describe(ParseDNS(msg)))
+				}
+				s := "tcp: " + strings.Join(parsed, ", ")
+				if len(rest) > 0 {
+					s += fmt.Sprintf(" (%d bytes left)", len(rest))
+				}
+				got = append(got, strings.TrimSpace(s))
+			}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("parsed:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestParseDNSMalformed(t *testing.T) {
+	header := func(qdcount byte) []byte { return []byte{0, 1, 1, 0, 0, qdcount, 0, 0, 0, 0, 0, 0} }
+	tests := []struct {
+		name string
+		msg  []byte
+		want string
+	}{
+		{name: "short header", msg: header(1)[:11], want: "error: dns: short header"},
+		{
+			// A second question that reuses the first one's name
+			name: "compressed question",
+			msg:  append(header(2), 7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0, 0, 1, 0, 1, 3, 'w', 'w', 'w', 0xc0, 12, 0, 28, 0, 1),
+			want: "0x0001 query example.com A www.example.com AAAA",
+		},
+		{name: "root", msg: append(header(1), 0, 0, 2, 0, 1), want: "0x0001 query . NS"},
+		{name: "unknown type", msg: append(header(1), 0, 0xff, 0xfe, 0, 1), want: "0x0001 query . TYPE65534"},
+		{name: "pointer loop", msg: append(header(1), 0xc0, 12, 0, 1, 0, 1), want: "error: dns: bad compression pointer"},
+		{name: "forward pointer", msg: append(header(1), 0xc0, 14, 0, 0, 1, 0, 1), want: "error: dns: bad compression pointer"},
+		{name: "label past the end", msg: append(header(1), 9, 'e', 'x'), want: "error: dns: name out of bounds"},
+		{name: "reserved label type", msg: append(header(1), 0x40, 0, 0, 1, 0, 1), want: "error: dns: bad label length"},
+		{name: "short question", msg: append(header(1), 0, 0, 1), want: "error: dns: short question"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := describe(ParseDNS(tt.msg)); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitTCPDNS(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream []byte
+		msgs   [][]byte
+		rest   []byte
+	}{
+		{name: "empty"},
+		{name: "one", stream: []byte{0, 3, 'a', 'b', 'c'}, msgs: [][]byte{[]byte("abc")}},
+		{name: "two and a length", stream: []byte{0, 1, 'a', 0, 2, 'b', 'c', 0}, msgs: [][]byte{[]byte("a"), []byte("bc")}, rest: []byte{0}},
+		{name: "incomplete", stream: []byte{0, 5, 'a', 'b'}, rest: []byte{0, 5, 'a', 'b'}},
+		{name: "zero length", stream: []byte{0, 0, 0, 1, 'a'}, msgs: [][]byte{{}, []byte("a")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msgs, rest := SplitTCPDNS(tt.stream)
+			if len(msgs) != len(tt.msgs) {
+				t.Fatalf("got %d messages %q, want %q", len(msgs), msgs, tt.msgs)
+			}
+			for i := range msgs {
+				if !bytes.Equal(msgs[i], tt.msgs[i]) {
+					t.Errorf("message %d is %q, want %q", i, msgs[i], tt.msgs[i])
+				}
+			}
+			if !bytes.Equal(rest, tt.rest) {
+				t.Errorf("rest is %q, want %q", rest, tt.rest)
+			}
+		})
+	}
+}
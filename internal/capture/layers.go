@@ -0,0 +1,258 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Frame is a decoded packet: its link layer metadata and the IP packet
+type Frame struct {
+	Time time.Time
+	// Interface is where the packet was captured or, for pflog, the
+	// interface pf saw it on; empty when the capture doesn't say
+	Interface string
+	// Pflog is set for packets logged by pf
+	Pflog *PflogHeader
+	IP    IPPacket
+}
+
+// Decode parses a packet's link layer and its IPv4 or IPv6 packet
+func Decode(p Packet) (Frame, error) {
+	f := Frame{Time: p.Time, Interface: p.Interface}
+
+	var data []byte
+	switch p.LinkType {
+	case LinkEthernet:
+		var err error
+		if data, err = ethernetPayload(p.Data); err != nil {
+			return f, err
+		}
+	case LinkNull, LinkLoop:
+		// A 4-byte address family, in host order for NULL and network
+		// order for LOOP; the IP version nibble says the same
+		if len(p.Data) < 4 {
+			return f, fmt.Errorf("loopback: short header")
+		}
+		data = p.Data[4:]
+	case LinkRaw:
+		data = p.Data
+	case LinkPflog:
+		hdr, rest, err := ParsePflog(p.Data)
+		if err != nil {
+			return f, err
+		}
+		f.Pflog, f.Interface, data = &hdr, hdr.Interface, rest
+	default:
+		return f, fmt.Errorf("unsupported link type %s", p.LinkType)
+	}
+
+	ip, err := ParseIP(data)
+	if err != nil {
+		return f, err
+	}
+	f.IP = ip
+	return f, nil
+}
+
+// Ethernet types
+const (
+	etherIPv4 = 0x0800
+	etherIPv6 = 0x86dd
+	etherVLAN = 0x8100
+	etherQinQ = 0x88a8
+)
+
+// ethernetPayload returns the IP packet in an Ethernet frame, skipping
+// VLAN tags
+func ethernetPayload(data []byte) ([]byte, error) {
+	if len(data) < 14 {
+		return nil, fmt.Errorf("ethernet: short frame")
+	}
+	etherType, rest := binary.BigEndian.Uint16(data[12:14]), data[14:]
+	for etherType == etherVLAN || etherType == etherQinQ {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("ethernet: short VLAN tag")
+		}
+		etherType, rest = binary.BigEndian.Uint16(rest[2:4]), rest[4:]
+	}
+	if etherType != etherIPv4 && etherType != etherIPv6 {
+		return nil, fmt.Errorf("ethernet: not IP (type %#04x)", etherType)
+	}
+	return rest, nil
+}
+
+// PflogHeader is the part of pf's struct pfloghdr that says what pf did
+// with a packet and who sent it. UID and PID are only filled in by
+// 'log (user)' rules.
+type PflogHeader struct {
+	Family uint8
+	// Action is PflogPass or PflogDrop, among others
+	Action    uint8
+	Interface string
+	Ruleset   string
+	RuleNr    uint32
+	UID       uint32
+	PID       int32
+	Outbound  bool
+}
+
+// pf actions
+const (
+	PflogPass = 0
+	PflogDrop = 1
+)
+
+// PflogNoPID is the PID pf logs when it couldn't find the sending socket
+const PflogNoPID = 99999
+
+// pflogMinLength is the size of struct pfloghdr before padding
+const pflogMinLength = 61
+
+// ParsePflog splits a pflog frame into its header and the IP packet
+func ParsePflog(data []byte) (PflogHeader, []byte, error) {
+	var h PflogHeader
+	// length, af, action, reason, ifname[16], ruleset[16], rulenr,
+	// subrulenr, uid, pid, rule_uid, rule_pid, dir
+	if len(data) < pflogMinLength || data[0] < pflogMinLength {
+		return h, nil, fmt.Errorf("pflog: short header")
+	}
+
+	h.Family, h.Action = data[1], data[2]
+	h.Interface = cString(data[4:20])
+	h.Ruleset = cString(data[20:36])
+	h.RuleNr = binary.BigEndian.Uint32(data[36:40])
+	// uid and pid are in host order, which is little-endian on every Mac
+	h.UID = binary.LittleEndian.Uint32(data[44:48])
+	h.PID = int32(binary.LittleEndian.Uint32(data[48:52]))
+	// PF_OUT is 2
+	h.Outbound = data[60] == 2
+
+	// The header is padded to a multiple of 4 bytes
+	length := (int(data[0]) + 3) &^ 3
+	if length > len(data) {
+		return h, nil, fmt.Errorf("pflog: short header")
+	}
+	return h, data[length:], nil
+}
+
+// cString reads a NUL-terminated string from a fixed-size field
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// IPPacket is the part of an IPv4 or IPv6 packet leak analysis needs
+type IPPacket struct {
+	Version  int
+	Src, Dst net.IP
+	// Proto is "udp" or "tcp"
+	Proto            string
+	SrcPort, DstPort uint16
+	// TCPFlags are the TCP header flags, e.g. TCPSyn
+	TCPFlags uint8
+	// Seq is the TCP sequence number
+	Seq uint32
+	// Payload is the UDP or TCP payload
+	Payload []byte
+}
+
+// TCP flags
+const (
+	TCPFin = 0x01
+	TCPSyn = 0x02
+	TCPRst = 0x04
+)
+
+// IP protocol numbers, including the IPv6 extension headers ParseIP skips
+const (
+	protoHopByHop    = 0
+	protoTCP         = 6
+	protoUDP         = 17
+	protoRouting     = 43
+	protoFragment    = 44
+	protoDestOptions = 60
+)
+
+// ParseIP decodes an IPv4 or IPv6 packet carrying UDP or TCP. Fragments
+// after the first can't be decoded and return an error.
+func ParseIP(data []byte) (IPPacket, error) {
+	var p IPPacket
+	if len(data) < 1 {
+		return p, fmt.Errorf("ip: empty packet")
+	}
+
+	var proto byte
+	var rest []byte
+	switch p.Version = int(data[0] >> 4); p.Version {
+	case 4:
+		headerLen := int(data[0]&0x0f) * 4
+		if len(data) < 20 || headerLen < 20 || len(data) < headerLen {
+			return p, fmt.Errorf("ipv4: short packet")
+		}
+		if binary.BigEndian.Uint16(data[6:8])&0x1fff != 0 {
+			return p, fmt.Errorf("ipv4: non-initial fragment")
+		}
+		// Ethernet pads short frames; the total length trims it
+		total := int(binary.BigEndian.Uint16(data[2:4]))
+		if total < headerLen || total > len(data) {
+			total = len(data)
+		}
+		proto = data[9]
+		p.Src, p.Dst = net.IP(data[12:16]), net.IP(data[16:20])
+		rest = data[headerLen:total]
+	case 6:
+		if len(data) < 40 {
+			return p, fmt.Errorf("ipv6: short packet")
+		}
+		proto = data[6]
+		p.Src, p.Dst = net.IP(data[8:24]), net.IP(data[24:40])
+		rest = data[40:]
+		if payload := int(binary.BigEndian.Uint16(data[4:6])); payload > 0 && payload < len(rest) {
+			rest = rest[:payload]
+		}
+
+		for proto == protoHopByHop || proto == protoRouting || proto == protoDestOptions || proto == protoFragment {
+			if len(rest) < 8 {
+				return p, fmt.Errorf("ipv6: short extension header")
+			}
+			length := (int(rest[1]) + 1) * 8
+			if proto == protoFragment {
+				if binary.BigEndian.Uint16(rest[2:4])&0xfff8 != 0 {
+					return p, fmt.Errorf("ipv6: non-initial fragment")
+				}
+				length = 8
+			}
+			if len(rest) < length {
+				return p, fmt.Errorf("ipv6: short extension header")
+			}
+			proto, rest = rest[0], rest[length:]
+		}
+	default:
+		return p, fmt.Errorf("ip: unknown version %d", p.Version)
+	}
+
+	switch proto {
+	case protoUDP:
+		if len(rest) < 8 {
+			return p, fmt.Errorf("udp: short header")
+		}
+		p.Proto, p.Payload = "udp", rest[8:]
+	case protoTCP:
+		if len(rest) < 20 || len(rest) < int(rest[12]>>4)*4 {
+			return p, fmt.Errorf("tcp: short header")
+		}
+		p.Proto, p.Payload = "tcp", rest[int(rest[12]>>4)*4:]
+		p.Seq = binary.BigEndian.Uint32(rest[4:8])
+		p.TCPFlags = rest[13]
+	default:
+		return p, fmt.Errorf("ip: unsupported protocol %d", proto)
+	}
+	p.SrcPort = binary.BigEndian.Uint16(rest[0:2])
+	p.DstPort = binary.BigEndian.Uint16(rest[2:4])
+	return p, nil
+}
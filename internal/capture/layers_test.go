@@ -0,0 +1,146 @@
+package capture
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// summary describes a decoded frame in one line, tcpdump style
+func summary(f Frame, err error) string {
+	if err != nil {
+		return "error: " + err.Error()
+	}
+	ip := f.IP
+	s := fmt.Sprintf("%s IPv%d %s %s.%d > %s.%d", f.Interface, ip.Version, ip.Proto, ip.Src, ip.SrcPort, ip.Dst, ip.DstPort)
+	if ip.Proto == "tcp" {
+		s += fmt.Sprintf(" flags %#02x seq %d", ip.TCPFlags, ip.Seq)
+	}
+	s += fmt.Sprintf(" len %d", len(ip.Payload))
+	if h := f.Pflog; h != nil {
+		s += fmt.Sprintf(" [pflog af %d action %d %s rule %d uid %d pid %d out %t]",
+			h.Family, h.Action, h.Ruleset, h.RuleNr, h.UID, h.PID, h.Outbound)
+	}
+	return s
+}
+
+func TestDecode(t *testing.T) {
+	tests := map[string][]string{
+		"linux-eth0.pcap": {
+			" IPv4 udp 192.0.2.2.47068 > 10.255.255.53.53 len 44",
+			" IPv4 udp 192.0.2.2.47068 > 10.255.255.53.53 len 44",
+			" IPv4 udp 10.255.255.53.53 > 192.0.2.2.47068 len 44",
+			" IPv4 udp 10.255.255.53.53 > 192.0.2.2.47068 len 44",
+			" IPv4 tcp 192.0.2.2.50284 > 10.255.255.53.53 flags 0x02 seq 3008492881 len 0",
+			" IPv4 tcp 10.255.255.53.53 > 192.0.2.2.50284 flags 0x12 seq 3948579169 len 0",
+			" IPv4 tcp 192.0.2.2.50284 > 10.255.255.53.53 flags 0x10 seq 3008492882 len 0",
+			" IPv4 tcp 192.0.2.2.50284 > 10.255.255.53.53 flags 0x18 seq 3008492882 len 62",
+			" IPv4 tcp 10.255.255.53.53 > 192.0.2.2.50284 flags 0x10 seq 3948579170 len 0",
+			" IPv4 tcp 10.255.255.53.53 > 192.0.2.2.50284 flags 0x14 seq 3948579170 len 0",
+			" IPv4 tcp 192.0.2.2.50290 > 10.255.255.53.53 flags 0x02 seq 3166474824 len 0",
+			" IPv4 tcp 10.255.255.53.53 > 192.0.2.2.50290 flags 0x12 seq 1553254220 len 0",
+			" IPv4 tcp 192.0.2.2.50290 > 10.255.255.53.53 flags 0x10 seq 3166474825 len 0",
+			" IPv4 tcp 192.0.2.2.50290 > 10.255.255.53.53 flags 0x18 seq 3166474825 len 62",
+			" IPv4 tcp 10.255.255.53.53 > 192.0.2.2.50290 flags 0x10 seq 1553254221 len 0",
+			" IPv4 tcp 10.255.255.53.53 > 192.0.2.2.50290 flags 0x14 seq 1553254221 len 0",
+		},
+		"linux-lo.pcap": {
+			" IPv4 udp 127.0.0.1.54877 > 127.0.0.1.53 len 40",
+			"error: ip: unsupported protocol 1",
+			" IPv4 udp 127.0.0.1.54877 > 127.0.0.1.53 len 40",
+			"error: ip: unsupported protocol 1",
+			" IPv6 udp ::1.49946 > ::1.53 len 40",
+			"error: ip: unsupported protocol 58",
+			" IPv6 udp ::1.49946 > ::1.53 len 40",
+			"error: ip: unsupported protocol 58",
+			" IPv4 tcp 127.0.0.1.48792 > 127.0.0.1.53 flags 0x02 seq 1627029323 len 0",
+			" IPv4 tcp 127.0.0.1.53 > 127.0.0.1.48792 flags 0x12 seq 1128284523 len 0",
+			" IPv4 tcp 127.0.0.1.48792 > 127.0.0.1.53 flags 0x10 seq 1627029324 len 0",
+			" IPv4 tcp 127.0.0.1.48792 > 127.0.0.1.53 flags 0x18 seq 1627029324 len 62",
+			" IPv4 tcp 127.0.0.1.53 > 127.0.0.1.48792 flags 0x10 seq 1128284524 len 0",
+			" IPv4 tcp 127.0.0.1.53 > 127.0.0.1.48792 flags 0x11 seq 1128284524 len 0",
+			" IPv4 tcp 127.0.0.1.48792 > 127.0.0.1.53 flags 0x10 seq 1627029386 len 0",
+			" IPv4 tcp 127.0.0.1.48792 > 127.0.0.1.53 flags 0x11 seq 1627029386 len 0",
+			" IPv4 tcp 127.0.0.1.53 > 127.0.0.1.48792 flags 0x10 seq 1128284525 len 0",
+		},
+		"synthetic-pflog.pcap": {
+			"en0 IPv4 udp 192.168.1.20.53001 > 8.8.8.8.53 len 51 [pflog af 2 action 1 xray-dns rule 3 uid 501 pid 4242 out true]",
+			"en0 IPv6 udp 2001:db8::20.53002 > 2001:4860:4860::8888.53 len 33 [pflog af 30 action 1 xray-dns rule 4 uid 4294967295 pid 99999 out true]",
+			"en0 IPv4 tcp 192.168.1.20.49152 > 1.1.1.1.53 flags 0x02 seq 1000 len 0 [pflog af 2 action 1 xray-dns rule 3 uid 501 pid 4242 out true]",
+			"en0 IPv4 tcp 192.168.1.20.49153 > 9.9.9.9.53 flags 0x18 seq 2001 len 46 [pflog af 2 action 1 xray-dns rule 3 uid 0 pid 5150 out true]",
+		},
+		"synthetic-lo0.pcapng": {
+			"lo0 IPv4 udp 127.0.0.1.60000 > 127.0.0.1.53 len 29",
+			"lo0 IPv4 udp 127.0.0.1.53 > 127.0.0.1.60000 len 74",
+			"lo0 IPv6 udp ::1.60001 > ::1.53 len 40",
+		},
+		"synthetic-ethernet.pcap": {
+			"error: ethernet: not IP (type 0x0806)",
+			// VLAN tagged
+			" IPv4 udp 10.0.0.5.41000 > 10.0.0.1.53 len 39",
+			// Behind a hop-by-hop options header
+			" IPv6 udp 2001:db8::5.41001 > 2001:db8::1.53 len 64",
+			// Two whole queries and the start of a third
+			" IPv4 tcp 10.0.0.5.41002 > 10.0.0.1.53 flags 0x18 seq 7000 len 71",
+			// Cut by the snap length inside the question
+			" IPv4 udp 10.0.0.5.41003 > 10.0.0.1.53 len 22",
+		},
+	}
+
+	for file, want := range tests {
+		t.Run(file, func(t *testing.T) {
+			pkts := readFixture(t, file)
+			var got []string
+			for _, pkt := range pkts {
+				got = append(got, summary(Decode(pkt)))
+			}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("decoded:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	ipv4 := []byte{0x45, 0, 0, 28, 0, 0, 0, 0, 64, 17, 0, 0, 10, 0, 0, 5, 10, 0, 0, 1, 0xa0, 0x28, 0, 53, 0, 8, 0, 0}
+	tests := []struct {
+		name string
+		pkt  Packet
+		want string
+	}{
+		{name: "short ethernet", pkt: Packet{LinkType: LinkEthernet, Data: make([]byte, 10)}, want: "ethernet: short frame"},
+		{name: "short loopback", pkt: Packet{LinkType: LinkLoop, Data: []byte{0, 0}}, want: "loopback: short header"},
+		{name: "short pflog", pkt: Packet{LinkType: LinkPflog, Data: make([]byte, 40)}, want: "pflog: short header"},
+		{name: "unknown link", pkt: Packet{LinkType: 228, Data: ipv4}, want: "unsupported link type linktype 228"},
+		{name: "raw", pkt: Packet{LinkType: LinkRaw, Data: ipv4}},
+		{name: "fragment", pkt: Packet{LinkType: LinkRaw, Data: fragment(ipv4)}, want: "ipv4: non-initial fragment"},
+		{name: "icmp", pkt: Packet{LinkType: LinkRaw, Data: icmp(ipv4)}, want: "ip: unsupported protocol 1"},
+		{name: "short udp", pkt: Packet{LinkType: LinkRaw, Data: ipv4[:24]}, want: "udp: short header"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Decode(tt.pkt)
+			switch {
+			case tt.want == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.want != "" && (err == nil || err.Error() != tt.want):
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// fragment makes an IPv4 packet a later fragment
+func fragment(packet []byte) []byte {
+	p := append([]byte(nil), packet...)
+	p[7] = 0xb9
+	return p
+}
+
+// icmp changes an IPv4 packet's protocol to ICMP
+func icmp(packet []byte) []byte {
+	p := append([]byte(nil), packet...)
+	p[9] = 1
+	return p
+}
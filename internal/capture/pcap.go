@@ -0,0 +1,359 @@
+// Package capture decodes packet captures for leak forensics: pcap and
+// pcapng files, the link layers saferay sees (Ethernet, loopback, raw IP
+// and pflog), IPv4/IPv6 with UDP/TCP, and DNS messages. It needs no
+// external tools or cgo.
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"time"
+)
+
+// LinkType is a pcap LINKTYPE_ value
+type LinkType uint32
+
+// Link types Decode understands
+const (
+	LinkNull     LinkType = 0
+	LinkEthernet LinkType = 1
+	LinkRaw      LinkType = 101
+	LinkLoop     LinkType = 108
+	LinkPflog    LinkType = 117
+)
+
+func (l LinkType) String() string {
+	switch l {
+	case LinkNull:
+		return "loopback"
+	case LinkEthernet:
+		return "ethernet"
+	case LinkRaw:
+		return "raw"
+	case LinkLoop:
+		return "loop"
+	case LinkPflog:
+		return "pflog"
+	}
+	return fmt.Sprintf("linktype %d", uint32(l))
+}
+
+// maxPacket bounds a packet's length so a corrupt file can't make the
+// reader allocate gigabytes
+const maxPacket = 1 << 18
+
+// Packet is one captured packet
+type Packet struct {
+	Time     time.Time
+	LinkType LinkType
+	// Interface is the capture interface's name, when the file records it
+	// (pcapng); empty otherwise
+	Interface string
+	Data      []byte
+}
+
+// Reader reads packets from a pcap or pcapng stream, such as a file or the
+// output of 'tcpdump -w -'
+type Reader struct {
+	r io.Reader
+	// next reads a packet in the detected format
+	next func() (Packet, error)
+
+	// classic pcap
+	order    binary.ByteOrder
+	nanos    bool
+	linkType LinkType
+
+	// pcapng
+	interfaces []ngInterface
+}
+
+// Classic pcap magic numbers, as read big-endian
+const (
+	pcapMicros        = 0xa1b2c3d4
+	pcapNanos         = 0xa1b23c4d
+	pcapMicrosSwapped = 0xd4c3b2a1
+	pcapNanosSwapped  = 0x4d3cb2a1
+)
+
+// pcapng block types and options
+const (
+	ngSectionHeader  = 0x0a0d0d0a
+	ngByteOrderMagic = 0x1a2b3c4d
+	ngInterfaceBlock = 1
+	ngObsoletePacket = 2
+	ngSimplePacket   = 3
+	ngEnhancedPacket = 6
+
+	ngOptionEnd     = 0
+	ngOptionIfName  = 2
+	ngOptionTSResol = 9
+
+	// ngMaxBlock bounds a block's length like maxPacket
+	ngMaxBlock = maxPacket + 4096
+)
+
+// ngInterface is an interface described by a pcapng Interface Description
+// Block
+type ngInterface struct {
+	linkType LinkType
+	name     string
+	// unitsPerSecond is the timestamp resolution, microseconds by default
+	unitsPerSecond uint64
+}
+
+// NewReader detects the format from the first bytes of r
+func NewReader(r io.Reader) (*Reader, error) {
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(r, magic); err != nil {
+		return nil, fmt.Errorf("pcap: reading header: %w", err)
+	}
+
+	p := &Reader{r: r}
+	switch binary.BigEndian.Uint32(magic) {
+	case ngSectionHeader:
+		if err := p.readSectionHeader(); err != nil {
+			return nil, err
+		}
+		p.next = p.nextNg
+		return p, nil
+	case pcapMicros:
+		p.order = binary.BigEndian
+	case pcapNanos:
+		p.order, p.nanos = binary.BigEndian, true
+	case pcapMicrosSwapped:
+		p.order = binary.LittleEndian
+	case pcapNanosSwapped:
+		p.order, p.nanos = binary.LittleEndian, true
+	default:
+		return nil, fmt.Errorf("pcap: not a pcap or pcapng file (magic %x)", magic)
+	}
+
+	// The rest of the 24-byte file header
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("pcap: reading header: %w", err)
+	}
+	p.linkType = LinkType(p.order.Uint32(header[16:20]) & 0x0fffffff)
+	p.next = p.nextClassic
+	return p, nil
+}
+
+// Next returns the next packet, or io.EOF at the end of the stream. A
+// truncated last packet, as left by an interrupted capture, is treated as
+// the end.
+func (p *Reader) Next() (Packet, error) {
+	return p.next()
+}
+
+func (p *Reader) nextClassic() (Packet, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(p.r, header); err != nil {
+		return Packet{}, eof(err)
+	}
+
+	sec, frac := p.order.Uint32(header[0:4]), p.order.Uint32(header[4:8])
+	length := p.order.Uint32(header[8:12])
+	if length > maxPacket {
+		return Packet{}, fmt.Errorf("pcap: packet length %d too large", length)
+	}
+
+	data := make([]byte, length)
+	if _, err := io.ReadFull(p.r, data); err != nil {
+		return Packet{}, eof(err)
+	}
+
+	nsec := int64(frac) * 1000
+	if p.nanos {
+		nsec = int64(frac)
+	}
+	return Packet{Time: time.Unix(int64(sec), nsec), LinkType: p.linkType, Data: data}, nil
+}
+
+// eof maps a short read to io.EOF
+func eof(err error) error {
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		return io.EOF
+	}
+	return err
+}
+
+// readSectionHeader reads a pcapng Section Header Block whose type has
+// already been read, setting the byte order for the section
+func (p *Reader) readSectionHeader() error {
+	head := make([]byte, 8)
+	if _, err := io.ReadFull(p.r, head); err != nil {
+		return fmt.Errorf("pcapng: reading section header: %w", err)
+	}
+	switch {
+	case binary.LittleEndian.Uint32(head[4:8]) == ngByteOrderMagic:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(head[4:8]) == ngByteOrderMagic:
+		p.order = binary.BigEndian
+	default:
+		return fmt.Errorf("pcapng: bad byte-order magic")
+	}
+
+	length := p.order.Uint32(head[0:4])
+	if length < 28 || length > ngMaxBlock {
+		return fmt.Errorf("pcapng: bad section header length %d", length)
+	}
+	// The rest of the block: version, section length, options, length
+	if _, err := io.CopyN(io.Discard, p.r, int64(length)-12); err != nil {
+		return fmt.Errorf("pcapng: reading section header: %w", err)
+	}
+	// Interface ids are per section
+	p.interfaces = nil
+	return nil
+}
+
+func (p *Reader) nextNg() (Packet, error) {
+	for {
+		head := make([]byte, 8)
+		if _, err := io.ReadFull(p.r, head); err != nil {
+			return Packet{}, eof(err)
+		}
+
+		if binary.BigEndian.Uint32(head[0:4]) == ngSectionHeader {
+			// A new section; its header starts with the block type and
+			// the length we already read
+			p.r = io.MultiReader(bytes.NewReader(head[4:8]), p.r)
+			if err := p.readSectionHeader(); err != nil {
+				return Packet{}, err
+			}
+			continue
+		}
+
+		blockType, length := p.order.Uint32(head[0:4]), p.order.Uint32(head[4:8])
+		if length < 12 || length > ngMaxBlock || length%4 != 0 {
+			return Packet{}, fmt.Errorf("pcapng: bad block length %d", length)
+		}
+		body := make([]byte, length-8)
+		if _, err := io.ReadFull(p.r, body); err != nil {
+			return Packet{}, eof(err)
+		}
+		// Drop the trailing copy of the length
+		body = body[:len(body)-4]
+
+		switch blockType {
+		case ngInterfaceBlock:
+			if err := p.readInterface(body); err != nil {
+				return Packet{}, err
+			}
+		case ngEnhancedPacket:
+			return p.enhancedPacket(body)
+		case ngSimplePacket:
+			return p.simplePacket(body)
+		case ngObsoletePacket:
+			return p.obsoletePacket(body)
+		}
+		// Other blocks (name resolution, statistics...) are skipped
+	}
+}
+
+func (p *Reader) readInterface(body []byte) error {
+	// link type, reserved, snap length, options
+	if len(body) < 8 {
+		return fmt.Errorf("pcapng: short interface block")
+	}
+	iface := ngInterface{linkType: LinkType(p.order.Uint16(body[0:2])), unitsPerSecond: 1e6}
+
+	for opts := body[8:]; len(opts) >= 4; {
+		code, length := p.order.Uint16(opts[0:2]), int(p.order.Uint16(opts[2:4]))
+		if code == ngOptionEnd || 4+length > len(opts) {
+			break
+		}
+		value := opts[4 : 4+length]
+		switch {
+		case code == ngOptionIfName:
+			iface.name = string(bytes.TrimRight(value, "\x00"))
+		case code == ngOptionTSResol && length == 1:
+			// High bit set: a negative power of two, otherwise of ten
+			exp := value[0] & 0x7f
+			switch {
+			case value[0]&0x80 != 0 && exp < 64:
+				iface.unitsPerSecond = 1 << exp
+			case value[0]&0x80 == 0 && exp <= 19:
+				iface.unitsPerSecond = pow10(exp)
+			default:
+				return fmt.Errorf("pcapng: unsupported timestamp resolution %#x", value[0])
+			}
+		}
+		// Options are padded to 4 bytes
+		opts = opts[4+(length+3)&^3:]
+	}
+
+	p.interfaces = append(p.interfaces, iface)
+	return nil
+}
+
+func (p *Reader) enhancedPacket(body []byte) (Packet, error) {
+	if len(body) < 20 {
+		return Packet{}, fmt.Errorf("pcapng: short packet block")
+	}
+	id := p.order.Uint32(body[0:4])
+	ts := uint64(p.order.Uint32(body[4:8]))<<32 | uint64(p.order.Uint32(body[8:12]))
+	length := p.order.Uint32(body[12:16])
+	if int(length) > len(body)-20 {
+		return Packet{}, fmt.Errorf("pcapng: packet length %d exceeds its block", length)
+	}
+	return p.packet(id, ts, body[20:20+length])
+}
+
+func (p *Reader) simplePacket(body []byte) (Packet, error) {
+	if len(body) < 4 {
+		return Packet{}, fmt.Errorf("pcapng: short packet block")
+	}
+	// Simple packets have no timestamp and only the original length; the
+	// captured data is the rest of the block
+	length := int(p.order.Uint32(body[0:4]))
+	if length > len(body)-4 {
+		length = len(body) - 4
+	}
+	return p.packet(0, 0, body[4:4+length])
+}
+
+func (p *Reader) obsoletePacket(body []byte) (Packet, error) {
+	if len(body) < 20 {
+		return Packet{}, fmt.Errorf("pcapng: short packet block")
+	}
+	id := uint32(p.order.Uint16(body[0:2]))
+	ts := uint64(p.order.Uint32(body[4:8]))<<32 | uint64(p.order.Uint32(body[8:12]))
+	length := p.order.Uint32(body[12:16])
+	if int(length) > len(body)-20 {
+		return Packet{}, fmt.Errorf("pcapng: packet length %d exceeds its block", length)
+	}
+	return p.packet(id, ts, body[20:20+length])
+}
+
+// packet builds a Packet for interface id with a timestamp in that
+// interface's units
+func (p *Reader) packet(id uint32, ts uint64, data []byte) (Packet, error) {
+	if int(id) >= len(p.interfaces) {
+		return Packet{}, fmt.Errorf("pcapng: packet for undeclared interface %d", id)
+	}
+	iface := p.interfaces[id]
+
+	// frac * 1e9 can overflow 64 bits at resolutions finer than 1ns
+	sec, frac := ts/iface.unitsPerSecond, ts%iface.unitsPerSecond
+	hi, lo := bits.Mul64(frac, 1e9)
+	nsec, _ := bits.Div64(hi, lo, iface.unitsPerSecond)
+	return Packet{
+		Time:      time.Unix(int64(sec), int64(nsec)),
+		LinkType:  iface.linkType,
+		Interface: iface.name,
+		Data:      append([]byte(nil), data...),
+	}, nil
+}
+
+func pow10(exp uint8) uint64 {
+	n := uint64(1)
+	for ; exp > 0; exp-- {
+		n *= 10
+	}
+	return n
+}
@@ -0,0 +1,151 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// The linux-* fixtures in testdata were recorded with testdata/record.go,
+// the synthetic-* ones are written by testdata/gen.go
+
+// t0 is when every fixture starts
+var t0 = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// readFixture reads every packet of a capture in testdata
+func readFixture(t *testing.T, name string) []Packet {
+	t.Helper()
+	f, err := os.Open(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	r, err := NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pkts []Packet
+	for {
+		pkt, err := r.Next()
+		if err == io.EOF {
+			return pkts
+		}
+		if err != nil {
+			t.Fatalf("packet %d: %v", len(pkts)+1, err)
+		}
+		pkts = append(pkts, pkt)
+	}
+}
+
+func TestReader(t *testing.T) {
+	tests := []struct {
+		file        string
+		linkType    LinkType
+		iface       string
+		count       int
+		first, last time.Time
+		firstSize   int
+	}{
+		{
+			// Recorded: little-endian microseconds, as tcpdump writes
+			file:      "linux-eth0.pcap",
+			linkType:  LinkEthernet,
+			count:     16,
+			first:     time.Date(2026, 10, 19, 6, 21, 56, 253384000, time.UTC),
+			last:      time.Date(2026, 10, 19, 6, 21, 56, 261679000, time.UTC),
+			firstSize: 14 + 20 + 8 + 44,
+		},
+		{
+			// Recorded: Linux frames loopback as Ethernet
+			file:      "linux-lo.pcap",
+			linkType:  LinkEthernet,
+			count:     17,
+			first:     time.Date(2026, 10, 19, 6, 22, 14, 428828000, time.UTC),
+			last:      time.Date(2026, 10, 19, 6, 22, 16, 241165000, time.UTC),
+			firstSize: 14 + 20 + 8 + 40,
+		},
+		{
+			// The last packet is cut off
+			file:      "synthetic-pflog.pcap",
+			linkType:  LinkPflog,
+			count:     4,
+			first:     t0.Add(125 * time.Millisecond),
+			last:      t0.Add(2 * time.Second),
+			firstSize: 64 + 20 + 8 + 51,
+		},
+		{
+			// pcapng with nanosecond timestamps and a statistics block
+			file:      "synthetic-lo0.pcapng",
+			linkType:  LinkNull,
+			iface:     "lo0",
+			count:     3,
+			first:     t0.Add(1234),
+			last:      t0.Add(time.Second),
+			firstSize: 4 + 20 + 8 + 29,
+		},
+		{
+			// Big-endian nanoseconds; the last packet hit the snap length
+			file:      "synthetic-ethernet.pcap",
+			linkType:  LinkEthernet,
+			count:     5,
+			first:     t0.Add(10 * time.Millisecond),
+			last:      t0.Add(50 * time.Millisecond),
+			firstSize: 14 + 28,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.file, func(t *testing.T) {
+			pkts := readFixture(t, tt.file)
+			if len(pkts) != tt.count {
+				t.Fatalf("read %d packets, want %d", len(pkts), tt.count)
+			}
+			for i, pkt := range pkts {
+				if pkt.LinkType != tt.linkType || pkt.Interface != tt.iface {
+					t.Errorf("packet %d: link type %s on %q, want %s on %q", i+1, pkt.LinkType, pkt.Interface, tt.linkType, tt.iface)
+				}
+				if i > 0 && pkt.Time.Before(pkts[i-1].Time) {
+					t.Errorf("packet %d: time goes backwards", i+1)
+				}
+			}
+			for _, c := range []struct {
+				pkt  Packet
+				want time.Time
+			}{{pkts[0], tt.first}, {pkts[len(pkts)-1], tt.last}} {
+				if !c.pkt.Time.Equal(c.want) {
+					t.Errorf("time %s, want %s", c.pkt.Time.UTC().Format(time.RFC3339Nano), c.want.Format(time.RFC3339Nano))
+				}
+			}
+			if len(pkts[0].Data) != tt.firstSize {
+				t.Errorf("first packet is %d bytes, want %d", len(pkts[0].Data), tt.firstSize)
+			}
+		})
+	}
+}
+
+func TestNewReaderRejects(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{name: "empty", data: nil, want: "reading header"},
+		{name: "text", data: []byte("not a capture\n"), want: "not a pcap or pcapng file"},
+		{name: "short pcap header", data: []byte{0xd4, 0xc3, 0xb2, 0xa1, 2, 0}, want: "reading header"},
+		{name: "pcapng byte order", data: []byte{0x0a, 0x0d, 0x0d, 0x0a, 28, 0, 0, 0, 1, 2, 3, 4}, want: "bad byte-order magic"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(bytes.NewReader(tt.data))
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want one containing %q", err, tt.want)
+			}
+		})
+	}
+}
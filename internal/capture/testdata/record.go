@@ -0,0 +1,95 @@
+//go:build ignore
+
+// record captures a Linux interface to a pcap the way 'tcpdump -w' does,
+// for hosts without tcpdump: little-endian microsecond timestamps,
+// LINKTYPE_ETHERNET, and on loopback each packet once rather than on the
+// way out and again on the way in. It needs root.
+//
+//	go run testdata/record.go -i eth0 -t 5s -o testdata/linux-eth0.pcap
+//
+// The linux-* fixtures were recorded with it. Their traffic is glibc's
+// stub resolver looking names up with its own resolv.conf:
+//
+//	unshare -m sh -c 'mount --bind my-resolv.conf /etc/resolv.conf && getent ahosts example.com'
+//
+// linux-eth0.pcap has A and AAAA queries with 'options edns0' to the
+// host's resolver, which answers NXDOMAIN, then the same with 'options
+// use-vc' over TCP, which it resets. linux-lo.pcap has them to 127.0.0.1
+// and ::1 with nothing listening, drawing ICMP port unreachables, then
+// over TCP to a listener that reads them and never answers.
+package main
+
+import (
+	"encoding/binary"
+	"flag"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+func main() {
+	iface := flag.String("i", "lo", "interface")
+	duration := flag.Duration("t", 5*time.Second, "how long to capture")
+	out := flag.String("o", "capture.pcap", "output file")
+	flag.Parse()
+
+	ifi, err := net.InterfaceByName(*iface)
+	if err != nil {
+		log.Fatal(err)
+	}
+	all := htons(syscall.ETH_P_ALL)
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW, int(all))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: all, Ifindex: ifi.Index}); err != nil {
+		log.Fatal(err)
+	}
+	timeout := syscall.Timeval{Usec: 100000}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &timeout); err != nil {
+		log.Fatal(err)
+	}
+
+	f, err := os.Create(*out)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:4], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:6], 2)
+	binary.LittleEndian.PutUint16(header[6:8], 4)
+	binary.LittleEndian.PutUint32(header[16:20], 262144)
+	binary.LittleEndian.PutUint32(header[20:24], 1)
+	if _, err := f.Write(header); err != nil {
+		log.Fatal(err)
+	}
+
+	buf := make([]byte, 262144)
+	count := 0
+	for end := time.Now().Add(*duration); time.Now().Before(end); {
+		n, from, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			continue
+		}
+		// libpcap drops loopback's outgoing copy
+		if ifi.Flags&net.FlagLoopback != 0 && from.(*syscall.SockaddrLinklayer).Pkttype == syscall.PACKET_OUTGOING {
+			continue
+		}
+		now := time.Now()
+		record := make([]byte, 16, 16+n)
+		binary.LittleEndian.PutUint32(record[0:4], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(record[4:8], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:12], uint32(n))
+		binary.LittleEndian.PutUint32(record[12:16], uint32(n))
+		if _, err := f.Write(append(record, buf[:n]...)); err != nil {
+			log.Fatal(err)
+		}
+		count++
+	}
+	log.Printf("%d packets captured on %s", count, *iface)
+}
+
+func htons(v uint16) uint16 { return v<<8 | v>>8 }